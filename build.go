@@ -43,17 +43,24 @@ const (
 	WantToFinish
 )
 
-// commandRunner is an interface that wraps running the build
+// CommandRunner is an interface that wraps running the build
 // subcommands.  This allows tests to abstract out running commands.
-// RealCommandRunner is an implementation that actually runs commands.
-type commandRunner interface {
+// realCommandRunner is an implementation that actually runs commands.
+//
+// See nintest.CommandRunner for a fake implementation.
+type CommandRunner interface {
+	// CanRunMore returns true if another command can be started.
 	CanRunMore() bool
+	// StartCommand starts the command of the edge. Returns false on failure.
 	StartCommand(edge *Edge) bool
 
-	/// Wait for a command to complete, or return false if interrupted.
+	// WaitForCommand waits for a command to complete, or return false if
+	// interrupted.
 	WaitForCommand(result *Result) bool
 
+	// GetActiveEdges returns the edges whose command is running.
 	GetActiveEdges() []*Edge
+	// Abort stops all the running commands.
 	Abort()
 }
 
@@ -76,6 +83,19 @@ type BuildConfig struct {
 	// The maximum load average we must not exceed. A negative or zero value
 	// means that we do not have any limit.
 	MaxLoadAvg float64
+	// SavedOutputs persists the output of the edges run unless its Mode is
+	// OutputNone.
+	SavedOutputs OutputStore
+	// SavedCommands persists the commands of the edges run when its Save is
+	// set, so "-d explain" can show how a command changed.
+	SavedCommands CommandStore
+	// UsePTY runs the commands, except the ones in the console pool, with
+	// their output attached to a pseudo-terminal instead of a pipe, so
+	// compilers print colored diagnostics. Only supported on Linux.
+	UsePTY bool
+	// ToolDeps makes the tool binary run by each command an implicit input of
+	// the edge. See DependencyScan.SetToolDeps.
+	ToolDeps bool
 }
 
 // NewBuildConfig returns the default build configuration.
@@ -172,7 +192,13 @@ func (r *realCommandRunner) CanRunMore() bool {
 
 func (r *realCommandRunner) StartCommand(edge *Edge) bool {
 	command := edge.EvaluateCommand(false)
-	subproc := r.subprocs.Add(command, edge.Pool == ConsolePool)
+	env, clear := edge.EvaluateEnv()
+	subproc := r.subprocs.start(command, subprocessOpts{
+		env:        environ(env, clear),
+		dir:        edge.Cwd(),
+		useConsole: edge.Pool == ConsolePool,
+		pty:        r.config.UsePTY,
+	})
 	if subproc == nil {
 		return false
 	}
@@ -655,7 +681,7 @@ type Builder struct {
 	state         *State
 	config        *BuildConfig
 	plan          plan
-	commandRunner commandRunner
+	commandRunner CommandRunner
 	status        Status
 
 	// Map of running edge to time the edge started running.
@@ -666,6 +692,9 @@ type Builder struct {
 
 	di   DiskInterface
 	scan DependencyScan
+
+	// diagnostics are the compiler diagnostics reported during this build.
+	diagnostics DiagnosticSet
 }
 
 // NewBuilder returns an initialized Builder.
@@ -680,9 +709,26 @@ func NewBuilder(state *State, config *BuildConfig, buildLog *BuildLog, depsLog *
 	}
 	b.plan = newPlan(b)
 	b.scan = NewDependencyScan(state, buildLog, depsLog, di)
+	b.scan.SetToolDeps(config.ToolDeps)
+	b.scan.SetCommandStore(&config.SavedCommands)
 	return b
 }
 
+// SetCommandRunner sets the CommandRunner used to run the edges' commands.
+//
+// By default, commands are run as subprocesses, or not at all in dry run mode.
+func (b *Builder) SetCommandRunner(c CommandRunner) {
+	b.commandRunner = c
+}
+
+// SetDirtyCallback sets a function to be called with each reason why a node
+// is dirty, found while adding targets or loading dyndep files.
+//
+// See DependencyScan.SetDirtyCallback.
+func (b *Builder) SetDirtyCallback(f func(r *DirtyReason)) {
+	b.scan.SetDirtyCallback(f)
+}
+
 // cleanup cleans up after interrupted commands by deleting output files.
 func (b *Builder) cleanup() {
 	if b.commandRunner != nil {
@@ -943,7 +989,29 @@ func (b *Builder) finishCommand(result *Result) error {
 	endTimeMillis = int32(time.Now().UnixMilli() - b.startTimeMillis)
 	delete(b.runningEdges, edge)
 
+	if r, ok := b.status.(ExitCodeReporter); ok {
+		r.BuildEdgeExitCode(edge, result.ExitCode)
+	}
 	b.status.BuildEdgeFinished(edge, endTimeMillis, result.ExitCode == ExitSuccess, result.Output)
+	if r, ok := b.status.(DiagnosticsReporter); ok && result.Output != "" {
+		if diags := b.diagnostics.Add(EdgeDiagnostics(edge, result.Output)); len(diags) != 0 {
+			r.BuildEdgeDiagnostics(edge, diags)
+		}
+	}
+
+	if b.config.SavedOutputs.Mode != OutputNone && !b.config.DryRun {
+		s := &StoredOutput{
+			Path:        edge.Outputs[0].Path,
+			Command:     edge.EvaluateCommand(false),
+			ExitCode:    result.ExitCode,
+			StartMillis: b.startTimeMillis + int64(startTimeMillis),
+			EndMillis:   b.startTimeMillis + int64(endTimeMillis),
+			Output:      result.Output,
+		}
+		if err := b.config.SavedOutputs.Record(s); err != nil {
+			b.status.Warning("saving output of %s: %s", s.Path, err)
+		}
+	}
 
 	// The rest of this function only applies to successful commands.
 	if result.ExitCode != ExitSuccess {
@@ -1023,6 +1091,11 @@ func (b *Builder) finishCommand(result *Result) error {
 			return fmt.Errorf("error writing to build log: %w", err)
 		}
 	}
+	if b.config.SavedCommands.Save && !b.config.DryRun {
+		if err := b.config.SavedCommands.Record(HashCommand(edge.EvaluateCommand(true)), edge.EvaluateCommandWithoutEnv()); err != nil {
+			b.status.Warning("saving command of %s: %s", edge.Outputs[0].Path, err)
+		}
+	}
 
 	if depsType != "" && !b.config.DryRun {
 		if len(edge.Outputs) == 0 {
@@ -1033,7 +1106,7 @@ func (b *Builder) finishCommand(result *Result) error {
 			if depsMtime == -1 {
 				return err
 			}
-			if err := b.scan.depsLog().recordDeps(o, depsMtime, depsNodes); err != nil {
+			if err := b.scan.depsLog().RecordDeps(o, depsMtime, depsNodes); err != nil {
 				return fmt.Errorf("error writing to deps log: %w", err)
 			}
 		}
@@ -1082,8 +1155,9 @@ func (b *Builder) extractDeps(result *Result, depsType string, depsPrefix string
 
 		// XXX check depfile matches expected output.
 		depsNodes := make([]*Node, len(deps.ins))
+		cwd := result.Edge.Cwd()
 		for i, s := range deps.ins {
-			depsNodes[i] = b.state.GetNode(CanonicalizePathBits(s))
+			depsNodes[i] = b.state.GetNode(CanonicalizePathBits(resolveCwdPath(cwd, s)))
 		}
 
 		if !Debug.KeepDepfile {
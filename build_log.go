@@ -23,7 +23,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
-	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -43,6 +43,18 @@ func (l *LogEntry) Equal(r *LogEntry) bool {
 		l.mtime == r.mtime
 }
 
+// CommandHash returns the hash of the command that built the output, as
+// returned by HashCommand().
+func (l *LogEntry) CommandHash() uint64 {
+	return l.commandHash
+}
+
+// DurationMillis returns the time spent running the command that built the
+// output, in milliseconds.
+func (l *LogEntry) DurationMillis() int32 {
+	return l.endTime - l.startTime
+}
+
 // Serialize writes an entry into a log file as a text form.
 func (l *LogEntry) Serialize(w io.Writer) error {
 	_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%x\n", l.startTime, l.endTime, l.mtime, l.output, l.commandHash)
@@ -63,27 +75,21 @@ const (
 )
 
 // unsafeByteSlice converts string to a byte slice without memory allocation.
-func unsafeByteSlice(s string) (b []byte) {
-	/* #nosec G103 */
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+func unsafeByteSlice(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
 	/* #nosec G103 */
-	sh := *(*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh.Data = sh.Data
-	bh.Len = sh.Len
-	bh.Cap = sh.Len
-	return
+	return unsafe.Slice((*byte)(unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&s)).Data)), len(s))
 }
 
 // unsafeUint64Slice converts string to a byte slice without memory allocation.
-func unsafeUint64Slice(s string) (b []uint64) {
-	/* #nosec G103 */
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+func unsafeUint64Slice(s string) []uint64 {
+	if len(s) < 8 {
+		return nil
+	}
 	/* #nosec G103 */
-	sh := *(*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh.Data = sh.Data
-	bh.Len = sh.Len / 8
-	bh.Cap = sh.Len / 8
-	return
+	return unsafe.Slice((*uint64)(unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&s)).Data)), len(s)/8)
 }
 
 // HashCommand hashes a command using the MurmurHash2 algorithm by Austin
@@ -161,7 +167,11 @@ type BuildLogUser interface {
 //
 // 3) restat information.
 type BuildLog struct {
-	Entries           map[string]*LogEntry
+	Entries map[string]*LogEntry
+	// Commands, when set, is pruned of the commands no longer referenced by
+	// Entries when the log is recompacted.
+	Commands *CommandStore
+
 	logFile           *os.File
 	logFilePath       string
 	needsRecompaction bool
@@ -268,175 +278,197 @@ func (b *BuildLog) openForWriteIfNeeded() error {
 	return nil
 }
 
-/*
-type LineReader struct {
-
-  file *FILE
-  char buf[256 << 10]
-  bufEnd *char  // Points one past the last valid byte in |buf|.
-
-  lineStart *char
-  // Points at the next \n in buf after lineStart, or NULL.
-  lineEnd *char
-}
-func NewLineReader(file *FILE) LineReader {
-	return LineReader{
-		file: file,
-		bufEnd: buf,
-		lineStart: buf,
-		lineEnd: nil,
-	}
-	{ memset(buf, 0, sizeof(buf)); }
-}
-// Reads a \n-terminated line from the file passed to the constructor.
-// On return, *lineStart points to the beginning of the next line, and
-// *lineEnd points to the \n at the end of the line. If no newline is seen
-// in a fixed buffer size, *lineEnd is set to NULL. Returns false on EOF.
-func (l *LineReader) ReadLine(lineStart *char*, lineEnd *char*) bool {
-  if l.lineStart >= l.bufEnd || !l.lineEnd {
-    // Buffer empty, refill.
-    sizeRead := fread(l.buf, 1, sizeof(l.buf), l.file)
-    if !sizeRead {
-      return false
-    }
-    l.lineStart = l.buf
-    l.bufEnd = l.buf + sizeRead
-  } else {
-    // Advance to next line in buffer.
-    l.lineStart = l.lineEnd + 1
-  }
-
-  l.lineEnd = (char*)memchr(l.lineStart, '\n', l.bufEnd - l.lineStart)
-  if !l.lineEnd {
-    // No newline. Move rest of data to start of buffer, fill rest.
-    sizeT alreadyConsumed = l.lineStart - l.buf
-    sizeT sizeRest = (l.bufEnd - l.buf) - alreadyConsumed
-    memmove(l.buf, l.lineStart, sizeRest)
-
-    sizeT read = fread(l.buf + sizeRest, 1, sizeof(l.buf) - sizeRest, l.file)
-    l.bufEnd = l.buf + sizeRest + read
-    l.lineStart = l.buf
-    l.lineEnd = (char*)memchr(l.lineStart, '\n', l.bufEnd - l.lineStart)
-  }
-
-  *lineStart = l.lineStart
-  *lineEnd = l.lineEnd
-  return true
-}
-*/
-
 // Load the on-disk log.
 //
 // It can return a warning with success and an error.
 //
 // LoadNotFound is only returned when os.IsNotExist(err) is true.
 func (b *BuildLog) Load(path string) (LoadStatus, error) {
+	return b.LoadWithOpts(path, LogLoadOpts{})
+}
+
+// LoadWithOpts loads the on-disk log with the specified options.
+//
+// Entries are parsed in place, their output path references the file content
+// which is kept alive.
+//
+// It can return a warning with success and an error.
+//
+// LoadNotFound is only returned when os.IsNotExist(err) is true.
+func (b *BuildLog) LoadWithOpts(path string, opts LogLoadOpts) (LoadStatus, error) {
 	defer metricRecord(".ninja_log load")()
-	file, err := ioutil.ReadFile(path)
-	if file == nil {
+	var data []byte
+	var err error
+	if opts.Mmap {
+		data, err = mmapFile(path)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if data == nil {
 		if os.IsNotExist(err) {
 			return LoadNotFound, err
 		}
 		return LoadError, err
 	}
 
-	if len(file) == 0 {
+	if len(data) == 0 {
 		// File was empty.
 		return LoadSuccess, nil
 	}
 
+	// A line without a trailing new line is ignored.
+	end := bytes.IndexByte(data, '\n')
+	if end == -1 {
+		b.needsRecompaction = true
+		return LoadSuccess, nil
+	}
 	logVersion := 0
+	_, _ = fmt.Sscanf(unsafeString(data[:end+1]), buildLogFileSignature, &logVersion)
+	if logVersion < buildLogOldestSupportedVersion {
+		_ = os.Remove(path)
+		// Don't report this as a failure.  An empty build log will cause
+		// us to rebuild the outputs anyway.
+		return LoadSuccess, errors.New("build log version invalid, perhaps due to being too old; starting over")
+	}
+	data = data[end+1:]
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	// Split the content in chunks on line boundaries, parse them concurrently,
+	// then merge the entries in file order so that later entries win.
+	chunks := splitLines(data, opts.Concurrency)
+	results := make([]buildLogChunk, len(chunks))
+	if len(chunks) == 1 {
+		results[0] = parseBuildLogChunk(chunks[0], logVersion)
+	} else {
+		var wg sync.WaitGroup
+		for i := range chunks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = parseBuildLogChunk(chunks[i], logVersion)
+			}(i)
+		}
+		wg.Wait()
+	}
+
 	uniqueEntryCount := 0
 	totalEntryCount := 0
+	for _, r := range results {
+		for i := range r.entries {
+			entry := &r.entries[i]
+			if old, ok := b.Entries[entry.output]; ok {
+				*old = *entry
+			} else {
+				b.Entries[entry.output] = entry
+				uniqueEntryCount++
+			}
+			totalEntryCount++
+		}
+		if r.err != nil {
+			return LoadError, r.err
+		}
+	}
 
-	// TODO(maruel): The LineReader implementation above is significantly faster
-	// because it modifies the data in-place.
-	reader := bytes.NewBuffer(file)
-	for {
-		line, e := reader.ReadString('\n')
-		if e != nil {
+	// Decide whether it's time to rebuild the log:
+	// - if we're upgrading versions
+	// - if it's getting large
+	const minCompactionEntryCount = 100
+	const compactionRatio = 3
+	if logVersion < buildLogCurrentVersion {
+		b.needsRecompaction = true
+	} else if totalEntryCount > minCompactionEntryCount && totalEntryCount > uniqueEntryCount*compactionRatio {
+		b.needsRecompaction = true
+	}
+
+	return LoadSuccess, nil
+}
+
+// splitLines splits data in up to n chunks of roughly equal size, each ending
+// with a new line.
+func splitLines(data []byte, n int) [][]byte {
+	if n <= 1 || len(data) < 64*1024 {
+		return [][]byte{data}
+	}
+	out := make([][]byte, 0, n)
+	size := len(data) / n
+	for len(data) > 0 {
+		if len(out) == n-1 || len(data) <= size {
+			out = append(out, data)
 			break
 		}
-		line = line[:len(line)-1]
-		if logVersion == 0 {
-			_, _ = fmt.Sscanf(line, buildLogFileSignature, &logVersion)
-
-			if logVersion < buildLogOldestSupportedVersion {
-				_ = os.Remove(path)
-				// Don't report this as a failure.  An empty build log will cause
-				// us to rebuild the outputs anyway.
-				return LoadSuccess, errors.New("build log version invalid, perhaps due to being too old; starting over")
-			}
-		}
-		const fieldSeparator = byte('\t')
-		end := strings.IndexByte(line, fieldSeparator)
+		end := bytes.IndexByte(data[size:], '\n') + size + 1
+		out = append(out, data[:end])
+		data = data[end:]
+	}
+	return out
+}
+
+// buildLogChunk is the result of parseBuildLogChunk.
+type buildLogChunk struct {
+	entries []LogEntry
+	err     error
+}
+
+// parseBuildLogChunk parses the lines in data. data must end with a new line.
+//
+// Entries are allocated as one slab. Parsing stops at the first error.
+func parseBuildLogChunk(data []byte, logVersion int) buildLogChunk {
+	const fieldSeparator = byte('\t')
+	out := buildLogChunk{entries: make([]LogEntry, 0, bytes.Count(data, []byte{'\n'}))}
+	for len(data) != 0 {
+		end := bytes.IndexByte(data, '\n')
+		line := data[:end]
+		data = data[end+1:]
+
+		end = bytes.IndexByte(line, fieldSeparator)
 		if end == -1 {
 			continue
 		}
-
-		startTime, err := strconv.ParseInt(line[:end], 10, 32)
+		startTime, err := strconv.ParseInt(unsafeString(line[:end]), 10, 32)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			out.err = fmt.Errorf("invalid build log: %w", err)
+			break
 		}
 		line = line[end+1:]
-		end = strings.IndexByte(line, fieldSeparator)
+		end = bytes.IndexByte(line, fieldSeparator)
 		if end == -1 {
 			continue
 		}
-		endTime, err := strconv.ParseInt(line[:end], 10, 32)
+		endTime, err := strconv.ParseInt(unsafeString(line[:end]), 10, 32)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			out.err = fmt.Errorf("invalid build log: %w", err)
+			break
 		}
 		line = line[end+1:]
-		end = strings.IndexByte(line, fieldSeparator)
+		end = bytes.IndexByte(line, fieldSeparator)
 		if end == -1 {
 			continue
 		}
-		restatMtime, err := strconv.ParseInt(line[:end], 10, 64)
+		restatMtime, err := strconv.ParseInt(unsafeString(line[:end]), 10, 64)
 		if err != nil {
-			return LoadError, fmt.Errorf("invalid build log: %w", err)
+			out.err = fmt.Errorf("invalid build log: %w", err)
+			break
 		}
 		line = line[end+1:]
-		end = strings.IndexByte(line, fieldSeparator)
+		end = bytes.IndexByte(line, fieldSeparator)
 		if end == -1 {
 			continue
 		}
-		output := line[:end]
+		out.entries = append(out.entries, LogEntry{
+			output:    unsafeString(line[:end]),
+			startTime: int32(startTime),
+			endTime:   int32(endTime),
+			mtime:     TimeStamp(restatMtime),
+		})
+		entry := &out.entries[len(out.entries)-1]
 		line = line[end+1:]
-		var entry *LogEntry
-		i, ok := b.Entries[output]
-		if ok {
-			entry = i
-		} else {
-			entry = &LogEntry{output: output}
-			b.Entries[entry.output] = entry
-			uniqueEntryCount++
-		}
-		totalEntryCount++
-
-		// TODO(maruel): Check overflows.
-		entry.startTime = int32(startTime)
-		entry.endTime = int32(endTime)
-		entry.mtime = TimeStamp(restatMtime)
 		if logVersion >= 5 {
-			entry.commandHash, _ = strconv.ParseUint(line, 16, 64)
+			entry.commandHash, _ = strconv.ParseUint(unsafeString(line), 16, 64)
 		} else {
-			entry.commandHash = HashCommand(line)
+			entry.commandHash = HashCommand(unsafeString(line))
 		}
 	}
-
-	// Decide whether it's time to rebuild the log:
-	// - if we're upgrading versions
-	// - if it's getting large
-	const minCompactionEntryCount = 100
-	const compactionRatio = 3
-	if logVersion < buildLogCurrentVersion {
-		b.needsRecompaction = true
-	} else if totalEntryCount > minCompactionEntryCount && totalEntryCount > uniqueEntryCount*compactionRatio {
-		b.needsRecompaction = true
-	}
-
-	return LoadSuccess, nil
+	return out
 }
 
 // Recompact rewrites the known log entries, throwing away old data.
@@ -482,7 +514,12 @@ func (b *BuildLog) Recompact(path string, user BuildLogUser) error {
 	if err = os.Rename(tempPath, path); err != nil {
 		return err
 	}
-	return err
+	if b.Commands != nil {
+		if err = b.Commands.Prune(b.Entries); err != nil {
+			return fmt.Errorf("pruning %s: %w", b.Commands.Dir, err)
+		}
+	}
+	return nil
 }
 
 // Restat recompacts but stat()'s all outputs in the log.
@@ -180,6 +180,47 @@ func TestBuildLogTest_Truncate(t *testing.T) {
 	}
 }
 
+func TestBuildLogTest_LoadWithOpts(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
+	// Make it large enough to be split in chunks. Outputs are repeated so later
+	// entries must win across chunks.
+	content := "# ninja log v5\n"
+	for i := 0; i < 20000; i++ {
+		content += fmt.Sprintf("%d\t%d\t%d\tout%d\t%x\n", i, i+1, i+2, i%1000, i)
+	}
+	if err := ioutil.WriteFile(testFilename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := NewBuildLog()
+	if s, err := want.Load(testFilename); s != LoadSuccess || err != nil {
+		t.Fatal(s, err)
+	}
+	if len(want.Entries) != 1000 {
+		t.Fatal(len(want.Entries))
+	}
+	if e := want.Entries["out1"]; e.startTime != 19001 || e.commandHash != 19001 {
+		t.Fatal(e)
+	}
+	for _, opts := range []LogLoadOpts{{Mmap: true}, {Concurrency: 4}, {Mmap: true, Concurrency: 4}} {
+		got := NewBuildLog()
+		if s, err := got.LoadWithOpts(testFilename, opts); s != LoadSuccess || err != nil {
+			t.Fatal(s, err)
+		}
+		if len(got.Entries) != len(want.Entries) {
+			t.Fatal(opts, len(got.Entries))
+		}
+		for k, v := range want.Entries {
+			if e := got.Entries[k]; e == nil || *e != *v {
+				t.Fatal(opts, k, e, v)
+			}
+		}
+		if got.needsRecompaction != want.needsRecompaction {
+			t.Fatal(opts)
+		}
+	}
+}
+
 func TestBuildLogTest_ObsoleteOldVersion(t *testing.T) {
 	testFilename := filepath.Join(t.TempDir(), "BuildLogTest-tempfile")
 	content := []byte("# ninja log v3\n123 456 0 out command\n")
@@ -4378,3 +4378,60 @@ func TestBuildTest_ValidationWithCircularDependency(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBuildTest_DirtyCallback(t *testing.T) {
+	b := NewBuildTest(t)
+	var got []string
+	b.builder.SetDirtyCallback(func(r *DirtyReason) {
+		got = append(got, r.Kind.String()+": "+r.String())
+	})
+	if _, err := b.builder.addTargetName("cat1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"output_missing: output cat1 doesn't exist"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestBuildTest_SavedOutputs(t *testing.T) {
+	b := NewBuildTest(t)
+	b.config.SavedOutputs = OutputStore{Dir: t.TempDir(), Mode: OutputAll}
+	b.Dirty("cat1")
+	if _, err := b.builder.addTargetName("cat1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.config.SavedOutputs.Lookup("cat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Command != "cat in1 > cat1" || got.ExitCode != ExitSuccess || got.EndMillis < got.StartMillis {
+		t.Fatalf("%#v", got)
+	}
+}
+
+func TestBuildTest_DyndepP1689SeparateFiles(t *testing.T) {
+	b := NewBuildTest(t)
+	// a.ddi is built first and requires a module provided by b.ddi, which is
+	// only loaded later.
+	b.AssertParse(&b.state, "rule touch\n  command = touch $out\nrule cp\n  command = cp $in $out\nbuild a.ddi: cp a.ddi-in\nbuild b.ddi: cp b.ddi-in\nbuild a.o: touch || a.ddi b.ddi\n  dyndep = a.ddi\nbuild b.o: touch || b.ddi\n  dyndep = b.ddi\n", ParseManifestOpts{})
+	b.fs.Create("a.ddi-in", `{"version": 1, "rules": [{"primary-output": "a.o", "requires": [{"logical-name": "b"}]}]}`)
+	b.fs.Create("b.ddi-in", `{"version": 1, "rules": [{"primary-output": "b.o", "provides": [{"logical-name": "b", "compiled-module-path": "b.pcm"}]}]}`)
+
+	if _, err := b.builder.addTargetName("a.o"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	wantCommand := []string{"cp a.ddi-in a.ddi", "cp b.ddi-in b.ddi", "touch b.o", "touch a.o"}
+	if diff := cmp.Diff(wantCommand, b.commandRunner.commandsRan); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, ok := b.fs.filesCreated["b.pcm"]; !ok {
+		t.Fatal("expected b.pcm to be built")
+	}
+}
@@ -27,6 +27,7 @@ type Cleaner struct {
 	removed           map[string]struct{}
 	cleaned           map[*Node]struct{}
 	cleanedFilesCount int // Number of files cleaned.
+	cleanedFiles      []string
 	di                DiskInterface
 	status            int
 }
@@ -60,6 +61,7 @@ func (c *Cleaner) fileExists(path string) bool {
 func (c *Cleaner) report(path string) {
 	// TODO(maruel): Move this out to the caller.
 	c.cleanedFilesCount++
+	c.cleanedFiles = append(c.cleanedFiles, path)
 	if c.isVerbose() {
 		fmt.Printf("Remove %s\n", path)
 	}
@@ -331,10 +333,19 @@ func (c *Cleaner) CleanRules(rules []string) int {
 	return c.status
 }
 
+// CleanedFiles returns the files removed since the last clean started, in
+// order.
+//
+// In dry run mode, these are the files that would have been removed.
+func (c *Cleaner) CleanedFiles() []string {
+	return c.cleanedFiles
+}
+
 // Reset reinitializes the cleaner stats.
 func (c *Cleaner) Reset() {
 	c.status = 0
 	c.cleanedFilesCount = 0
+	c.cleanedFiles = nil
 	c.removed = map[string]struct{}{}
 	c.cleaned = map[*Node]struct{}{}
 }
@@ -17,12 +17,16 @@ package main
 import (
 	"fmt"
 	"os"
+	"runtime"
 	"time"
 
 	"github.com/maruel/nin"
 )
 
-const testFilename = "BuildLogPerfTest-tempfile"
+const (
+	testFilename     = "BuildLogPerfTest-tempfile"
+	testDepsFilename = "DepsLogPerfTest-tempfile"
+)
 
 type noDeadPaths struct {
 }
@@ -95,31 +99,47 @@ func writeTestData() error {
 	return nil
 }
 
-func mainImpl() error {
-	if err := writeTestData(); err != nil {
-		return fmt.Errorf("failed to write test data: %w", err)
+// writeDepsTestData writes a deps log where each of the build log outputs
+// depends on a few hundred headers.
+func writeDepsTestData() error {
+	log := nin.DepsLog{}
+	if err := log.OpenForWrite(testDepsFilename); err != nil {
+		return err
 	}
-
-	{
-		// Read once to warm up disk cache.
-		log := nin.NewBuildLog()
-		if s, err := log.Load(testFilename); s == nin.LoadError {
-			return fmt.Errorf("failed to read test data: %s", err)
+	state := nin.NewState()
+	const kNumHeaders = 10000
+	var headers []*nin.Node
+	for i := 0; i < kNumHeaders; i++ {
+		headers = append(headers, state.GetNode(fmt.Sprintf("../../and/arbitrary/but/fairly/long/path/header%d.h", i), 0))
+	}
+	for i := 0; i < 30000; i++ {
+		// Use a sliding window of 300 headers.
+		start := (i * 7) % (kNumHeaders - 300)
+		if err := log.RecordDeps(state.GetNode(fmt.Sprintf("input%d.o", i), 0), nin.TimeStamp(i), headers[start:start+300]); err != nil {
+			return err
 		}
 	}
+	return log.Close()
+}
+
+// measure runs load a few times and prints the timing.
+func measure(name string, load func() error) error {
+	// Read once to warm up disk cache.
+	if err := load(); err != nil {
+		return fmt.Errorf("failed to read test data: %w", err)
+	}
 
 	rnd := time.Microsecond
 	var times []time.Duration
 	kNumRepetitions := 5
 	for i := 0; i < kNumRepetitions; i++ {
+		// Do not account for the garbage left by the previous iteration.
+		runtime.GC()
 		start := time.Now()
-		log := nin.NewBuildLog()
-		if s, err := log.Load(testFilename); s == nin.LoadError {
-			return fmt.Errorf("failed to read test data: %s", err)
+		if err := load(); err != nil {
+			return fmt.Errorf("failed to read test data: %w", err)
 		}
-		delta := time.Since(start)
-		fmt.Printf("%s\n", delta.Round(rnd))
-		times = append(times, delta)
+		times = append(times, time.Since(start))
 	}
 
 	min := times[0]
@@ -134,8 +154,56 @@ func mainImpl() error {
 		}
 	}
 	avg := total / time.Duration(len(times))
-	fmt.Printf("min %s  max %s  avg %s\n", min.Round(rnd), max.Round(rnd), avg.Round(rnd))
-	return os.Remove(testFilename)
+	fmt.Printf("%-26s min %s  max %s  avg %s\n", name, min.Round(rnd), max.Round(rnd), avg.Round(rnd))
+	return nil
+}
+
+func mainImpl() error {
+	if err := writeTestData(); err != nil {
+		return fmt.Errorf("failed to write test data: %w", err)
+	}
+	defer os.Remove(testFilename)
+	if err := writeDepsTestData(); err != nil {
+		return fmt.Errorf("failed to write test data: %w", err)
+	}
+	defer os.Remove(testDepsFilename)
+
+	variants := []struct {
+		name string
+		opts nin.LogLoadOpts
+	}{
+		{"read", nin.LogLoadOpts{}},
+		{"mmap", nin.LogLoadOpts{Mmap: true}},
+		{"mmap+parallel", nin.LogLoadOpts{Mmap: true, Concurrency: runtime.NumCPU()}},
+	}
+	for _, v := range variants {
+		opts := v.opts
+		err := measure(".ninja_log "+v.name, func() error {
+			log := nin.NewBuildLog()
+			if s, err := log.LoadWithOpts(testFilename, opts); s == nin.LoadError {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range variants {
+		opts := v.opts
+		err := measure(".ninja_deps "+v.name, func() error {
+			state := nin.NewState()
+			log := nin.DepsLog{}
+			if s, err := log.LoadWithOpts(testDepsFilename, &state, opts); s == nin.LoadError {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
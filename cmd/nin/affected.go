@@ -0,0 +1,168 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/maruel/nin"
+)
+
+// affectedTargets returns the targets that transitively depend on sources,
+// sorted by path.
+//
+// It follows the edges of the manifest and the dependencies recorded in the
+// deps log, so it doesn't need to stat the files nor to load the depfiles.
+func affectedTargets(depsLog *nin.DepsLog, sources []*nin.Node) []*nin.Node {
+	// Reverse the deps log.
+	rdeps := map[*nin.Node][]*nin.Node{}
+	for id, deps := range depsLog.Deps {
+		if deps == nil {
+			continue
+		}
+		node := depsLog.Nodes[id]
+		if !depsLog.IsDepsEntryLiveFor(node) {
+			continue
+		}
+		for _, in := range deps.Nodes {
+			rdeps[in] = append(rdeps[in], node)
+		}
+	}
+
+	seen := map[*nin.Node]struct{}{}
+	var out []*nin.Node
+	queue := append([]*nin.Node{}, sources...)
+	add := func(node *nin.Node) {
+		if _, ok := seen[node]; !ok {
+			seen[node] = struct{}{}
+			out = append(out, node)
+			queue = append(queue, node)
+		}
+	}
+	for len(queue) != 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, edge := range node.OutEdges {
+			for _, o := range edge.Outputs {
+				add(o)
+			}
+		}
+		for _, o := range rdeps[node] {
+			add(o)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+// inputClosure returns the targets and all their transitive inputs.
+func inputClosure(targets []*nin.Node) map[*nin.Node]struct{} {
+	seen := map[*nin.Node]struct{}{}
+	stack := append([]*nin.Node{}, targets...)
+	for len(stack) != 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[node]; ok {
+			continue
+		}
+		seen[node] = struct{}{}
+		if node.InEdge != nil {
+			stack = append(stack, node.InEdge.Inputs...)
+		}
+	}
+	return seen
+}
+
+func toolAffected(n *ninjaMain, opts *options, args []string) int {
+	fs := flag.NewFlagSet("affected", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t affected -- [options] [files]\n\nLists the targets that transitively depend on the files. The files are read\nfrom stdin, one per line, when none are specified.\n\noptions:\n")
+		fs.PrintDefaults()
+	}
+	var rules multi
+	fs.Var(&rules, "rule", "only list the targets generated by this rule, e.g. phony; can be repeated")
+	var under multi
+	fs.Var(&under, "under", "only list the targets that are dependencies of this target, e.g. a phony alias; can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if l := strings.TrimSpace(s.Text()); l != "" {
+				paths = append(paths, l)
+			}
+		}
+		if err := s.Err(); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	var sources []*nin.Node
+	for _, p := range paths {
+		// Files unknown to the build can't affect it.
+		if node := n.state.Paths[nin.CanonicalizePath(p)]; node != nil {
+			sources = append(sources, node)
+		}
+	}
+
+	var closure map[*nin.Node]struct{}
+	if len(under) != 0 {
+		targets, err := n.collectTargetsFromArgs(under)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		closure = inputClosure(targets)
+	}
+	out := []*jsonTarget{}
+	for _, node := range affectedTargets(&n.depsLog, sources) {
+		rule := node.InEdge.Rule.Name
+		if len(rules) != 0 && !contains(rules, rule) {
+			continue
+		}
+		if closure != nil {
+			if _, ok := closure[node]; !ok {
+				continue
+			}
+		}
+		out = append(out, &jsonTarget{Path: node.Path, Rule: rule})
+	}
+	if opts.format == formatJSON {
+		return printJSON(out)
+	}
+	for _, t := range out {
+		fmt.Printf("%s: %s\n", t.Path, t.Rule)
+	}
+	return 0
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+func TestAffectedTargets(t *testing.T) {
+	state := parseForFormat(t,
+		"rule cc\n  command = cc $in\n  deps = gcc\n  depfile = $out.d\n"+
+			"rule cat\n  command = cat $in > $out\n"+
+			"build a.o: cc a.c\n"+
+			"build b.o: cc b.c\n"+
+			"build lib: cat a.o b.o\n"+
+			"build test_a: cat a.o\n"+
+			"build tests: phony test_a\n"+
+			"build unrelated: cat c\n")
+	// b.o includes a.h according to the deps log.
+	b := state.Paths["b.o"]
+	b.ID = 0
+	depsLog := nin.DepsLog{
+		Nodes: []*nin.Node{b},
+		Deps:  []*nin.Deps{{Nodes: []*nin.Node{state.GetNode("a.h", 0)}}},
+	}
+	paths := func(nodes []*nin.Node) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Path)
+		}
+		return out
+	}
+
+	got := paths(affectedTargets(&depsLog, []*nin.Node{state.Paths["a.c"]}))
+	if diff := cmp.Diff([]string{"a.o", "lib", "test_a", "tests"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	got = paths(affectedTargets(&depsLog, []*nin.Node{state.Paths["a.h"]}))
+	if diff := cmp.Diff([]string{"b.o", "lib"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	closure := inputClosure([]*nin.Node{state.Paths["tests"]})
+	var under []string
+	for _, n := range affectedTargets(&depsLog, []*nin.Node{state.Paths["a.c"]}) {
+		if _, ok := closure[n]; ok {
+			under = append(under, n.Path)
+		}
+	}
+	if diff := cmp.Diff([]string{"a.o", "test_a", "tests"}, under); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/nin"
+)
+
+// toolCompilationDatabaseTargets is like toolCompilationDatabase but only
+// prints the edges in the transitive closure of the targets.
+func toolCompilationDatabaseTargets(n *ninjaMain, opts *options, args []string) int {
+	fs := flag.NewFlagSet("compdb-targets", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t compdb-targets -- [options] targets\n\noptions:\n")
+		fs.PrintDefaults()
+	}
+	expand := fs.Bool("x", false, "expand @rspfile style response file invocations")
+	arguments := fs.Bool("arguments", false, "split the command into an arguments array")
+	var rules multi
+	fs.Var(&rules, "rule", "only print the edges using this rule; can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() == 0 {
+		errorf("expected a target")
+		return 1
+	}
+	targets, err := n.collectTargetsFromArgs(fs.Args())
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	evalMode := ecmNormal
+	if *expand {
+		evalMode = ecmExpandRSPFile
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+
+	closure := inputClosure(targets)
+	first := true
+	fmt.Printf("[")
+	for _, e := range n.state.Edges {
+		if len(e.Inputs) == 0 || e.Rule == nin.PhonyRule {
+			continue
+		}
+		if !edgeInClosure(e, closure) {
+			continue
+		}
+		if len(rules) != 0 && !contains(rules, e.Rule.Name) {
+			continue
+		}
+		if !first {
+			fmt.Printf(",")
+		}
+		printCompdb(os.Stdout, cwd, e, evalMode, *arguments)
+		first = false
+	}
+	fmt.Printf("\n]")
+	return 0
+}
+
+// updateCompdb regenerates the compilation database at path, with the edges
+// using rules, or all the edges with inputs but phony ones when empty.
+//
+// The rules and the current directory used are saved in a stamp file next to
+// it. Nothing is evaluated unless they changed or one of the manifest files is
+// newer than the stamp file.
+//
+// The file is only written when its content changes, so editors watching it
+// don't reload it needlessly. It is written atomically.
+func updateCompdb(state *nin.State, path string, rules, manifests []string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	stampPath := path + ".stamp"
+	stamp := compdbStamp(cwd, rules)
+	if fi, err := os.Stat(stampPath); err == nil && !anyNewer(manifests, fi.ModTime()) {
+		if old, err := ioutil.ReadFile(stampPath); err == nil && bytes.Equal(old, stamp) {
+			if _, err := os.Stat(path); err == nil {
+				return nil
+			}
+		}
+	}
+	var b bytes.Buffer
+	first := true
+	b.WriteString("[")
+	for _, e := range state.Edges {
+		if len(e.Inputs) == 0 || e.Rule == nin.PhonyRule {
+			continue
+		}
+		if len(rules) != 0 && !contains(rules, e.Rule.Name) {
+			continue
+		}
+		if !first {
+			b.WriteString(",")
+		}
+		printCompdb(&b, cwd, e, ecmNormal, false)
+		first = false
+	}
+	b.WriteString("\n]\n")
+	if old, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(old, b.Bytes()) {
+		if err := nin.WriteFileAtomic(path, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	// Always rewrite the stamp file, so its modification time is after the
+	// manifests'.
+	return ioutil.WriteFile(stampPath, stamp, 0o666)
+}
+
+// compdbStamp returns the content of the stamp file of updateCompdb.
+func compdbStamp(cwd string, rules []string) []byte {
+	return []byte(cwd + "\n" + strings.Join(rules, "\n") + "\n")
+}
+
+// anyNewer returns true if one of the files is newer than t or can't be
+// accessed.
+func anyNewer(paths []string, t time.Time) bool {
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err != nil || fi.ModTime().After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileRecorder is a nin.FileReader recording the files read, i.e. the files
+// included by the manifest.
+type fileRecorder struct {
+	nin.FileReader
+	mu    sync.Mutex
+	paths []string
+}
+
+func (f *fileRecorder) ReadFile(path string) ([]byte, error) {
+	f.mu.Lock()
+	f.paths = append(f.paths, path)
+	f.mu.Unlock()
+	return f.FileReader.ReadFile(path)
+}
+
+// edgeInClosure returns true if one of the outputs of the edge is in closure.
+func edgeInClosure(e *nin.Edge, closure map[*nin.Node]struct{}) bool {
+	for _, o := range e.Outputs {
+		if _, ok := closure[o]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCommand splits a command into its arguments, the way the system runs
+// it.
+func splitCommand(command string) []string {
+	if runtime.GOOS == "windows" {
+		return splitWindowsCommand(command)
+	}
+	return splitPosixCommand(command)
+}
+
+// splitPosixCommand splits a command like /bin/sh does, handling quotes and
+// backslashes. Other shell constructs are kept as is.
+func splitPosixCommand(command string) []string {
+	var out []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				out = append(out, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			inArg = true
+			for i++; i < len(command) && command[i] != '\''; i++ {
+				arg.WriteByte(command[i])
+			}
+		case c == '"':
+			inArg = true
+			for i++; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("$`\"\\\n", command[i+1]) != -1 {
+					i++
+				}
+				arg.WriteByte(command[i])
+			}
+		case c == '\\':
+			inArg = true
+			if i++; i < len(command) && command[i] != '\n' {
+				arg.WriteByte(command[i])
+			}
+		default:
+			inArg = true
+			arg.WriteByte(c)
+		}
+	}
+	if inArg {
+		out = append(out, arg.String())
+	}
+	return out
+}
+
+// splitWindowsCommand splits a command like CommandLineToArgvW() does.
+func splitWindowsCommand(command string) []string {
+	var out []string
+	var arg strings.Builder
+	inArg := false
+	inQuote := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inArg {
+				out = append(out, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '\\':
+			inArg = true
+			// Backslashes are only special before a double quote.
+			n := 1
+			for ; i+n < len(command) && command[i+n] == '\\'; n++ {
+			}
+			if i+n < len(command) && command[i+n] == '"' {
+				arg.WriteString(strings.Repeat("\\", n/2))
+				if n%2 == 1 {
+					arg.WriteByte('"')
+					i++
+				}
+			} else {
+				arg.WriteString(strings.Repeat("\\", n))
+			}
+			i += n - 1
+		case c == '"':
+			inArg = true
+			if inQuote && i+1 < len(command) && command[i+1] == '"' {
+				// A doubled quote inside quotes is a literal quote.
+				arg.WriteByte('"')
+				i++
+			} else {
+				inQuote = !inQuote
+			}
+		default:
+			inArg = true
+			arg.WriteByte(c)
+		}
+	}
+	if inArg {
+		out = append(out, arg.String())
+	}
+	return out
+}
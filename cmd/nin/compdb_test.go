@@ -0,0 +1,154 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitPosixCommand(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"cc  -c\ta.c", []string{"cc", "-c", "a.c"}},
+		{`cc -DA='"x y"' -c 'a b.c'`, []string{"cc", `-DA="x y"`, "-c", "a b.c"}},
+		{`cc "-DA=\"\$x\\" a\ b.c ''`, []string{"cc", `-DA="$x\`, "a b.c", ""}},
+		{`cc "a"'b'c`, []string{"cc", "abc"}},
+	}
+	for i, l := range data {
+		if diff := cmp.Diff(l.want, splitPosixCommand(l.in)); diff != "" {
+			t.Errorf("#%d: +want, -got: %s", i, diff)
+		}
+	}
+}
+
+func TestSplitWindowsCommand(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{`cl.exe /c "a b.cc"`, []string{"cl.exe", "/c", "a b.cc"}},
+		{`cl.exe /Fo"out\dir\\" a\b.cc`, []string{"cl.exe", `/Foout\dir\`, `a\b.cc`}},
+		{`cl.exe /D"A=\"x\"" ""`, []string{"cl.exe", `/DA="x"`, ""}},
+		{`cl.exe "a""b" \\\"c`, []string{"cl.exe", `a"b`, `\"c`}},
+	}
+	for i, l := range data {
+		if diff := cmp.Diff(l.want, splitWindowsCommand(l.in)); diff != "" {
+			t.Errorf("#%d: +want, -got: %s", i, diff)
+		}
+	}
+}
+
+func TestEvaluateCommandWithRspfile(t *testing.T) {
+	state := parseForFormat(t,
+		"rule link\n  command = link @$out.rsp -o $out\n  rspfile = $out.rsp\n  rspfile_content = $in\n"+
+			"build app: link a.o b.o\n")
+	e := state.Edges[0]
+	if got := evaluateCommandWithRspfile(e, ecmNormal); got != "link @app.rsp -o app" {
+		t.Fatal(got)
+	}
+	if got := evaluateCommandWithRspfile(e, ecmExpandRSPFile); got != "link a.o b.o -o app" {
+		t.Fatal(got)
+	}
+}
+
+func TestUpdateCompdb(t *testing.T) {
+	state := parseForFormat(t,
+		"rule cc\n  command = cc -c $in -o $out\n"+
+			"rule link\n  command = link $in -o $out\n"+
+			"build a.o: cc a.c\n"+
+			"build app: link a.o\n"+
+			"build all: phony app\n")
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "build.ninja")
+	if err := ioutil.WriteFile(manifest, nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	manifests := []string{manifest}
+	p := filepath.Join(dir, "compile_commands.json")
+	if err := updateCompdb(state, p, []string{"cc"}, manifests); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[\n  {\n    \"directory\": \"" + encodeJSONString(cwd) + "\",\n" +
+		"    \"command\": \"cc -c a.c -o a.o\",\n" +
+		"    \"file\": \"a.c\",\n" +
+		"    \"output\": \"a.o\"\n" +
+		"  }\n]\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+
+	// Nothing is evaluated when neither the manifest nor the rules changed.
+	if err := ioutil.WriteFile(p, []byte("stale"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateCompdb(state, p, []string{"cc"}, manifests); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(p); err != nil || string(got) != "stale" {
+		t.Fatal("unexpected update", err)
+	}
+	if err := ioutil.WriteFile(p, []byte(want), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is not rewritten when its content is unchanged, e.g. when the
+	// manifest was touched.
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(p+".stamp", old, old); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateCompdb(state, p, []string{"cc"}, manifests); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p); err != nil || !os.SameFile(before, fi) || !fi.ModTime().Equal(before.ModTime()) {
+		t.Fatal("unexpected rewrite", err)
+	}
+	// The stamp file is updated instead.
+	if fi, err := os.Stat(p + ".stamp"); err != nil || !fi.ModTime().After(old) {
+		t.Fatal("expected the stamp file to be updated", err)
+	}
+
+	// Without rules, all the edges but phony ones are included, even if the
+	// manifest didn't change.
+	if err := updateCompdb(state, p, nil, manifests); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(p); err != nil || !strings.Contains(string(got), "link a.o -o app") {
+		t.Fatalf("expected a rewrite: %q %v", got, err)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/maruel/nin"
+)
+
+// outputFormat is the output format of the query-style tools, as specified
+// with -format.
+type outputFormat string
+
+const (
+	formatText outputFormat = "text"
+	formatJSON outputFormat = "json"
+)
+
+func (o *outputFormat) String() string {
+	return string(*o)
+}
+
+func (o *outputFormat) Set(s string) error {
+	switch f := outputFormat(s); f {
+	case formatText, formatJSON:
+		*o = f
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q; valid values are text and json", s)
+	}
+}
+
+// printJSON prints v as a single JSON document followed by a new line to
+// stdout.
+//
+// HTML characters are not escaped, since paths and commands commonly contain
+// '<', '>' and '&'.
+func printJSON(v interface{}) int {
+	e := json.NewEncoder(os.Stdout)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+// nodePaths returns the paths of nodes. It never returns nil, so that it is
+// encoded as an empty list instead of null.
+func nodePaths(nodes []*nin.Node) []string {
+	out := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.Path)
+	}
+	return out
+}
+
+// The schemas below are stable. Fields may be added but never removed or
+// renamed.
+
+// jsonQuery is one element of the list printed by -t query.
+type jsonQuery struct {
+	// Path is the queried target.
+	Path string `json:"path"`
+	// Input is the edge generating the target. It is null for source files.
+	Input *jsonQueryInput `json:"input"`
+	// Outputs are the outputs of the edges using the target as an input.
+	Outputs []string `json:"outputs"`
+	// ValidationFor are the outputs of the edges using the target as a
+	// validation.
+	ValidationFor []string `json:"validation_for"`
+}
+
+// jsonQueryInput is the edge generating the target in jsonQuery.
+type jsonQueryInput struct {
+	Rule        string   `json:"rule"`
+	Explicit    []string `json:"explicit"`
+	Implicit    []string `json:"implicit"`
+	OrderOnly   []string `json:"order_only"`
+	Validations []string `json:"validations"`
+}
+
+func newJSONQuery(node *nin.Node) *jsonQuery {
+	out := &jsonQuery{
+		Path:          node.Path,
+		Outputs:       []string{},
+		ValidationFor: []string{},
+	}
+	if edge := node.InEdge; edge != nil {
+		out.Input = &jsonQueryInput{
+			Rule:        edge.Rule.Name,
+			Explicit:    []string{},
+			Implicit:    []string{},
+			OrderOnly:   []string{},
+			Validations: nodePaths(edge.Validations),
+		}
+		for in := 0; in < len(edge.Inputs); in++ {
+			p := edge.Inputs[in].Path
+			if edge.IsImplicit(in) {
+				out.Input.Implicit = append(out.Input.Implicit, p)
+			} else if edge.IsOrderOnly(in) {
+				out.Input.OrderOnly = append(out.Input.OrderOnly, p)
+			} else {
+				out.Input.Explicit = append(out.Input.Explicit, p)
+			}
+		}
+	}
+	for _, edge := range node.OutEdges {
+		out.Outputs = append(out.Outputs, nodePaths(edge.Outputs)...)
+	}
+	for _, edge := range node.ValidationOutEdges {
+		out.ValidationFor = append(out.ValidationFor, nodePaths(edge.Outputs)...)
+	}
+	return out
+}
+
+// jsonTarget is one element of the list printed by -t targets.
+type jsonTarget struct {
+	Path string `json:"path"`
+	// Rule is the rule generating the target. It is omitted for source files.
+	Rule string `json:"rule,omitempty"`
+	// Inputs are only set in "depth" mode, up to the requested depth.
+	Inputs []*jsonTarget `json:"inputs,omitempty"`
+}
+
+// newJSONTargets returns the targets for nodes, recursing into their inputs
+// like toolTargetsListNodes().
+func newJSONTargets(nodes []*nin.Node, depth int) []*jsonTarget {
+	out := make([]*jsonTarget, 0, len(nodes))
+	for _, n := range nodes {
+		t := &jsonTarget{Path: n.Path}
+		if n.InEdge != nil {
+			t.Rule = n.InEdge.Rule.Name
+			if depth > 1 || depth <= 0 {
+				t.Inputs = newJSONTargets(n.InEdge.Inputs, depth-1)
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// jsonRule is one element of the list printed by -t rules.
+type jsonRule struct {
+	Name string `json:"name"`
+	// Description is only set when -d is specified and the rule has one. It is
+	// the unevaluated binding.
+	Description string `json:"description,omitempty"`
+}
+
+// jsonDeps is one element of the list printed by -t deps.
+type jsonDeps struct {
+	Path string `json:"path"`
+	// Found is false if the deps log has no entry for this target. In this
+	// case, the other fields are zero.
+	Found bool `json:"found"`
+	// MTime is the mtime recorded in the deps log.
+	MTime int64 `json:"mtime"`
+	// Valid is false if the output is missing or newer than the deps log entry.
+	Valid bool     `json:"valid"`
+	Deps  []string `json:"deps"`
+}
+
+// jsonCommand is one element of the list printed by -t commands, in
+// execution order.
+type jsonCommand struct {
+	Rule    string   `json:"rule"`
+	Outputs []string `json:"outputs"`
+	Command string   `json:"command"`
+}
+
+// jsonMissingDeps is the object printed by -t missingdeps.
+type jsonMissingDeps struct {
+	Missing []jsonMissingDep `json:"missing"`
+	// NodesProcessed is the number of nodes visited.
+	NodesProcessed int `json:"nodes_processed"`
+	// MissingDepPaths is the number of missing dependency paths.
+	MissingDepPaths int `json:"missing_dep_paths"`
+	// TargetsMissingDeps is the number of targets with a missing dependency.
+	TargetsMissingDeps int `json:"targets_missing_deps"`
+	// GeneratedInputs is the number of distinct generated inputs involved.
+	GeneratedInputs int `json:"generated_inputs"`
+	// GeneratorRules is the number of rules generating these inputs.
+	GeneratorRules int `json:"generator_rules"`
+}
+
+// jsonMissingDep is a missing dependency in jsonMissingDeps.
+type jsonMissingDep struct {
+	// Target uses Path via its depfile without a dependency path to the
+	// generator.
+	Target string `json:"target"`
+	Path   string `json:"path"`
+	// Generator is the rule generating Path.
+	Generator string `json:"generator"`
+}
+
+// jsonMissingDepCollector is a nin.MissingDependencyScannerDelegate
+// collecting the missing dependencies.
+type jsonMissingDepCollector struct {
+	missing []jsonMissingDep
+}
+
+func (j *jsonMissingDepCollector) OnMissingDep(node *nin.Node, path string, generator *nin.Rule) {
+	j.missing = append(j.missing, jsonMissingDep{Target: node.Path, Path: path, Generator: generator.Name})
+}
+
+// jsonClean is the object printed by -t clean and -t cleandead.
+type jsonClean struct {
+	// DryRun is true when -n was specified; nothing was removed.
+	DryRun bool `json:"dry_run"`
+	// Removed are the files removed, or that would have been removed in dry
+	// run mode.
+	Removed []string `json:"removed"`
+}
+
+// jsonWhy is one element of the list printed by -t why, and the reason chain
+// of a dirty input.
+type jsonWhy struct {
+	Path    string           `json:"path"`
+	Dirty   bool             `json:"dirty"`
+	Reasons []*jsonWhyReason `json:"reasons"`
+}
+
+// jsonWhyReason is a nin.DirtyReason.
+type jsonWhyReason struct {
+	// Kind is nin.DirtyReasonKind.String(), e.g. "output_older".
+	Kind string `json:"kind"`
+	// Message is the same message as printed by -d explain.
+	Message string `json:"message"`
+	// Node is the missing source, the output or the dyndep file.
+	Node string `json:"node,omitempty"`
+	// Input is the dirty input or the most recent input.
+	Input string `json:"input,omitempty"`
+	// Depfile is the depfile path.
+	Depfile    string `json:"depfile,omitempty"`
+	MTime      int64  `json:"mtime,omitempty"`
+	InputMTime int64  `json:"input_mtime,omitempty"`
+	Restat     bool   `json:"restat,omitempty"`
+	// OldHash and NewHash are the hexadecimal command hashes.
+	OldHash string `json:"old_hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+	// OldCommand and NewCommand are set when the previous command was saved
+	// with -save_commands.
+	OldCommand string `json:"old_command,omitempty"`
+	NewCommand string `json:"new_command,omitempty"`
+	// Chain explains why Input is dirty for "input_dirty". It is omitted when
+	// Input was already explained earlier in the output.
+	Chain *jsonWhy `json:"chain,omitempty"`
+}
+
+func newJSONWhyReason(r *nin.DirtyReason) *jsonWhyReason {
+	out := &jsonWhyReason{
+		Kind:       r.Kind.String(),
+		Message:    r.String(),
+		Depfile:    r.Path,
+		MTime:      int64(r.MTime),
+		InputMTime: int64(r.InputMTime),
+		Restat:     r.Restat,
+	}
+	if r.Node != nil {
+		out.Node = r.Node.Path
+	}
+	if r.Input != nil {
+		out.Input = r.Input.Path
+	}
+	if r.Kind == nin.DirtyCommandChanged {
+		out.OldHash = fmt.Sprintf("%016x", r.OldHash)
+		out.NewHash = fmt.Sprintf("%016x", r.NewHash)
+		out.OldCommand = r.OldCommand
+		out.NewCommand = r.NewCommand
+	}
+	return out
+}
+
+// jsonCmdDiff is the output of -t cmddiff for a target.
+type jsonCmdDiff struct {
+	Path string `json:"path"`
+	// OldCommand is the command recorded in the build log and NewCommand is the
+	// current one, without the environment variables. They are equal when only
+	// the environment changed.
+	OldCommand string `json:"old_command"`
+	NewCommand string `json:"new_command"`
+	Changed    bool   `json:"changed"`
+}
+
+// jsonDiagnostic is a nin.Diagnostic printed by -t diagnostics.
+type jsonDiagnostic struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+	// Output is the first output of the edge that printed the diagnostic.
+	Output string `json:"output"`
+}
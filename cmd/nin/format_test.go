@@ -0,0 +1,80 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+func parseForFormat(t *testing.T, input string) *nin.State {
+	state := nin.NewState()
+	if err := nin.ParseManifest(&state, nil, nin.ParseManifestOpts{}, "build.ninja", []byte(input+"\x00")); err != nil {
+		t.Fatal(err)
+	}
+	return &state
+}
+
+func TestOutputFormat(t *testing.T) {
+	var f outputFormat
+	if err := f.Set("json"); err != nil || f != formatJSON {
+		t.Fatal(f, err)
+	}
+	if err := f.Set("xml"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestJSONQuery(t *testing.T) {
+	state := parseForFormat(t,
+		"rule cat\n  command = cat $in > $out\n"+
+			"build a: cat b | c || d |@ v\n"+
+			"build e: cat a\n")
+	got, err := json.Marshal(newJSONQuery(state.Paths["a"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"path":"a","input":{"rule":"cat","explicit":["b"],"implicit":["c"],"order_only":["d"],"validations":["v"]},"outputs":["e"],"validation_for":[]}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+
+	got, err = json.Marshal(newJSONQuery(state.Paths["b"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"path":"b","input":null,"outputs":["a"],"validation_for":[]}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestJSONTargets(t *testing.T) {
+	state := parseForFormat(t,
+		"rule cat\n  command = cat $in > $out\n"+
+			"build a: cat b\n"+
+			"build e: cat a\n")
+	got, err := json.Marshal(newJSONTargets(state.RootNodes(), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"path":"e","rule":"cat","inputs":[{"path":"a","rule":"cat"}]}]`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
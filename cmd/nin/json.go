@@ -14,10 +14,6 @@
 
 package main
 
-import (
-	"os"
-)
-
 func encodeJSONString(in string) string {
 	hexDigits := "0123456789abcdef"
 	out := ""
@@ -50,10 +46,3 @@ func encodeJSONString(in string) string {
 	}
 	return out
 }
-
-// Print a string in JSON format to stdout without enclosing quotes
-func printJSONString(in string) {
-	//b, _ := json.Marshal(in)
-	b := encodeJSONString(in)
-	_, _ = os.Stdout.WriteString(b)
-}
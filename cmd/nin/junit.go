@@ -0,0 +1,93 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/maruel/nin"
+)
+
+// junitTestSuites is the root of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is an edge run.
+type junitTestCase struct {
+	// ClassName is the rule name.
+	ClassName string `xml:"classname,attr"`
+	// Name is the first output.
+	Name string `xml:"name,attr"`
+	// Time is the duration in seconds.
+	Time    string        `xml:"time,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+	// SystemOut is the output of a successful edge.
+	SystemOut string `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+// newJUnitTestCase returns the test case for an edge run.
+func newJUnitTestCase(edge *nin.Edge, durationMillis int32, exitCode nin.ExitStatus, output string) junitTestCase {
+	c := junitTestCase{
+		ClassName: edge.Rule.Name,
+		Name:      edge.Outputs[0].Path,
+		Time:      junitTime(durationMillis),
+	}
+	output = nin.StripAnsiEscapeCodes(output)
+	if exitCode != nin.ExitSuccess {
+		c.Failure = &junitFailure{
+			Message: "exit code " + strconv.Itoa(int(exitCode)) + ": " + edge.EvaluateCommand(false),
+			Output:  output,
+		}
+	} else {
+		c.SystemOut = output
+	}
+	return c
+}
+
+// junitTime formats a duration in milliseconds as seconds.
+func junitTime(durationMillis int32) string {
+	return strconv.FormatFloat(float64(durationMillis)/1000., 'f', 3, 64)
+}
+
+// writeJUnitReport writes the test cases as a JUnit XML report to path.
+func writeJUnitReport(path string, cases []junitTestCase) error {
+	s := junitTestSuite{Name: "nin", Tests: len(cases), Cases: cases}
+	for _, c := range cases {
+		if c.Failure != nil {
+			s.Failures++
+		}
+	}
+	b, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{s}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(b, '\n')...), 0o666)
+}
@@ -17,7 +17,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/maruel/nin"
 )
@@ -65,40 +64,3 @@ func infof(msg string, s ...interface{}) {
 	fmt.Fprintf(os.Stdout, msg, s...)
 	fmt.Fprintf(os.Stdout, "\n")
 }
-
-func islatinalpha(c byte) bool {
-	// isalpha() is locale-dependent.
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
-}
-
-// Removes all Ansi escape codes (http://www.termsys.demon.co.uk/vtansi.htm).
-func stripAnsiEscapeCodes(in string) string {
-	if strings.IndexByte(in, '\x1B') == -1 {
-		return in
-	}
-	stripped := ""
-	//stripped.reserve(in.size())
-
-	for i := 0; i < len(in); i++ {
-		if in[i] != '\x1B' {
-			// Not an escape code.
-			stripped += string(in[i])
-			continue
-		}
-
-		// Only strip CSIs for now.
-		if i+1 >= len(in) {
-			break
-		}
-		if in[i+1] != '[' { // Not a CSI.
-			continue
-		}
-		i += 2
-
-		// Skip everything up to and including the next [a-zA-Z].
-		for i < len(in) && !islatinalpha(in[i]) {
-			i++
-		}
-	}
-	return stripped
-}
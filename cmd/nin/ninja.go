@@ -18,7 +18,9 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -28,6 +30,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/maruel/nin"
 )
@@ -46,6 +49,22 @@ type options struct {
 	// build.ninja parsing options.
 	parserOpts nin.ParseManifestOpts
 
+	// .ninja_log and .ninja_deps loading options.
+	logOpts nin.LogLoadOpts
+
+	// Output format of the query-style tools.
+	format outputFormat
+
+	// Show the running edges below the progress line.
+	multiline bool
+
+	// Compilation database to keep up to date, and the rules to include in it.
+	compdb      string
+	compdbRules multi
+
+	// JUnit XML report of the edges run.
+	junit string
+
 	cpuprofile string
 	memprofile string
 	trace      string
@@ -71,6 +90,7 @@ type ninjaMain struct {
 
 	buildLog nin.BuildLog
 	depsLog  nin.DepsLog
+	logOpts  nin.LogLoadOpts
 
 	// The type of functions that are the entry points to tools (subcommands).
 
@@ -132,6 +152,9 @@ type tool struct {
 
 	// Implementation of the tool.
 	tool toolFunc
+
+	// Supports -format=json.
+	json bool
 }
 
 // when to run the tool.
@@ -168,6 +191,25 @@ func guessParallelism() int {
 	}
 }
 
+// newBuilder returns a Builder printing the dirty reasons with -d explain.
+func (n *ninjaMain) newBuilder(status nin.Status) *nin.Builder {
+	b := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, &n.di, status, n.startTimeMillis)
+	if nin.Debug.Explaining {
+		b.SetDirtyCallback(explainDirty)
+	}
+	return b
+}
+
+// explainDirty prints a reason why a node is dirty for -d explain.
+func explainDirty(r *nin.DirtyReason) {
+	if r.Kind == nin.DirtyDyndepPending {
+		// Not a reason per se; the edge is reconsidered once the dyndep file is
+		// loaded.
+		return
+	}
+	fmt.Fprintf(os.Stderr, "ninja explain: %s\n", r)
+}
+
 // Rebuild the build manifest, if necessary.
 // Returns true if the manifest was rebuilt.
 // Rebuild the manifest, if necessary.
@@ -183,7 +225,7 @@ func (n *ninjaMain) RebuildManifest(inputFile string, status nin.Status) (bool,
 		return false, errors.New("path not found")
 	}
 
-	builder := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, &n.di, status, n.startTimeMillis)
+	builder := n.newBuilder(status)
 	if dirty, err := builder.AddTarget(node); !dirty {
 		return false, err
 	}
@@ -284,18 +326,225 @@ func (n *ninjaMain) collectTargetsFromArgs(args []string) ([]*nin.Node, error) {
 
 // The various subcommands, run via "-t XXX".
 func toolGraph(n *ninjaMain, opts *options, args []string) int {
-	nodes, err := n.collectTargetsFromArgs(args)
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t graph -- [options] [targets]\n\noptions:\n")
+		fs.PrintDefaults()
+	}
+	defFormat := "dot"
+	if opts.format == formatJSON {
+		defFormat = "json"
+	}
+	format := fs.String("format", defFormat, "output format: dot, mermaid, graphml or json; without any option, the output of ninja is kept")
+	var gopts nin.GraphOpts
+	fs.IntVar(&gopts.MaxDepth, "depth", 0, "maximum number of build edges to traverse (0 means infinity)")
+	var exclude multi
+	fs.Var(&exclude, "exclude", "skip the paths matching this glob pattern; can be repeated")
+	fs.BoolVar(&gopts.CollapseDirs, "collapse", false, "collapse the files by directory")
+	dirty := fs.Bool("dirty", false, "only include the dirty nodes")
+	fs.StringVar(&gopts.Highlight, "highlight", "", "highlight the paths from the targets to this path")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NFlag() == 0 && opts.format != formatJSON {
+		// Without options, keep the exact output of ninja.
+		nodes, err := n.collectTargetsFromArgs(fs.Args())
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		graph := nin.NewGraphViz(&n.state, &n.di)
+		graph.Start()
+		for _, n := range nodes {
+			graph.AddTarget(n)
+		}
+		graph.Finish()
+		return 0
+	}
+	var err error
+	if gopts.Format, err = nin.ParseGraphFormat(*format); err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	gopts.Exclude = exclude
+	if *dirty {
+		if !n.loadLogs() {
+			return 1
+		}
+		scan := nin.NewDependencyScan(&n.state, &n.buildLog, &n.depsLog, &n.di)
+		scan.SetToolDeps(n.config.ToolDeps)
+		gopts.Scan = &scan
+	}
+
+	nodes, err := n.collectTargetsFromArgs(fs.Args())
 	if err != nil {
 		errorf("%s", err)
 		return 1
 	}
 
-	graph := nin.NewGraphViz(&n.state, &n.di)
-	graph.Start()
+	graph := nin.NewGraphExporter(&n.state, &n.di, gopts)
 	for _, n := range nodes {
-		graph.AddTarget(n)
+		if err := graph.AddTarget(n); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	if err := graph.Write(os.Stdout); err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+func toolExtract(n *ninjaMain, opts *options, args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t extract -- [options] [targets]\n\nwrites a standalone manifest to build the targets\n\noptions:\n")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", "", "file to write the manifest to instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	nodes, err := n.collectTargetsFromArgs(fs.Args())
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	e := nin.NewManifestExtractor(&n.state)
+	for _, node := range nodes {
+		e.AddTarget(node)
+	}
+	if *output == "" {
+		if err := e.Write(os.Stdout); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		return 0
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	err = e.Write(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+func toolManifestDiff(n *ninjaMain, opts *options, args []string) int {
+	fs := flag.NewFlagSet("manifestdiff", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t manifestdiff -- old.ninja [new.ninja]\n\nprints the semantic differences between two manifests; new.ninja defaults to the -f file\n\ninclude and subninja are resolved relative to the current directory for both\nmanifests, so old.ninja uses the current subninjas\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	files := fs.Args()
+	if len(files) == 1 {
+		files = append(files, opts.inputFile)
+	}
+	if len(files) != 2 {
+		fs.Usage()
+		return 1
+	}
+	var states [2]nin.State
+	for i, f := range files {
+		states[i] = nin.NewState()
+		input, err := n.di.ReadFile(f)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		if err := nin.ParseManifest(&states[i], &n.di, opts.parserOpts, f, input); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	d := nin.DiffManifests(&states[0], &states[1])
+	if opts.format == formatJSON {
+		return printJSON(d)
+	}
+	printManifestChanges("pool", d.Pools)
+	printManifestChanges("rule", d.Rules)
+	printManifestChanges("build", d.Edges)
+	printManifestChanges("default", d.Defaults)
+	return 0
+}
+
+func printManifestChanges(section string, changes []nin.ManifestChange) {
+	for _, c := range changes {
+		line := section + " " + c.Name
+		switch c.Kind {
+		case nin.ManifestAdded, nin.ManifestRemoved:
+			prefix, v := "+", c.New
+			if c.Kind == nin.ManifestRemoved {
+				prefix, v = "-", c.Old
+			}
+			line = prefix + line
+			if c.Field != "" {
+				line += ": " + c.Field + " " + v
+			} else if v != "" {
+				line += ": " + v
+			}
+		default:
+			line = "~" + line + ": " + c.Field
+			if c.Old == "" {
+				line += " +" + c.New
+			} else if c.New == "" {
+				line += " -" + c.Old
+			} else {
+				line += fmt.Sprintf(" %q -> %q", c.Old, c.New)
+			}
+		}
+		fmt.Println(line)
+	}
+}
+
+func toolGraphQuery(n *ninjaMain, opts *options, args []string) int {
+	fs := flag.NewFlagSet("graphquery", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nin -t graphquery -- [options] expression\n\nexamples:\n  deps(foo, 1)\n  rdeps(..., foo.h) ^ kind(link, ...)\n  somepath(all, foo.h)\n\nSee nin.GraphQuery for the full syntax.\n\noptions:\n")
+		fs.PrintDefaults()
+	}
+	withDepsLog := fs.Bool("deps_log", false, "include the dependencies recorded in the deps log")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() == 0 {
+		errorf("expected a query expression")
+		return 1
+	}
+	var depsLog *nin.DepsLog
+	if *withDepsLog {
+		depsLog = &n.depsLog
+	}
+	nodes, err := nin.NewGraphQuery(&n.state, depsLog).Eval(strings.Join(fs.Args(), " "))
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	if opts.format == formatJSON {
+		out := make([]*jsonTarget, 0, len(nodes))
+		for _, node := range nodes {
+			t := &jsonTarget{Path: node.Path}
+			if node.InEdge != nil {
+				t.Rule = node.InEdge.Rule.Name
+			}
+			out = append(out, t)
+		}
+		return printJSON(out)
+	}
+	for _, node := range nodes {
+		fmt.Printf("%s\n", node.Path)
 	}
-	graph.Finish()
 	return 0
 }
 
@@ -307,6 +556,7 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 
 	dyndepLoader := nin.NewDyndepLoader(&n.state, &n.di)
 
+	var out []*jsonQuery
 	for i := 0; i < len(args); i++ {
 		node, err := n.collectTarget(args[i])
 		if err != nil {
@@ -314,13 +564,18 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 			return 1
 		}
 
+		if edge := node.InEdge; edge != nil && edge.Dyndep != nil && edge.Dyndep.DyndepPending {
+			if err := dyndepLoader.LoadDyndeps(edge.Dyndep, nin.DyndepFile{}); err != nil {
+				warningf("%s\n", err)
+			}
+		}
+		if opts.format == formatJSON {
+			out = append(out, newJSONQuery(node))
+			continue
+		}
+
 		fmt.Printf("%s:\n", node.Path)
 		if edge := node.InEdge; edge != nil {
-			if edge.Dyndep != nil && edge.Dyndep.DyndepPending {
-				if err := dyndepLoader.LoadDyndeps(edge.Dyndep, nin.DyndepFile{}); err != nil {
-					warningf("%s\n", err)
-				}
-			}
 			fmt.Printf("  input: %s\n", edge.Rule.Name)
 			for in := 0; in < len(edge.Inputs); in++ {
 				label := ""
@@ -354,6 +609,293 @@ func toolQuery(n *ninjaMain, opts *options, args []string) int {
 			}
 		}
 	}
+	if opts.format == formatJSON {
+		return printJSON(out)
+	}
+	return 0
+}
+
+// whyCollector collects the reasons found by nin.DependencyScan.
+type whyCollector struct {
+	edges   map[*nin.Edge][]*nin.DirtyReason
+	sources map[*nin.Node]*nin.DirtyReason
+	seen    map[*nin.Node]struct{}
+}
+
+func (w *whyCollector) onDirty(r *nin.DirtyReason) {
+	if r.Edge == nil {
+		w.sources[r.Node] = r
+	} else {
+		w.edges[r.Edge] = append(w.edges[r.Edge], r)
+	}
+}
+
+// chain returns the reasons why node is dirty, recursing into dirty inputs.
+func (w *whyCollector) chain(node *nin.Node) *jsonWhy {
+	w.seen[node] = struct{}{}
+	out := &jsonWhy{Path: node.Path, Dirty: node.Dirty, Reasons: []*jsonWhyReason{}}
+	var reasons []*nin.DirtyReason
+	if node.InEdge != nil {
+		reasons = w.edges[node.InEdge]
+	} else if r := w.sources[node]; r != nil {
+		reasons = append(reasons, r)
+	}
+	for _, r := range reasons {
+		j := newJSONWhyReason(r)
+		if r.Kind == nin.DirtyInputDirty {
+			if _, ok := w.seen[r.Input]; !ok {
+				j.Chain = w.chain(r.Input)
+			}
+		}
+		out.Reasons = append(out.Reasons, j)
+	}
+	return out
+}
+
+func printWhy(w *jsonWhy, indent string) {
+	if !w.Dirty {
+		fmt.Printf("%s%s: clean\n", indent, w.Path)
+		return
+	}
+	fmt.Printf("%s%s: dirty\n", indent, w.Path)
+	for _, r := range w.Reasons {
+		switch {
+		case r.OldHash != "":
+			fmt.Printf("%s  %s (%s vs %s)\n", indent, r.Message, r.OldHash, r.NewHash)
+		case r.Kind == nin.DirtyInputDirty.String() && r.Chain == nil:
+			fmt.Printf("%s  %s (see above)\n", indent, r.Message)
+		default:
+			fmt.Printf("%s  %s\n", indent, r.Message)
+		}
+		if r.Chain != nil {
+			printWhy(r.Chain, indent+"    ")
+		}
+	}
+}
+
+// outputStoreName is the directory in the build directory where -save_output
+// saves the output of the edges.
+const outputStoreName = ".ninja_output"
+
+func (n *ninjaMain) outputStoreDir() string {
+	return filepath.Join(n.state.Bindings.LookupVariable("builddir"), outputStoreName)
+}
+
+// commandStoreName is the directory in the build directory where
+// -save_commands saves the commands of the edges.
+const commandStoreName = ".ninja_commands"
+
+func (n *ninjaMain) commandStoreDir() string {
+	return filepath.Join(n.state.Bindings.LookupVariable("builddir"), commandStoreName)
+}
+
+func toolLastOutput(n *ninjaMain, opts *options, args []string) int {
+	if len(args) == 0 {
+		errorf("expected a target")
+		return 1
+	}
+	nodes, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	store := nin.OutputStore{Dir: n.outputStoreDir()}
+	var out []*nin.StoredOutput
+	ret := 0
+	for _, node := range nodes {
+		if node.InEdge == nil {
+			errorf("'%s' is not generated by a rule", node.Path)
+			ret = 1
+			continue
+		}
+		s, err := store.Lookup(node.InEdge.Outputs[0].Path)
+		if errors.Is(err, os.ErrNotExist) {
+			errorf("no output saved for '%s'; build with -save_output", node.Path)
+			ret = 1
+			continue
+		} else if err != nil {
+			errorf("%s", err)
+			ret = 1
+			continue
+		}
+		out = append(out, s)
+	}
+	if opts.format == formatJSON {
+		if out == nil {
+			out = []*nin.StoredOutput{}
+		}
+		if printJSON(out) != 0 {
+			return 1
+		}
+		return ret
+	}
+	for _, s := range out {
+		start := time.UnixMilli(s.StartMillis).Format("2006-01-02 15:04:05")
+		d := time.Duration(s.EndMillis-s.StartMillis) * time.Millisecond
+		fmt.Printf("%s: exit code %d, started %s, took %s\n%s\n%s", s.Path, s.ExitCode, start, d, s.Command, s.Output)
+		if s.Output != "" && !strings.HasSuffix(s.Output, "\n") {
+			fmt.Printf("\n")
+		}
+	}
+	return ret
+}
+
+func toolDiagnostics(n *ninjaMain, opts *options, args []string) int {
+	var edges []*nin.Edge
+	if len(args) == 0 {
+		edges = n.state.Edges
+	} else {
+		nodes, err := n.collectTargetsFromArgs(args)
+		if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		closure := inputClosure(nodes)
+		for _, e := range n.state.Edges {
+			if edgeInClosure(e, closure) {
+				edges = append(edges, e)
+			}
+		}
+	}
+	store := nin.OutputStore{Dir: n.outputStoreDir()}
+	var set nin.DiagnosticSet
+	out := []*jsonDiagnostic{}
+	for _, e := range edges {
+		if e.Rule == nin.PhonyRule {
+			continue
+		}
+		s, err := store.Lookup(e.Outputs[0].Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errorf("%s", err)
+			return 1
+		}
+		for _, d := range set.Add(nin.EdgeDiagnostics(e, s.Output)) {
+			out = append(out, &jsonDiagnostic{
+				Path:     d.Path,
+				Line:     d.Line,
+				Column:   d.Column,
+				Severity: d.Severity,
+				Code:     d.Code,
+				Message:  d.Message,
+				Output:   s.Path,
+			})
+		}
+	}
+	if opts.format == formatJSON {
+		return printJSON(out)
+	}
+	for _, d := range out {
+		loc := d.Path + ":" + strconv.Itoa(d.Line)
+		if d.Column != 0 {
+			loc += ":" + strconv.Itoa(d.Column)
+		}
+		sev := d.Severity
+		if d.Code != "" {
+			sev += " " + d.Code
+		}
+		fmt.Printf("%s: %s: %s\n", loc, sev, d.Message)
+	}
+	return 0
+}
+
+func toolCmdDiff(n *ninjaMain, opts *options, args []string) int {
+	if len(args) == 0 {
+		errorf("expected a target")
+		return 1
+	}
+	nodes, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	store := nin.CommandStore{Dir: n.commandStoreDir()}
+	var out []*jsonCmdDiff
+	ret := 0
+	for _, node := range nodes {
+		if node.InEdge == nil {
+			errorf("'%s' is not generated by a rule", node.Path)
+			ret = 1
+			continue
+		}
+		entry := n.buildLog.Entries[node.Path]
+		if entry == nil {
+			errorf("'%s' is not in the build log", node.Path)
+			ret = 1
+			continue
+		}
+		d := &jsonCmdDiff{Path: node.Path, NewCommand: node.InEdge.EvaluateCommandWithoutEnv()}
+		d.Changed = nin.HashCommand(node.InEdge.EvaluateCommand(true)) != entry.CommandHash()
+		if !d.Changed {
+			d.OldCommand = d.NewCommand
+		} else if d.OldCommand, err = store.Lookup(entry.CommandHash()); errors.Is(err, os.ErrNotExist) {
+			errorf("previous command of '%s' was not saved; build with -save_commands", node.Path)
+			ret = 1
+			continue
+		} else if err != nil {
+			errorf("%s", err)
+			ret = 1
+			continue
+		}
+		out = append(out, d)
+	}
+	if opts.format == formatJSON {
+		if out == nil {
+			out = []*jsonCmdDiff{}
+		}
+		if printJSON(out) != 0 {
+			return 1
+		}
+		return ret
+	}
+	for _, d := range out {
+		if !d.Changed {
+			fmt.Printf("%s: unchanged\n", d.Path)
+		} else if d.OldCommand == d.NewCommand {
+			fmt.Printf("%s: environment changed\n", d.Path)
+		} else {
+			fmt.Printf("%s: %s\n", d.Path, nin.CommandDiff(d.OldCommand, d.NewCommand))
+		}
+	}
+	return ret
+}
+
+func toolWhy(n *ninjaMain, opts *options, args []string) int {
+	if len(args) == 0 {
+		errorf("expected a target")
+		return 1
+	}
+	nodes, err := n.collectTargetsFromArgs(args)
+	if err != nil {
+		errorf("%s", err)
+		return 1
+	}
+	w := whyCollector{
+		edges:   map[*nin.Edge][]*nin.DirtyReason{},
+		sources: map[*nin.Node]*nin.DirtyReason{},
+		seen:    map[*nin.Node]struct{}{},
+	}
+	scan := nin.NewDependencyScan(&n.state, &n.buildLog, &n.depsLog, &n.di)
+	scan.SetDirtyCallback(w.onDirty)
+	scan.SetToolDeps(n.config.ToolDeps)
+	scan.SetCommandStore(&nin.CommandStore{Dir: n.commandStoreDir()})
+	for _, node := range nodes {
+		if _, err := scan.RecomputeDirty(node); err != nil {
+			errorf("%s", err)
+			return 1
+		}
+	}
+	out := make([]*jsonWhy, 0, len(nodes))
+	for _, node := range nodes {
+		out = append(out, w.chain(node))
+	}
+	if opts.format == formatJSON {
+		return printJSON(out)
+	}
+	for _, j := range out {
+		printWhy(j, "")
+	}
 	return 0
 }
 
@@ -390,18 +932,26 @@ func toolTargetsListNodes(nodes []*nin.Node, depth int, indent int) int {
 	return 0
 }
 
-func toolTargetsSourceList(state *nin.State) int {
+func toolTargetsSourceList(state *nin.State, format outputFormat) int {
+	out := []*jsonTarget{}
 	for _, e := range state.Edges {
 		for _, inps := range e.Inputs {
 			if inps.InEdge == nil {
-				fmt.Printf("%s\n", inps.Path)
+				if format == formatJSON {
+					out = append(out, &jsonTarget{Path: inps.Path})
+				} else {
+					fmt.Printf("%s\n", inps.Path)
+				}
 			}
 		}
 	}
+	if format == formatJSON {
+		return printJSON(out)
+	}
 	return 0
 }
 
-func toolTargetsListRule(state *nin.State, ruleName string) int {
+func toolTargetsListRule(state *nin.State, ruleName string, format outputFormat) int {
 	rules := map[string]struct{}{}
 
 	// Gather the outputs.
@@ -418,6 +968,13 @@ func toolTargetsListRule(state *nin.State, ruleName string) int {
 		names = append(names, n)
 	}
 	sort.Strings(names)
+	if format == formatJSON {
+		out := make([]*jsonTarget, 0, len(names))
+		for _, i := range names {
+			out = append(out, &jsonTarget{Path: i, Rule: ruleName})
+		}
+		return printJSON(out)
+	}
 	// Print them.
 	for _, i := range names {
 		fmt.Printf("%s\n", i)
@@ -425,12 +982,20 @@ func toolTargetsListRule(state *nin.State, ruleName string) int {
 	return 0
 }
 
-func toolTargetsList(state *nin.State) int {
+func toolTargetsList(state *nin.State, format outputFormat) int {
+	out := []*jsonTarget{}
 	for _, e := range state.Edges {
 		for _, outNode := range e.Outputs {
-			fmt.Printf("%s: %s\n", outNode.Path, e.Rule.Name)
+			if format == formatJSON {
+				out = append(out, &jsonTarget{Path: outNode.Path, Rule: e.Rule.Name})
+			} else {
+				fmt.Printf("%s: %s\n", outNode.Path, e.Rule.Name)
+			}
 		}
 	}
+	if format == formatJSON {
+		return printJSON(out)
+	}
 	return 0
 }
 
@@ -452,10 +1017,15 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 	}
 
 	di := nin.RealDiskInterface{}
+	out := []*jsonDeps{}
 	for _, it := range nodes {
 		deps := n.depsLog.GetDeps(it)
 		if deps == nil {
-			fmt.Printf("%s: deps not found\n", it.Path)
+			if opts.format == formatJSON {
+				out = append(out, &jsonDeps{Path: it.Path, Deps: []string{}})
+			} else {
+				fmt.Printf("%s: deps not found\n", it.Path)
+			}
 			continue
 		}
 
@@ -463,8 +1033,13 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 		if mtime == -1 {
 			errorf("%s", err) // Log and ignore Stat() errors;
 		}
+		valid := mtime != 0 && mtime <= deps.MTime
+		if opts.format == formatJSON {
+			out = append(out, &jsonDeps{Path: it.Path, Found: true, MTime: int64(deps.MTime), Valid: valid, Deps: nodePaths(deps.Nodes)})
+			continue
+		}
 		s := "VALID"
-		if mtime == 0 || mtime > deps.MTime {
+		if !valid {
 			s = "STALE"
 		}
 		fmt.Printf("%s: #deps %d, deps mtime %d (%s)\n", it.Path, len(deps.Nodes), deps.MTime, s)
@@ -473,6 +1048,9 @@ func toolDeps(n *ninjaMain, opts *options, args []string) int {
 		}
 		fmt.Printf("\n")
 	}
+	if opts.format == formatJSON {
+		return printJSON(out)
+	}
 	return 0
 }
 
@@ -482,12 +1060,30 @@ func toolMissingDeps(n *ninjaMain, opts *options, args []string) int {
 		errorf("%s", err)
 		return 1
 	}
-	printer := missingDependencyPrinter{}
-	scanner := nin.NewMissingDependencyScanner(&printer, &n.depsLog, &n.state, &nin.RealDiskInterface{})
+	var delegate nin.MissingDependencyScannerDelegate = &missingDependencyPrinter{}
+	collector := jsonMissingDepCollector{missing: []jsonMissingDep{}}
+	if opts.format == formatJSON {
+		delegate = &collector
+	}
+	scanner := nin.NewMissingDependencyScanner(delegate, &n.depsLog, &n.state, &nin.RealDiskInterface{})
 	for _, it := range nodes {
 		scanner.ProcessNode(it)
 	}
-	scanner.PrintStats()
+	if opts.format == formatJSON {
+		s := scanner.Stats()
+		if ret := printJSON(&jsonMissingDeps{
+			Missing:            collector.missing,
+			NodesProcessed:     s.NodesProcessed,
+			MissingDepPaths:    s.MissingDepPaths,
+			TargetsMissingDeps: s.NodesMissingDeps,
+			GeneratedInputs:    s.GeneratedNodes,
+			GeneratorRules:     s.GeneratorRules,
+		}); ret != 0 {
+			return ret
+		}
+	} else {
+		scanner.PrintStats()
+	}
 	if scanner.HadMissingDeps() {
 		return 3
 	}
@@ -504,9 +1100,9 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 				rule = args[1]
 			}
 			if len(rule) == 0 {
-				return toolTargetsSourceList(&n.state)
+				return toolTargetsSourceList(&n.state, opts.format)
 			}
-			return toolTargetsListRule(&n.state, rule)
+			return toolTargetsListRule(&n.state, rule, opts.format)
 		}
 		if mode == "depth" {
 			if len(args) > 1 {
@@ -514,7 +1110,7 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 				depth, _ = strconv.Atoi(args[1])
 			}
 		} else if mode == "all" {
-			return toolTargetsList(&n.state)
+			return toolTargetsList(&n.state, opts.format)
 		} else {
 			suggestion := nin.SpellcheckString(mode, "rule", "depth", "all")
 			if suggestion != "" {
@@ -527,6 +1123,9 @@ func toolTargets(n *ninjaMain, opts *options, args []string) int {
 	}
 
 	if rootNodes := n.state.RootNodes(); len(rootNodes) != 0 {
+		if opts.format == formatJSON {
+			return printJSON(newJSONTargets(rootNodes, depth))
+		}
 		return toolTargetsListNodes(rootNodes, depth, 0)
 	}
 	errorf("could not determine root nodes of build graph")
@@ -554,6 +1153,18 @@ func toolRules(n *ninjaMain, opts *options, args []string) int {
 	}
 	sort.Strings(names)
 
+	if opts.format == formatJSON {
+		out := make([]*jsonRule, 0, len(names))
+		for _, name := range names {
+			r := &jsonRule{Name: name}
+			if description := rules[name].Bindings["description"]; printDescription && description != nil {
+				r.Description = description.Unparse()
+			}
+			out = append(out, r)
+		}
+		return printJSON(out)
+	}
+
 	// Print rules
 	for _, name := range names {
 		fmt.Printf("%s", name)
@@ -592,7 +1203,9 @@ const (
 	pcmAll    printCommandMode = true
 )
 
-func printCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printCommandMode) {
+// visitCommands calls f for each non-phony edge needed to build edge, in
+// execution order.
+func visitCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printCommandMode, f func(edge *nin.Edge)) {
 	if edge == nil {
 		return
 	}
@@ -603,12 +1216,12 @@ func printCommands(edge *nin.Edge, seen map[*nin.Edge]struct{}, mode printComman
 
 	if mode == pcmAll {
 		for _, in := range edge.Inputs {
-			printCommands(in.InEdge, seen, mode)
+			visitCommands(in.InEdge, seen, mode, f)
 		}
 	}
 
 	if edge.Rule != nin.PhonyRule {
-		fmt.Printf("%s\n", (edge.EvaluateCommand(false)))
+		f(edge)
 	}
 }
 
@@ -633,8 +1246,19 @@ func toolCommands(n *ninjaMain, opts *options, args []string) int {
 	}
 
 	seen := map[*nin.Edge]struct{}{}
+	if opts.format == formatJSON {
+		out := []*jsonCommand{}
+		for _, in := range nodes {
+			visitCommands(in.InEdge, seen, mode, func(edge *nin.Edge) {
+				out = append(out, &jsonCommand{Rule: edge.Rule.Name, Outputs: nodePaths(edge.Outputs), Command: edge.EvaluateCommand(false)})
+			})
+		}
+		return printJSON(out)
+	}
 	for _, in := range nodes {
-		printCommands(in.InEdge, seen, mode)
+		visitCommands(in.InEdge, seen, mode, func(edge *nin.Edge) {
+			fmt.Printf("%s\n", edge.EvaluateCommand(false))
+		})
 	}
 	return 0
 }
@@ -665,19 +1289,49 @@ func toolClean(n *ninjaMain, opts *options, args []string) int {
 		return 1
 	}
 
-	cleaner := nin.NewCleaner(&n.state, n.config, &n.di)
+	cleaner := n.newCleaner(opts.format)
+	ret := 0
 	if len(args) >= 1 {
 		if cleanRules {
-			return cleaner.CleanRules(args)
+			ret = cleaner.CleanRules(args)
+		} else {
+			ret = cleaner.CleanTargets(args)
 		}
-		return cleaner.CleanTargets(args)
+	} else {
+		ret = cleaner.CleanAll(generator)
 	}
-	return cleaner.CleanAll(generator)
+	return n.printCleaned(cleaner, opts.format, ret)
 }
 
 func toolCleanDead(n *ninjaMain, opts *options, args []string) int {
-	cleaner := nin.NewCleaner(&n.state, n.config, &n.di)
-	return cleaner.CleanDead(n.buildLog.Entries)
+	cleaner := n.newCleaner(opts.format)
+	return n.printCleaned(cleaner, opts.format, cleaner.CleanDead(n.buildLog.Entries))
+}
+
+// newCleaner returns a Cleaner. It is silent when the output is JSON.
+func (n *ninjaMain) newCleaner(format outputFormat) *nin.Cleaner {
+	config := n.config
+	if format == formatJSON {
+		c := *config
+		c.Verbosity = nin.Quiet
+		config = &c
+	}
+	return nin.NewCleaner(&n.state, config, &n.di)
+}
+
+// printCleaned prints the files cleaned when the output is JSON.
+func (n *ninjaMain) printCleaned(cleaner *nin.Cleaner, format outputFormat, ret int) int {
+	if format != formatJSON {
+		return ret
+	}
+	removed := cleaner.CleanedFiles()
+	if removed == nil {
+		removed = []string{}
+	}
+	if r := printJSON(&jsonClean{DryRun: n.config.DryRun, Removed: removed}); r != 0 {
+		return r
+	}
+	return ret
 }
 
 type evaluateCommandMode bool
@@ -703,35 +1357,67 @@ func evaluateCommandWithRspfile(edge *nin.Edge, mode evaluateCommandMode) string
 		return command
 	}
 
-	panic("TODO")
-	/*
-			rspfileContent := edge.GetBinding("rspfile_content")
-		  newlineIndex := 0
-		  for (newlineIndex = rspfileContent.find('\n', newlineIndex)) != string::npos {
-		    rspfileContent.replace(newlineIndex, 1, 1, ' ')
-		    newlineIndex++
-		  }
-		  command.replace(index - 1, rspfile.length() + 1, rspfileContent)
-		  return command
-	*/
+	rspfileContent := strings.ReplaceAll(edge.GetBinding("rspfile_content"), "\n", " ")
+	return command[:index-1] + rspfileContent + command[index+len(rspfile):]
+}
+
+// printCompdb prints the compilation database entry of an edge. When
+// arguments is set, the command is split into an "arguments" array.
+func printCompdb(w io.Writer, directory string, edge *nin.Edge, evalMode evaluateCommandMode, arguments bool) {
+	file := edge.Inputs[0].Path
+	output := edge.Outputs[0].Path
+	if cwd := edge.Cwd(); cwd != "" {
+		// The command is run in another directory; file and output are relative
+		// to the directory the command is run in.
+		dir := cwd
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(directory, dir)
+		}
+		file = compdbPath(directory, dir, file)
+		output = compdbPath(directory, dir, output)
+		directory = dir
+	}
+	fmt.Fprintf(w, "\n  {\n    \"directory\": \"")
+	_, _ = io.WriteString(w, encodeJSONString(directory))
+	if arguments {
+		fmt.Fprintf(w, "\",\n    \"arguments\": [")
+		for i, arg := range splitCommand(evaluateCommandWithRspfile(edge, evalMode)) {
+			if i != 0 {
+				fmt.Fprintf(w, ", ")
+			}
+			fmt.Fprintf(w, "\"")
+			_, _ = io.WriteString(w, encodeJSONString(arg))
+			fmt.Fprintf(w, "\"")
+		}
+		fmt.Fprintf(w, "],\n    \"file\": \"")
+	} else {
+		fmt.Fprintf(w, "\",\n    \"command\": \"")
+		_, _ = io.WriteString(w, encodeJSONString(evaluateCommandWithRspfile(edge, evalMode)))
+		fmt.Fprintf(w, "\",\n    \"file\": \"")
+	}
+	_, _ = io.WriteString(w, encodeJSONString(file))
+	fmt.Fprintf(w, "\",\n    \"output\": \"")
+	_, _ = io.WriteString(w, encodeJSONString(output))
+	fmt.Fprintf(w, "\"\n  }")
 }
 
-func printCompdb(directory string, edge *nin.Edge, evalMode evaluateCommandMode) {
-	fmt.Printf("\n  {\n    \"directory\": \"")
-	printJSONString(directory)
-	fmt.Printf("\",\n    \"command\": \"")
-	printJSONString(evaluateCommandWithRspfile(edge, evalMode))
-	fmt.Printf("\",\n    \"file\": \"")
-	printJSONString(edge.Inputs[0].Path)
-	fmt.Printf("\",\n    \"output\": \"")
-	printJSONString(edge.Outputs[0].Path)
-	fmt.Printf("\"\n  }")
+// compdbPath returns the path p, relative to the build directory root, as a
+// path relative to dir.
+func compdbPath(root, dir, p string) string {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	if r, err := filepath.Rel(dir, p); err == nil {
+		return filepath.ToSlash(r)
+	}
+	return p
 }
 
 func toolCompilationDatabase(n *ninjaMain, opts *options, args []string) int {
-	// HACK: parse one additional flag.
-	// fmt.Printf( "usage: nin -t compdb [options] [rules]\n\noptions:\n  -x     expand @rspfile style response file invocations\n" )
+	// HACK: parse additional flags.
+	// fmt.Printf( "usage: nin -t compdb [options] [rules]\n\noptions:\n  -x     expand @rspfile style response file invocations\n  -arguments  split the command into an arguments array\n" )
 	evalMode := ecmNormal
+	arguments := false
 	for i := 0; i < len(args); i++ {
 		if args[i] == "-x" {
 			if i != len(args)-1 {
@@ -739,6 +1425,10 @@ func toolCompilationDatabase(n *ninjaMain, opts *options, args []string) int {
 				args = args[:len(args)-1]
 			}
 			evalMode = ecmExpandRSPFile
+		} else if args[i] == "-arguments" {
+			args = append(args[:i], args[i+1:]...)
+			i--
+			arguments = true
 		}
 	}
 
@@ -756,7 +1446,7 @@ func toolCompilationDatabase(n *ninjaMain, opts *options, args []string) int {
 			if !first {
 				fmt.Printf(",")
 			}
-			printCompdb(cwd, e, evalMode)
+			printCompdb(os.Stdout, cwd, e, evalMode, arguments)
 			first = false
 		} else {
 			for i := 0; i != len(args); i++ {
@@ -764,7 +1454,7 @@ func toolCompilationDatabase(n *ninjaMain, opts *options, args []string) int {
 					if !first {
 						fmt.Printf(",")
 					}
-					printCompdb(cwd, e, evalMode)
+					printCompdb(os.Stdout, cwd, e, evalMode, arguments)
 					first = false
 				}
 			}
@@ -798,7 +1488,7 @@ func toolRestat(n *ninjaMain, opts *options, args []string) int {
 		logPath = filepath.Join(n.buildDir, logPath)
 	}
 
-	status, err := n.buildLog.Load(logPath)
+	status, err := n.buildLog.LoadWithOpts(logPath, n.logOpts)
 	if status == nin.LoadError {
 		errorf("loading build log %s: %s", logPath, err)
 		return nin.ExitFailure
@@ -831,20 +1521,29 @@ func toolRestat(n *ninjaMain, opts *options, args []string) int {
 // Returns a Tool, or NULL if Ninja should exit.
 func chooseTool(toolName string) *tool {
 	tools := []*tool{
-		{"browse", "browse dependency graph in a web browser", runAfterLoad, toolBrowse},
+		{"browse", "browse dependency graph in a web browser", runAfterLoad, toolBrowse, false},
 		//{"msvc", "build helper for MSVC cl.exe (EXPERIMENTAL)",runAfterFlags, toolMSVC},
-		{"clean", "clean built files", runAfterLoad, toolClean},
-		{"commands", "list all commands required to rebuild given targets", runAfterLoad, toolCommands},
-		{"deps", "show dependencies stored in the deps log", runAfterLogs, toolDeps},
-		{"missingdeps", "check deps log dependencies on generated files", runAfterLogs, toolMissingDeps},
-		{"graph", "output graphviz dot file for targets", runAfterLoad, toolGraph},
-		{"query", "show inputs/outputs for a path", runAfterLogs, toolQuery},
-		{"targets", "list targets by their rule or depth in the DAG", runAfterLoad, toolTargets},
-		{"compdb", "dump JSON compilation database to stdout", runAfterLoad, toolCompilationDatabase},
-		{"recompact", "recompacts ninja-internal data structures", runAfterLoad, toolRecompact},
-		{"restat", "restats all outputs in the build log", runAfterFlags, toolRestat},
-		{"rules", "list all rules", runAfterLoad, toolRules},
-		{"cleandead", "clean built files that are no longer produced by the manifest", runAfterLogs, toolCleanDead},
+		{"clean", "clean built files", runAfterLoad, toolClean, true},
+		{"commands", "list all commands required to rebuild given targets", runAfterLoad, toolCommands, true},
+		{"deps", "show dependencies stored in the deps log", runAfterLogs, toolDeps, true},
+		{"missingdeps", "check deps log dependencies on generated files", runAfterLogs, toolMissingDeps, true},
+		{"extract", "write a standalone manifest to build the targets", runAfterLoad, toolExtract, false},
+		{"manifestdiff", "show the semantic differences between two manifests", runAfterFlags, toolManifestDiff, true},
+		{"graph", "output graphviz dot, mermaid, graphml or json graph for targets", runAfterLoad, toolGraph, true},
+		{"query", "show inputs/outputs for a path", runAfterLogs, toolQuery, true},
+		{"graphquery", "evaluate a query over the build graph, e.g. rdeps(..., foo.h)", runAfterLogs, toolGraphQuery, true},
+		{"targets", "list targets by their rule or depth in the DAG", runAfterLoad, toolTargets, true},
+		{"why", "explain why targets would be rebuilt", runAfterLogs, toolWhy, true},
+		{"cmddiff", "show how the commands for targets changed since the last build", runAfterLogs, toolCmdDiff, true},
+		{"diagnostics", "print the compiler diagnostics in the output saved with -save_output", runAfterLoad, toolDiagnostics, true},
+		{"lastoutput", "print the output saved with -save_output for targets", runAfterLoad, toolLastOutput, true},
+		{"affected", "list the targets depending on changed files", runAfterLogs, toolAffected, true},
+		{"compdb", "dump JSON compilation database to stdout", runAfterLoad, toolCompilationDatabase, false},
+		{"compdb-targets", "dump JSON compilation database for the edges needed to build targets", runAfterLoad, toolCompilationDatabaseTargets, false},
+		{"recompact", "recompacts ninja-internal data structures", runAfterLoad, toolRecompact, false},
+		{"restat", "restats all outputs in the build log", runAfterFlags, toolRestat, false},
+		{"rules", "list all rules", runAfterLoad, toolRules, true},
+		{"cleandead", "clean built files that are no longer produced by the manifest", runAfterLogs, toolCleanDead, true},
 		//{"wincodepage", "print the Windows code page used by nin", runAfterFlags, toolWinCodePage},
 	}
 	if toolName == "list" {
@@ -955,8 +1654,9 @@ func (n *ninjaMain) OpenBuildLog(recompactOnly bool) bool {
 	if n.buildDir != "" {
 		logPath = n.buildDir + "/" + logPath
 	}
+	n.buildLog.Commands = &nin.CommandStore{Dir: n.commandStoreDir()}
 
-	status, err := n.buildLog.Load(logPath)
+	status, err := n.buildLog.LoadWithOpts(logPath, n.logOpts)
 	if status == nin.LoadError {
 		errorf("loading build log %s: %s", logPath, err)
 		return false
@@ -988,6 +1688,27 @@ func (n *ninjaMain) OpenBuildLog(recompactOnly bool) bool {
 	return true
 }
 
+// loadLogs loads the build log and the deps log without opening them for
+// writing, for the tools run after load that need them.
+// @return false on error.
+func (n *ninjaMain) loadLogs() bool {
+	logPath := ".ninja_log"
+	depsPath := ".ninja_deps"
+	if n.buildDir != "" {
+		logPath = n.buildDir + "/" + logPath
+		depsPath = n.buildDir + "/" + depsPath
+	}
+	if status, err := n.buildLog.LoadWithOpts(logPath, n.logOpts); status == nin.LoadError {
+		errorf("loading build log %s: %s", logPath, err)
+		return false
+	}
+	if status, err := n.depsLog.LoadWithOpts(depsPath, &n.state, n.logOpts); status == nin.LoadError {
+		errorf("loading deps log %s: %s", depsPath, err)
+		return false
+	}
+	return true
+}
+
 // Open the deps log: load it, then open for writing.
 // @return false on error.
 // Open the deps log: load it, then open for writing.
@@ -998,7 +1719,7 @@ func (n *ninjaMain) OpenDepsLog(recompactOnly bool) bool {
 		path = n.buildDir + "/" + path
 	}
 
-	status, err := n.depsLog.Load(path, &n.state)
+	status, err := n.depsLog.LoadWithOpts(path, &n.state, n.logOpts)
 	if status == nin.LoadError {
 		errorf("loading deps log %s: %s", path, err)
 		return false
@@ -1064,7 +1785,7 @@ func (n *ninjaMain) RunBuild(args []string, status nin.Status) int {
 
 	n.di.AllowStatCache(!disableExperimentalStatcache)
 
-	builder := nin.NewBuilder(&n.state, n.config, &n.buildLog, &n.depsLog, &n.di, status, n.startTimeMillis)
+	builder := n.newBuilder(status)
 	for i := 0; i < len(targets); i++ {
 		if dirty, err := builder.AddTarget(targets[i]); !dirty {
 			if err != nil {
@@ -1161,6 +1882,17 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	// Flags that do not exist in the C++ code:
 	serial := flag.Bool("serial", false, "parse subninja files serially; default is concurrent")
 	noprewarm := flag.Bool("noprewarm", false, "do not prewarm subninja files; instead process them in order")
+	opts.format = formatText
+	flag.Var(&opts.format, "format", "output format of query tools (affected, clean, cleandead, cmddiff, commands, deps, diagnostics, graph, graphquery, lastoutput, manifestdiff, missingdeps, query, rules, targets, why): text or json")
+	saveOutput := flag.String("save_output", "", "save the output of the edges run in $builddir/"+outputStoreName+" for -t lastoutput: all or failed")
+	flag.BoolVar(&config.SavedCommands.Save, "save_commands", false, "save the commands of the edges run, without their environment variables, in $builddir/"+commandStoreName+" for -d explain and -t cmddiff")
+	flag.StringVar(&opts.compdb, "compdb", "", "keep this compilation database, e.g. compile_commands.json, up to date before each build")
+	flag.Var(&opts.compdbRules, "compdb_rule", "only include the edges using this rule in -compdb; can be repeated")
+	flag.StringVar(&opts.junit, "junit", "", "write a JUnit XML report of the edges run to this file")
+	flag.BoolVar(&config.UsePTY, "pty", false, "run the commands in a pseudo-terminal so compilers print colors, stripped unless nin's output is a smart terminal (linux only)")
+	multiline := flag.Bool("multiline", false, "on smart terminals, show one status line per running edge with its elapsed time")
+	flag.BoolVar(&config.ToolDeps, "tool_deps", false, "rebuild the edges whose tool, the first word of the command resolved through the PATH of the command, changed")
+	mmap := flag.Bool("mmap", false, "memory map .ninja_log and .ninja_deps and parse them concurrently")
 	opts.parserOpts.Concurrency = nin.ParseManifestConcurrentParsing
 
 	flag.Usage = usage
@@ -1176,6 +1908,12 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	if *quiet {
 		config.Verbosity = nin.NoStatusUpdate
 	}
+	// We want to go until N jobs fail, which means we should allow N failures
+	// and then stop. For N <= 0, MaxInt32 is close enough to infinite for most
+	// sane builds.
+	if config.FailuresAllowed <= 0 {
+		config.FailuresAllowed = math.MaxInt32
+	}
 	if *warning != "" {
 		if !warningEnable(*warning, opts) {
 			return 1
@@ -1194,6 +1932,10 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 			return 0
 		}
 	}
+	if opts.format == formatJSON && (opts.tool == nil || !opts.tool.json) {
+		fmt.Fprintf(os.Stderr, "-format=json is only supported by query tools; see -h.\n")
+		return 2
+	}
 	i := 0
 	if opts.cpuprofile != "" {
 		i++
@@ -1215,6 +1957,27 @@ func readFlags(opts *options, config *nin.BuildConfig) int {
 	if *noprewarm {
 		opts.parserOpts.Concurrency = nin.ParseManifestSerial
 	}
+	if *mmap {
+		opts.logOpts.Mmap = true
+		opts.logOpts.Concurrency = runtime.NumCPU()
+	}
+	opts.multiline = *multiline
+	switch *saveOutput {
+	case "":
+	case "all":
+		config.SavedOutputs.Mode = nin.OutputAll
+	case "failed":
+		config.SavedOutputs.Mode = nin.OutputFailed
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -save_output %q; valid values are all and failed\n", *saveOutput)
+		return 2
+	}
+	if config.UsePTY {
+		if err := nin.CheckPTY(); err != nil {
+			warningf("-pty: %s; the commands are run with a pipe", err)
+			config.UsePTY = false
+		}
+	}
 
 	/*
 		OPT_VERSION := 1
@@ -1375,6 +2138,12 @@ func mainImpl() int {
 	args := flag.Args()
 
 	status := newStatusPrinter(&config)
+	if opts.tool == nil {
+		status.junitPath = opts.junit
+	}
+	if opts.multiline && opts.tool == nil {
+		status.enableLiveStatus()
+	}
 	if opts.workingDir != "" {
 		// The formatting of this string, complete with funny quotes, is
 		// so Emacs can properly identify that the cwd has changed for
@@ -1393,6 +2162,7 @@ func mainImpl() int {
 		// None of the runAfterFlags actually use a ninjaMain, but it's needed
 		// by other tools.
 		ninja := newNinjaMain(ninjaCommand, &config)
+		ninja.logOpts = opts.logOpts
 		return opts.tool.tool(&ninja, &opts, args)
 	}
 
@@ -1413,12 +2183,15 @@ func mainImpl() int {
 	const cycleLimit = 100
 	for cycle := 1; cycle <= cycleLimit; cycle++ {
 		ninja := newNinjaMain(ninjaCommand, &config)
+		status.junitLog = &ninja.buildLog
+		ninja.logOpts = opts.logOpts
 		input, err2 := ninja.di.ReadFile(opts.inputFile)
 		if err2 != nil {
 			status.Error("%s", err2)
 			return 1
 		}
-		if err := nin.ParseManifest(&ninja.state, &ninja.di, opts.parserOpts, opts.inputFile, input); err != nil {
+		manifests := fileRecorder{FileReader: &ninja.di, paths: []string{opts.inputFile}}
+		if err := nin.ParseManifest(&ninja.state, &manifests, opts.parserOpts, opts.inputFile, input); err != nil {
 			status.Error("%s", err)
 			return 1
 		}
@@ -1430,6 +2203,11 @@ func mainImpl() int {
 		if !ninja.EnsureBuildDirExists() {
 			return 1
 		}
+		if !config.DryRun {
+			status.reportPath = filepath.Join(ninja.buildDir, failureReportName)
+		}
+		config.SavedOutputs.Dir = ninja.outputStoreDir()
+		config.SavedCommands.Dir = ninja.commandStoreDir()
 
 		if !ninja.OpenBuildLog(false) || !ninja.OpenDepsLog(false) {
 			return 1
@@ -1453,6 +2231,12 @@ func mainImpl() int {
 			return 1
 		}
 
+		if opts.compdb != "" && !config.DryRun {
+			if err := updateCompdb(&ninja.state, opts.compdb, opts.compdbRules, manifests.paths); err != nil {
+				status.Warning("updating %s: %s", opts.compdb, err)
+			}
+		}
+
 		result := ninja.RunBuild(args, status)
 		if metricsEnabled {
 			ninja.DumpMetrics()
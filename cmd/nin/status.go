@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/maruel/nin"
 )
@@ -33,9 +34,48 @@ type statusPrinter struct {
 	// Prints progress output.
 	printer linePrinter
 
+	// Draws one line per running edge when enabled with -multiline on a smart
+	// terminal. When set, it is used instead of printer.
+	live *liveStatus
+
 	// The custom progress status format to use.
 	progressStatusFormat string
 	currentRate          slidingRateInfo
+
+	// exitCodes are the exit codes of the edges reported by BuildEdgeExitCode
+	// and not yet finished.
+	exitCodes map[*nin.Edge]nin.ExitStatus
+	// failures are the edges that failed in the current build.
+	failures []buildFailure
+	// reportPath is where the failure report is written at the end of the
+	// build. Empty to disable.
+	reportPath string
+
+	// junitPath is where the JUnit XML report is written at the end of each
+	// build. Empty to disable. The test cases accumulate across the builds,
+	// e.g. the manifest rebuild and the main build.
+	junitPath   string
+	junitStarts map[*nin.Edge]int32
+	junitCases  []junitTestCase
+	// junitLog is the build log of the current build. The duration of the
+	// successful edges is the one recorded in it, which is only known once the
+	// edge is finished. junitPending are the indexes in junitCases waiting for
+	// it.
+	junitLog     *nin.BuildLog
+	junitPending []int
+}
+
+// failureReportName is the file in the build directory describing the edges
+// that failed in the last build.
+const failureReportName = ".ninja_failures"
+
+// buildFailure is an edge that failed, as listed in the failure summary.
+type buildFailure struct {
+	outputs     []string
+	description string
+	command     string
+	exitCode    nin.ExitStatus
+	output      string
 }
 
 type slidingRateInfo struct {
@@ -84,6 +124,30 @@ func newStatusPrinter(config *nin.BuildConfig) *statusPrinter {
 	return s
 }
 
+// enableLiveStatus shows the running edges below the progress line if stdout
+// is a smart terminal. Otherwise the single line status is kept.
+func (s *statusPrinter) enableLiveStatus() {
+	if s.config.Verbosity != nin.Normal || os.Getenv("TERM") == "dumb" {
+		return
+	}
+	width, height, ok := terminalSize(os.Stdout)
+	if !ok {
+		return
+	}
+	s.live = newLiveStatus(os.Stdout, width, height)
+	s.printer.supportsColor = true
+}
+
+// printOnNewLine prints a string on a new line, above the running edges in
+// live mode.
+func (s *statusPrinter) printOnNewLine(toPrint string) {
+	if s.live != nil {
+		s.live.print(toPrint)
+	} else {
+		s.printer.PrintOnNewLine(toPrint)
+	}
+}
+
 func (s *statusPrinter) PlanHasTotalEdges(total int) {
 	s.totalEdges = total
 }
@@ -92,6 +156,19 @@ func (s *statusPrinter) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32)
 	s.startedEdges++
 	s.runningEdges++
 	s.timeMillis = startTimeMillis
+	if s.junitPath != "" {
+		if s.junitStarts == nil {
+			s.junitStarts = map[*nin.Edge]int32{}
+		}
+		s.junitStarts[edge] = startTimeMillis
+	}
+	if s.live != nil {
+		s.live.edgeStarted(edge, s.edgeDescription(edge), s.liveProgress(startTimeMillis))
+		if edge.Pool == nin.ConsolePool {
+			s.live.setPaused(true)
+		}
+		return
+	}
 	if edge.Pool == nin.ConsolePool || s.printer.isSmartTerminal() {
 		s.PrintStatus(edge, startTimeMillis)
 	}
@@ -101,24 +178,61 @@ func (s *statusPrinter) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32)
 	}
 }
 
+// BuildEdgeExitCode implements nin.ExitCodeReporter.
+func (s *statusPrinter) BuildEdgeExitCode(edge *nin.Edge, exitCode nin.ExitStatus) {
+	if s.exitCodes == nil {
+		s.exitCodes = map[*nin.Edge]nin.ExitStatus{}
+	}
+	s.exitCodes[edge] = exitCode
+}
+
 func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, success bool, output string) {
 	s.timeMillis = endTimeMillis
 	s.finishedEdges++
+	exitCode, ok := s.exitCodes[edge]
+	delete(s.exitCodes, edge)
+	if !ok && !success {
+		exitCode = nin.ExitFailure
+	}
+	if !success {
+		s.failures = append(s.failures, buildFailure{
+			outputs:     nodePaths(edge.Outputs),
+			description: edge.GetBinding("description"),
+			command:     edge.EvaluateCommand(false),
+			exitCode:    exitCode,
+			output:      output,
+		})
+	}
+	if s.junitPath != "" {
+		if success {
+			s.junitPending = append(s.junitPending, len(s.junitCases))
+		}
+		s.junitCases = append(s.junitCases, newJUnitTestCase(edge, endTimeMillis-s.junitStarts[edge], exitCode, output))
+		delete(s.junitStarts, edge)
+	}
 
 	if edge.Pool == nin.ConsolePool {
-		s.printer.SetConsoleLocked(false)
+		if s.live != nil {
+			s.live.setPaused(false)
+		} else {
+			s.printer.SetConsoleLocked(false)
+		}
 	}
 
 	if s.config.Verbosity == nin.Quiet {
 		return
 	}
 
-	if edge.Pool != nin.ConsolePool {
-		s.PrintStatus(edge, endTimeMillis)
+	if s.live != nil {
+		s.runningEdges--
+		s.live.edgeFinished(edge, s.liveProgress(endTimeMillis))
+	} else {
+		if edge.Pool != nin.ConsolePool {
+			s.PrintStatus(edge, endTimeMillis)
+		}
+		s.runningEdges--
 	}
 
-	s.runningEdges--
-
 	// Print the command that is spewing before printing its output.
 	if !success {
 		outputs := ""
@@ -126,11 +240,11 @@ func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, s
 			outputs += o.Path + " "
 		}
 		if s.printer.supportsColor {
-			s.printer.PrintOnNewLine("\x1B[31mFAILED: \x1B[0m" + outputs + "\n")
+			s.printOnNewLine("\x1B[31mFAILED: \x1B[0m" + outputs + "\n")
 		} else {
-			s.printer.PrintOnNewLine("FAILED: " + outputs + "\n")
+			s.printOnNewLine("FAILED: " + outputs + "\n")
 		}
-		s.printer.PrintOnNewLine(edge.EvaluateCommand(false) + "\n")
+		s.printOnNewLine(edge.EvaluateCommand(false) + "\n")
 	}
 
 	if len(output) != 0 {
@@ -142,12 +256,14 @@ func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, s
 		// To make sure these escape codes don't show up in a file if ninja's output
 		// is piped to a file, ninja strips ansi escape codes again if it's not
 		// writing to a |smartTerminal|.
-		// (Launching subprocesses in pseudo ttys doesn't work because there are
-		// only a few hundred available on some systems, and ninja can launch
-		// thousands of parallel compile commands.)
+		// With -pty, BuildConfig.UsePTY runs the subprocesses in pseudo ttys
+		// instead, so they print colors without such a flag. Each running
+		// command holds one pseudo tty, and there are only a few hundred
+		// available on some systems; a command falls back to a pipe when none
+		// is left.
 		finalOutput := ""
 		if !s.printer.supportsColor {
-			finalOutput = stripAnsiEscapeCodes(output)
+			finalOutput = nin.StripAnsiEscapeCodes(output)
 		} else {
 			finalOutput = output
 		}
@@ -156,7 +272,7 @@ func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, s
 		// Fix extra CR being added on Windows, writing out CR CR LF (#773)
 		//Setmode(Fileno(stdout), _O_BINARY) // Begin Windows extra CR fix
 
-		s.printer.PrintOnNewLine(finalOutput)
+		s.printOnNewLine(finalOutput)
 
 		//Setmode(Fileno(stdout), _O_TEXT) // End Windows extra CR fix
 
@@ -164,7 +280,7 @@ func (s *statusPrinter) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, s
 }
 
 func (s *statusPrinter) BuildLoadDyndeps() {
-	// The DependencyScan calls Explain() to print lines explaining why
+	// The DependencyScan reports lines (printed by explainDirty) explaining why
 	// it considers a portion of the graph to be out of date.  Normally
 	// this is done before the build starts, but our caller is about to
 	// load a dyndep file during the build.  Doing so may generate more
@@ -174,7 +290,7 @@ func (s *statusPrinter) BuildLoadDyndeps() {
 	// append to the status line.  After the explanations are done a
 	// new build status line will appear.
 	if nin.Debug.Explaining {
-		s.printer.PrintOnNewLine("")
+		s.printOnNewLine("")
 	}
 }
 
@@ -182,11 +298,96 @@ func (s *statusPrinter) BuildStarted() {
 	s.startedEdges = 0
 	s.finishedEdges = 0
 	s.runningEdges = 0
+	s.failures = nil
+	if s.live != nil {
+		s.live.start()
+	}
 }
 
 func (s *statusPrinter) BuildFinished() {
-	s.printer.SetConsoleLocked(false)
-	s.printer.PrintOnNewLine("")
+	if s.live != nil {
+		s.live.finish(s.liveProgress(s.timeMillis))
+	} else {
+		s.printer.SetConsoleLocked(false)
+		s.printer.PrintOnNewLine("")
+	}
+	s.writeFailureReport()
+	if s.junitPath != "" {
+		// Prefer the durations recorded in the build log. The status times are
+		// kept for the failed edges, which are not recorded.
+		for _, i := range s.junitPending {
+			if s.junitLog != nil {
+				if e := s.junitLog.Entries[s.junitCases[i].Name]; e != nil {
+					s.junitCases[i].Time = junitTime(e.DurationMillis())
+				}
+			}
+		}
+		s.junitPending = s.junitPending[:0]
+		if err := writeJUnitReport(s.junitPath, s.junitCases); err != nil {
+			s.Warning("writing JUnit report: %s", err)
+		}
+	}
+	if len(s.failures) != 0 && s.config.Verbosity != nin.Quiet {
+		s.printer.PrintOrBuffer(s.failureSummary())
+	}
+}
+
+// failureSummary returns a recap of the failed edges, one per line, so they
+// don't get lost in the build output.
+func (s *statusPrinter) failureSummary() string {
+	var b strings.Builder
+	if len(s.failures) == 1 {
+		b.WriteString("1 edge failed:\n")
+	} else {
+		fmt.Fprintf(&b, "%d edges failed:\n", len(s.failures))
+	}
+	for _, f := range s.failures {
+		name := f.description
+		if name == "" {
+			name = strings.Join(f.outputs, " ")
+		}
+		fmt.Fprintf(&b, "  %s (exit %d)\n", name, f.exitCode)
+	}
+	if s.reportPath != "" {
+		fmt.Fprintf(&b, "full report in %s\n", s.reportPath)
+	}
+	return b.String()
+}
+
+// writeFailureReport writes the description, command, exit code and output of
+// each failed edge to reportPath, for CI to attach. The file is removed when
+// the build succeeded, so that it never describes a previous build.
+func (s *statusPrinter) writeFailureReport() {
+	if s.reportPath == "" {
+		return
+	}
+	if len(s.failures) == 0 {
+		if err := os.Remove(s.reportPath); err != nil && !os.IsNotExist(err) {
+			s.Warning("%s", err)
+		}
+		return
+	}
+	var b strings.Builder
+	for i, f := range s.failures {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "FAILED: %s\n", strings.Join(f.outputs, " "))
+		if f.description != "" {
+			fmt.Fprintf(&b, "description: %s\n", f.description)
+		}
+		fmt.Fprintf(&b, "exit code: %d\ncommand: %s\n", f.exitCode, f.command)
+		if f.output != "" {
+			b.WriteString("output:\n")
+			b.WriteString(nin.StripAnsiEscapeCodes(f.output))
+			if !strings.HasSuffix(f.output, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	if err := os.WriteFile(s.reportPath, []byte(b.String()), 0o666); err != nil {
+		s.Warning("writing failure report: %s", err)
+	}
 }
 
 // Format the progress status string by replacing the placeholders.
@@ -271,14 +472,23 @@ func (s *statusPrinter) PrintStatus(edge *nin.Edge, timeMillis int32) {
 	}
 
 	forceFullCommand := s.config.Verbosity == nin.Verbose
+	toPrint := s.formatProgressStatus(s.progressStatusFormat, timeMillis) + s.edgeDescription(edge)
+	s.printer.Print(toPrint, !forceFullCommand)
+}
 
+// edgeDescription returns the description of the edge, or its command if
+// there is none or in verbose mode.
+func (s *statusPrinter) edgeDescription(edge *nin.Edge) string {
 	toPrint := edge.GetBinding("description")
-	if toPrint == "" || forceFullCommand {
-		toPrint = edge.GetBinding("command")
+	if toPrint == "" || s.config.Verbosity == nin.Verbose {
+		toPrint = edge.EvaluateCommand(false)
 	}
+	return toPrint
+}
 
-	toPrint = s.formatProgressStatus(s.progressStatusFormat, timeMillis) + toPrint
-	s.printer.Print(toPrint, !forceFullCommand)
+// liveProgress returns the progress line in live mode.
+func (s *statusPrinter) liveProgress(timeMillis int32) string {
+	return strings.TrimRight(s.formatProgressStatus(s.progressStatusFormat, timeMillis), " ")
 }
 
 func (s *statusPrinter) Warning(msg string, i ...interface{}) {
@@ -0,0 +1,291 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/maruel/nin"
+)
+
+// liveStatus draws the overall progress line followed by one line per running
+// edge with its elapsed time, redrawing them in place on a smart terminal.
+//
+// The running edges mirror Builder's running edges: the Status callbacks are
+// called as edges are added to and removed from it.
+type liveStatus struct {
+	out           io.Writer
+	width, height int
+
+	mu       sync.Mutex
+	progress string
+	running  []liveEdge
+	// lines is the number of lines currently drawn.
+	lines int
+	// paused is set while an edge in the console pool owns the terminal.
+	paused bool
+	// buffer is the output buffered while paused.
+	buffer strings.Builder
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type liveEdge struct {
+	edge  *nin.Edge
+	desc  string
+	start time.Time
+}
+
+// liveRefresh is the interval at which the elapsed times are updated.
+const liveRefresh = 100 * time.Millisecond
+
+func newLiveStatus(out io.Writer, width, height int) *liveStatus {
+	return &liveStatus{out: out, width: width, height: height}
+}
+
+// start starts refreshing the elapsed times until finish() is called.
+func (l *liveStatus) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		t := time.NewTicker(liveRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case now := <-t.C:
+				l.mu.Lock()
+				l.redrawLocked(now)
+				l.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// finish stops refreshing and leaves the progress line on the terminal.
+func (l *liveStatus) finish(progress string) {
+	l.mu.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.progress = progress
+	l.running = l.running[:0]
+	l.paused = false
+	l.flushLocked()
+	l.redrawLocked(time.Now())
+	if l.lines != 0 {
+		fmt.Fprint(l.out, "\n")
+		l.lines = 0
+	}
+}
+
+func (l *liveStatus) edgeStarted(edge *nin.Edge, desc, progress string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = append(l.running, liveEdge{edge: edge, desc: desc, start: time.Now()})
+	l.progress = progress
+	l.redrawLocked(time.Now())
+}
+
+func (l *liveStatus) edgeFinished(edge *nin.Edge, progress string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.running {
+		if l.running[i].edge == edge {
+			l.running = append(l.running[:i], l.running[i+1:]...)
+			break
+		}
+	}
+	l.progress = progress
+	l.redrawLocked(time.Now())
+}
+
+// setPaused erases the status lines and stops drawing them while an edge in
+// the console pool is running.
+func (l *liveStatus) setPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if paused {
+		l.clearLocked()
+		l.paused = true
+		return
+	}
+	l.paused = false
+	l.flushLocked()
+	l.redrawLocked(time.Now())
+}
+
+// print prints s above the status lines.
+//
+// An empty string erases the status lines until the next update, so that
+// output written directly to the terminal starts on a new line.
+func (l *liveStatus) print(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	if l.paused {
+		l.buffer.WriteString(s)
+		return
+	}
+	l.clearLocked()
+	if s == "" {
+		return
+	}
+	fmt.Fprint(l.out, s)
+	l.redrawLocked(time.Now())
+}
+
+func (l *liveStatus) flushLocked() {
+	if l.buffer.Len() != 0 {
+		l.clearLocked()
+		fmt.Fprint(l.out, l.buffer.String())
+		l.buffer.Reset()
+	}
+}
+
+// clearLocked erases the status lines and moves the cursor to the beginning
+// of the first one.
+func (l *liveStatus) clearLocked() {
+	if l.lines == 0 {
+		return
+	}
+	s := "\r\x1B[K"
+	for i := 1; i < l.lines; i++ {
+		s += "\x1B[1A\x1B[K"
+	}
+	fmt.Fprint(l.out, s)
+	l.lines = 0
+}
+
+func (l *liveStatus) redrawLocked(now time.Time) {
+	if l.paused {
+		return
+	}
+	lines := l.render(now)
+	l.clearLocked()
+	fmt.Fprint(l.out, strings.Join(lines, "\n"))
+	l.lines = len(lines)
+}
+
+// render returns the lines to draw: the progress line followed by the running
+// edges, oldest first, each cut to the terminal width.
+func (l *liveStatus) render(now time.Time) []string {
+	// Keep a line free so the terminal doesn't scroll.
+	maxEdges := l.height - 2
+	if maxEdges < 1 {
+		maxEdges = 1
+	}
+	lines := []string{l.progress}
+	for i, r := range l.running {
+		if i == maxEdges-1 && len(l.running) > maxEdges {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(l.running)-i))
+			break
+		}
+		elapsed := now.Sub(r.start).Seconds()
+		lines = append(lines, fmt.Sprintf("  %s (%.1fs)", r.desc, elapsed))
+	}
+	if l.width > 0 {
+		for i := range lines {
+			lines[i] = cutToWidth(lines[i], l.width)
+		}
+	}
+	return lines
+}
+
+// cutToWidth cuts s to width terminal cells, not counting the ANSI escape
+// sequences which are kept whole. The attributes are reset if a sequence was
+// seen before the cut, so a color doesn't leak into the next lines.
+func cutToWidth(s string, width int) string {
+	escaped := false
+	for i := 0; i < len(s); {
+		if s[i] == '\x1B' && i+1 < len(s) && s[i+1] == '[' {
+			// Skip the CSI up to and including its final byte.
+			escaped = true
+			for i += 2; i < len(s) && (s[i] < 0x40 || s[i] > 0x7E); i++ {
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		w := runeWidth(r)
+		if w > width {
+			if escaped {
+				return s[:i] + "\x1B[0m"
+			}
+			return s[:i]
+		}
+		width -= w
+		i += size
+	}
+	return s
+}
+
+// wideRunes are the East Asian wide and fullwidth ranges, which use two
+// terminal cells.
+var wideRunes = []struct{ lo, hi rune }{
+	{0x1100, 0x115F},
+	{0x2E80, 0x303E},
+	{0x3041, 0x33FF},
+	{0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE30, 0xFE4F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F},
+	{0x1F900, 0x1F9FF},
+	{0x20000, 0x2FFFD},
+	{0x30000, 0x3FFFD},
+}
+
+// runeWidth returns the number of terminal cells used by r.
+func runeWidth(r rune) int {
+	if unicode.Is(unicode.Mn, r) {
+		// Combining marks are drawn over the previous rune.
+		return 0
+	}
+	for _, w := range wideRunes {
+		if r < w.lo {
+			break
+		}
+		if r <= w.hi {
+			return 2
+		}
+	}
+	return 1
+}
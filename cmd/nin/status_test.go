@@ -15,8 +15,13 @@
 package main
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/maruel/nin"
 )
 
@@ -39,3 +44,134 @@ func TestStatusTest_StatusFormatReplacePlaceholder(t *testing.T) {
 		t.Fatal("expected equal")
 	}
 }
+
+func TestLiveStatus(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := newLiveStatus(&buf, 20, 4)
+	now := time.Now()
+	for i, desc := range []string{"CC a.o", "CC b_very_long_name.o", "CC c.o"} {
+		l.running = append(l.running, liveEdge{desc: desc, start: now.Add(time.Duration(-i) * time.Second)})
+	}
+	l.progress = "[1/4]"
+	want := []string{"[1/4]", "  CC a.o (0.0s)", "  ... and 2 more"}
+	if diff := cmp.Diff(want, l.render(now)); diff != "" {
+		t.Fatal(diff)
+	}
+	l.height = 10
+	want = []string{"[1/4]", "  CC a.o (0.0s)", "  CC b_very_long_nam", "  CC c.o (2.0s)"}
+	if diff := cmp.Diff(want, l.render(now)); diff != "" {
+		t.Fatal(diff)
+	}
+
+	l.running = l.running[:1]
+	l.redrawLocked(now)
+	l.print("output")
+	want2 := "[1/4]\n  CC a.o (0.0s)" + "\r\x1B[K\x1B[1A\x1B[K" + "output\n" + "[1/4]\n  CC a.o (0.0s)"
+	if diff := cmp.Diff(want2, buf.String()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCutToWidth(t *testing.T) {
+	data := []struct {
+		in    string
+		width int
+		want  string
+	}{
+		{"CC a.o", 10, "CC a.o"},
+		{"CC a.o", 4, "CC a"},
+		{"CC héé.o", 5, "CC hé"},
+		{"CC 日本.o", 4, "CC "},
+		{"CC 日本.o", 5, "CC 日"},
+		{"CC 日本.o", 8, "CC 日本."},
+		{"CC e\u0301.o", 5, "CC e\u0301."},
+		{"\x1B[1mCC\x1B[0m a.o", 4, "\x1B[1mCC\x1B[0m a\x1B[0m"},
+		{"\x1B[1mCC\x1B[0m a.o", 6, "\x1B[1mCC\x1B[0m a.o"},
+		{"CC\x1B[1", 1, "C"},
+	}
+	for i, l := range data {
+		if got := cutToWidth(l.in, l.width); got != l.want {
+			t.Errorf("#%d: want %q, got %q", i, l.want, got)
+		}
+	}
+}
+
+func TestStatusTest_FailureReport(t *testing.T) {
+	state := parseForFormat(t, "rule cc\n  command = cc $in -o $out\n  description = CC $out\nrule touch\n  command = touch $out\nbuild a.o: cc a.c\nbuild b: touch\n")
+	cfg := nin.NewBuildConfig()
+	cfg.Verbosity = nin.Quiet
+	status := newStatusPrinter(&cfg)
+	status.reportPath = filepath.Join(t.TempDir(), failureReportName)
+
+	status.BuildStarted()
+	a := state.Paths["a.o"].InEdge
+	b := state.Paths["b"].InEdge
+	status.BuildEdgeStarted(a, 0)
+	status.BuildEdgeStarted(b, 0)
+	status.BuildEdgeExitCode(a, 1)
+	status.BuildEdgeFinished(a, 1, false, "\x1B[31merror\x1B[0m: oops\n")
+	status.BuildEdgeExitCode(b, 3)
+	status.BuildEdgeFinished(b, 2, false, "")
+	status.BuildFinished()
+
+	want := "2 edges failed:\n  CC a.o (exit 1)\n  b (exit 3)\nfull report in " + status.reportPath + "\n"
+	if diff := cmp.Diff(want, status.failureSummary()); diff != "" {
+		t.Fatal(diff)
+	}
+	got, err := os.ReadFile(status.reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "FAILED: a.o\ndescription: CC a.o\nexit code: 1\ncommand: cc a.c -o a.o\noutput:\nerror: oops\n\nFAILED: b\nexit code: 3\ncommand: touch b\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// A successful build removes the stale report.
+	status.BuildStarted()
+	status.BuildFinished()
+	if _, err := os.Stat(status.reportPath); !os.IsNotExist(err) {
+		t.Fatalf("expected report to be removed: %v", err)
+	}
+}
+
+func TestStatusTest_JUnitReport(t *testing.T) {
+	state := parseForFormat(t, "rule cc\n  command = cc $in -o $out\nrule touch\n  command = touch $out\nbuild a.o: cc a.c\nbuild b: touch\n")
+	cfg := nin.NewBuildConfig()
+	cfg.Verbosity = nin.Quiet
+	status := newStatusPrinter(&cfg)
+	status.junitPath = filepath.Join(t.TempDir(), "junit.xml")
+
+	status.BuildStarted()
+	a := state.Paths["a.o"].InEdge
+	b := state.Paths["b"].InEdge
+	status.BuildEdgeStarted(a, 100)
+	status.BuildEdgeStarted(b, 200)
+	status.BuildEdgeFinished(a, 1350, false, "\x1B[31merror\x1B[0m: <oops>\n")
+	status.BuildEdgeFinished(b, 1400, true, "")
+	// The successful edges use the duration recorded in the build log.
+	log := nin.NewBuildLog()
+	status.junitLog = &log
+	if err := log.RecordCommand(b, 300, 1300, 0); err != nil {
+		t.Fatal(err)
+	}
+	status.BuildFinished()
+
+	got, err := os.ReadFile(status.junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="nin" tests="2" failures="1">
+    <testcase classname="cc" name="a.o" time="1.250">
+      <failure message="exit code 1: cc a.c -o a.o">error: &lt;oops&gt;&#xA;</failure>
+    </testcase>
+    <testcase classname="touch" name="b" time="1.000"></testcase>
+  </testsuite>
+</testsuites>
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "os"
+
+// terminalSize returns the size of the terminal f is connected to. ok is false
+// if f is not a terminal.
+//
+// TODO(maruel): Use GetConsoleScreenBufferInfo() and enable
+// ENABLE_VIRTUAL_TERMINAL_PROCESSING.
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	return 0, 0, false
+}
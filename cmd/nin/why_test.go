@@ -0,0 +1,125 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+// captureStdout returns what f printed on stdout.
+func captureStdout(t *testing.T, f func() int) (string, int) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = old
+	}()
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		_ = r.Close()
+		out <- b
+	}()
+	ret := f()
+	_ = w.Close()
+	return string(<-out), ret
+}
+
+// chdir changes the current directory to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(old); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestToolWhy(t *testing.T) {
+	chdir(t, t.TempDir())
+	if err := ioutil.WriteFile("a.c", nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	why := func(format outputFormat) string {
+		config := nin.NewBuildConfig()
+		n := newNinjaMain("nin", &config)
+		if err := nin.ParseManifest(&n.state, &n.di, nin.ParseManifestOpts{}, "build.ninja", []byte("rule cc\n  command = cc $in -o $out\nbuild a.o: cc a.c\nbuild app: cc a.o\n\x00")); err != nil {
+			t.Fatal(err)
+		}
+		opts := options{format: format}
+		got, ret := captureStdout(t, func() int { return toolWhy(&n, &opts, []string{"app", "a.c"}) })
+		if ret != 0 {
+			t.Fatal(ret)
+		}
+		return got
+	}
+
+	want := "app: dirty\n" +
+		"  a.o is dirty\n" +
+		"    a.o: dirty\n" +
+		"      output a.o doesn't exist\n" +
+		"a.c: clean\n"
+	if diff := cmp.Diff(want, why(formatText)); diff != "" {
+		t.Fatal(diff)
+	}
+	want = `[
+  {
+    "path": "app",
+    "dirty": true,
+    "reasons": [
+      {
+        "kind": "input_dirty",
+        "message": "a.o is dirty",
+        "node": "app",
+        "input": "a.o",
+        "chain": {
+          "path": "a.o",
+          "dirty": true,
+          "reasons": [
+            {
+              "kind": "output_missing",
+              "message": "output a.o doesn't exist",
+              "node": "a.o"
+            }
+          ]
+        }
+      }
+    ]
+  },
+  {
+    "path": "a.c",
+    "dirty": false,
+    "reasons": []
+  }
+]
+`
+	if diff := cmp.Diff(want, why(formatJSON)); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CommandStore persists the full evaluated commands, so the previous command
+// of an edge can be compared with the current one. The build log only
+// contains the command hash.
+//
+// The commands are gzip compressed, one file per command keyed by its hash as
+// recorded in the build log, so that identical commands are only stored once.
+//
+// The commands are stored as returned by Edge.EvaluateCommandWithoutEnv(), so
+// the values of the environment variables are never written to disk. The
+// commands no longer referenced by the build log are removed by Prune.
+type CommandStore struct {
+	Dir string
+	// Save enables Record. Lookup works as long as Dir is set.
+	Save bool
+}
+
+// Record saves a command, as returned by Edge.EvaluateCommandWithoutEnv(),
+// under the hash of Edge.EvaluateCommand(true), if Save is set.
+func (c *CommandStore) Record(hash uint64, command string) error {
+	if !c.Save || c.Dir == "" {
+		return nil
+	}
+	name := hashFileName(c.Dir, hash)
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(command)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0o777); err != nil {
+		return err
+	}
+	return WriteFileAtomic(name, b.Bytes())
+}
+
+// Lookup returns the command whose hash is hash.
+//
+// Returns an error wrapping os.ErrNotExist if it was not saved.
+func (c *CommandStore) Lookup(hash uint64) (string, error) {
+	if c.Dir == "" {
+		return "", fmt.Errorf("%016x: %w", hash, os.ErrNotExist)
+	}
+	f, err := os.Open(hashFileName(c.Dir, hash))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", hashFileName(c.Dir, hash), err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", hashFileName(c.Dir, hash), err)
+	}
+	return string(b), nil
+}
+
+// Prune removes the commands whose hash is not referenced by the entries of
+// the build log, along with the temporary files left by interrupted builds.
+func (c *CommandStore) Prune(entries map[string]*LogEntry) error {
+	if c.Dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	live := make(map[uint64]struct{}, len(entries))
+	for _, e := range entries {
+		live[e.commandHash] = struct{}{}
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".tmp") {
+			if len(name) != 16 {
+				continue
+			}
+			hash, err := strconv.ParseUint(name, 16, 64)
+			if err != nil {
+				continue
+			}
+			if _, ok := live[hash]; ok {
+				continue
+			}
+		}
+		if err := os.Remove(filepath.Join(c.Dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxCommandDiffCells bounds the memory used by CommandDiff.
+const maxCommandDiffCells = 1 << 22
+
+// CommandDiff returns a word-level diff between two commands, in the style of
+// "git diff --word-diff=plain": removed words are written as [-word-] and
+// added words as {+word+}.
+func CommandDiff(old, new string) string {
+	a := strings.Fields(old)
+	b := strings.Fields(new)
+	// Trim the common prefix and suffix, which is most of the command in
+	// practice.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var out []string
+	out = append(out, a[:prefix]...)
+	ma := a[prefix : len(a)-suffix]
+	mb := b[prefix : len(b)-suffix]
+	if (len(ma)+1)*(len(mb)+1) > maxCommandDiffCells {
+		// Too large, replace the whole middle.
+		out = appendWordDiff(out, ma, "[-", "-]")
+		out = appendWordDiff(out, mb, "{+", "+}")
+	} else {
+		out = append(out, diffWords(ma, mb)...)
+	}
+	out = append(out, a[len(a)-suffix:]...)
+	return strings.Join(out, " ")
+}
+
+// diffWords returns the words of a and b, marking the ones only in a as
+// removed and the ones only in b as added, based on their longest common
+// subsequence.
+func diffWords(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out, removed, added []string
+	flush := func() {
+		out = appendWordDiff(out, removed, "[-", "-]")
+		out = appendWordDiff(out, added, "{+", "+}")
+		removed = removed[:0]
+		added = added[:0]
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			out = append(out, a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return out
+}
+
+// appendWordDiff appends the words as a single marked group, if any.
+func appendWordDiff(out, words []string, start, end string) []string {
+	if len(words) == 0 {
+		return out
+	}
+	return append(out, start+strings.Join(words, " ")+end)
+}
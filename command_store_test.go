@@ -0,0 +1,113 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommandStore(t *testing.T) {
+	c := CommandStore{Dir: t.TempDir()}
+	if err := c.Record(HashCommand("cc -c a.c"), "cc -c a.c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lookup(HashCommand("cc -c a.c")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Record must be a no-op without Save: %v", err)
+	}
+	c.Save = true
+	for i := 0; i < 2; i++ {
+		if err := c.Record(HashCommand("cc -c a.c"), "cc -c a.c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := c.Lookup(HashCommand("cc -c a.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "cc -c a.c" {
+		t.Fatal(got)
+	}
+	if entries, err := os.ReadDir(c.Dir); err != nil || len(entries) != 1 {
+		t.Fatal(entries, err)
+	}
+}
+
+func TestCommandStore_Prune(t *testing.T) {
+	c := CommandStore{Dir: t.TempDir(), Save: true}
+	for _, cmd := range []string{"cc -c a.c", "cc -c b.c"} {
+		if err := c.Record(HashCommand(cmd), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"0123456789abcdef.tmp", "README"} {
+		if err := os.WriteFile(filepath.Join(c.Dir, name), nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := map[string]*LogEntry{"a.o": {output: "a.o", commandHash: HashCommand("cc -c a.c")}}
+	if err := c.Prune(entries); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lookup(HashCommand("cc -c a.c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lookup(HashCommand("cc -c b.c")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name())
+	}
+	want := []string{fmt.Sprintf("%016x", HashCommand("cc -c a.c")), "README"}
+	sort.Strings(want)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// A missing directory is not an error.
+	c.Dir = filepath.Join(c.Dir, "missing")
+	if err := c.Prune(entries); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandDiff(t *testing.T) {
+	data := []struct {
+		old, new, want string
+	}{
+		{"cc -c a.c", "cc -c a.c", "cc -c a.c"},
+		{"cc -O2 -c a.c", "cc -O3 -c a.c", "cc [--O2-] {+-O3+} -c a.c"},
+		{"cc -c a.c", "cc -g -Wall -c a.c", "cc {+-g -Wall+} -c a.c"},
+		{"cc -g -c a.c -o a.o", "cc -c a.c", "cc [--g-] -c a.c [--o a.o-]"},
+		{"cc  -c\ta.c", "cc -c a.c", "cc -c a.c"},
+		{"a b c", "x b y", "[-a-] {+x+} b [-c-] {+y+}"},
+	}
+	for i, l := range data {
+		if got := CommandDiff(l.old, l.new); got != l.want {
+			t.Errorf("#%d: want %q, got %q", i, l.want, got)
+		}
+	}
+}
@@ -22,6 +22,9 @@ import (
 // Debug contains debug functionality.
 var Debug struct {
 	// Explaining enables debug print of reason while a command is run.
+	//
+	// Library users should prefer DependencyScan.SetDirtyCallback or
+	// Builder.SetDirtyCallback to receive typed DirtyReason values instead.
 	Explaining bool
 	// KeepDepfile enables keeping gcc-style dependency files.
 	KeepDepfile bool
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 // Deps is the reading (startup-time) struct.
@@ -124,7 +125,9 @@ func (d *DepsLog) OpenForWrite(path string) error {
 	return nil
 }
 
-func (d *DepsLog) recordDeps(node *Node, mtime TimeStamp, nodes []*Node) error {
+// RecordDeps records the dependencies of node, assigning ids to the nodes as
+// needed.
+func (d *DepsLog) RecordDeps(node *Node, mtime TimeStamp, nodes []*Node) error {
 	nodeCount := len(nodes)
 	// Track whether there's any new data to be recorded.
 	madeChange := false
@@ -234,17 +237,56 @@ func (d *DepsLog) Close() error {
 // TODO(maruel): Make it an option so that when used as a library it doesn't
 // become a memory bloat. This is especially important when recompacting.
 func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
+	return d.LoadWithOpts(path, state, LogLoadOpts{})
+}
+
+// depsRecord is a deps record found while scanning the file. It is decoded
+// in a second pass.
+type depsRecord struct {
+	// data is the record content, excluding the size.
+	data []byte
+	// offset is the offset of the record in the file.
+	offset int64
+	// nodeCount is the number of nodes known when the record was written.
+	nodeCount int32
+	// first is the index of the first dependency in the slab.
+	first int
+}
+
+// LoadWithOpts loads a .ninja_deps with the specified options.
+//
+// The file is loaded in three passes:
+//
+// - the file is scanned serially to validate the record headers and create
+// the nodes for path records;
+//
+// - deps records are decoded, concurrently if requested, into a single slab;
+//
+// - deps records are applied in file order.
+//
+// Warning: the whole file content is kept alive, unless opts.Mmap is set.
+func (d *DepsLog) LoadWithOpts(path string, state *State, opts LogLoadOpts) (LoadStatus, error) {
 	defer metricRecord(".ninja_deps load")()
 	// Read the file all at once. The drawback is that it will fail hard on 32
 	// bits OS on large builds. This should be rare in 2022. For small builds, it
 	// will be fine (and faster).
-	data, err := ioutil.ReadFile(path)
+	var data []byte
+	var err error
+	if opts.Mmap {
+		data, err = mmapFile(path)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			return LoadNotFound, err
 		}
 		return LoadError, err
 	}
+	if opts.Mmap {
+		// Nothing references the mapping once loaded.
+		defer munmapFile(data)
+	}
 
 	// Validate header.
 	validHeader := false
@@ -268,14 +310,12 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 	}
 
 	// Skip the header.
-	// TODO(maruel): Calculate if it is faster to do "data = data[4:8]" or use
-	// "data[offset+4:offset+8]".
 	// Offset is kept to keep the last successful read, to truncate in case of
 	// failure.
 	offset := int64(len(depsLogFileSignature) + 4)
 	data = data[offset:]
-	uniqueDepRecordCount := 0
-	totalDepRecordCount := 0
+	var records []depsRecord
+	depsTotal := 0
 	for len(data) != 0 {
 		// A minimal record is size (4 bytes) plus one of:
 		// - content (>=4 + checksum(4)); CanonicalizePath() rejects empty paths.
@@ -310,26 +350,14 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 				err = errors.New("record deps id is out of bounds")
 				break
 			}
-			mtime := TimeStamp(binary.LittleEndian.Uint64(data[4:12]))
-			depsCount := int(size-12) / 4
-
-			// TODO(maruel): Redesign to reduce bound checks.
-			deps := NewDeps(mtime, depsCount)
-			x := 12
-			for i := 0; i < depsCount; i++ {
-				v := binary.LittleEndian.Uint32(data[x : x+4])
-				if int(v) >= len(d.Nodes) || d.Nodes[v] == nil {
-					err = errors.New("record deps node id is out of bounds")
-					break
-				}
-				deps.Nodes[i] = d.Nodes[v]
-				x += 4
-			}
-
-			totalDepRecordCount++
-			if !d.updateDeps(outID, deps) {
-				uniqueDepRecordCount++
-			}
+			// Decoding is deferred to the second pass.
+			records = append(records, depsRecord{
+				data:      data[:size],
+				offset:    offset,
+				nodeCount: int32(len(d.Nodes)),
+				first:     depsTotal,
+			})
+			depsTotal += int(size-12) / 4
 		} else {
 			pathSize := size - 4
 			// There can be up to 3 bytes of padding.
@@ -343,13 +371,14 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 				}
 			}
 
-			// TODO(maruel): We need to differentiate if we are using the GC or not.
-			// When the GC is disabled, #YOLO, the buffer will never go away anyway
-			// so better to leverage it!
-			subpath := unsafeString(data[:pathSize])
-			// Here we make a copy, because we do not want to keep a reference to the
-			// read buffer.
-			// subpath := string(data[:pathSize])
+			// The read buffer is kept alive by the strings referencing it. A
+			// mapping is released at the end of the load, so make a copy.
+			var subpath string
+			if opts.Mmap {
+				subpath = string(data[:pathSize])
+			} else {
+				subpath = unsafeString(data[:pathSize])
+			}
 
 			// It is not necessary to pass in a correct slashBits here. It will
 			// either be a Node that's in the manifest (in which case it will already
@@ -381,6 +410,61 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 		offset += int64(size) + 4
 	}
 
+	// Decode the deps records. Each record is only validated against the nodes
+	// that were known at the time it was written.
+	deps := make([]Deps, len(records))
+	nodes := make([]*Node, depsTotal)
+	failed := len(records)
+	chunks := opts.Concurrency
+	if chunks < 1 || len(records) < 1024 {
+		chunks = 1
+	}
+	if chunks == 1 {
+		failed = d.decodeDeps(records, deps, nodes)
+	} else {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		step := (len(records) + chunks - 1) / chunks
+		for start := 0; start < len(records); start += step {
+			end := start + step
+			if end > len(records) {
+				end = len(records)
+			}
+			wg.Add(1)
+			go func(start, end int) {
+				defer wg.Done()
+				if i := start + d.decodeDeps(records[start:end], deps[start:end], nodes); i < end {
+					mu.Lock()
+					if i < failed {
+						failed = i
+					}
+					mu.Unlock()
+				}
+			}(start, end)
+		}
+		wg.Wait()
+	}
+	if failed < len(records) {
+		// Forget about the nodes that were created after the invalid record.
+		r := &records[failed]
+		for _, n := range d.Nodes[r.nodeCount:] {
+			n.ID = -1
+		}
+		d.Nodes = d.Nodes[:r.nodeCount]
+		offset = r.offset
+		err = errors.New("record deps node id is out of bounds")
+	}
+
+	// Apply the deps records in order, so that the latter one wins.
+	uniqueDepRecordCount := 0
+	totalDepRecordCount := 0
+	for i := 0; i < failed; i++ {
+		totalDepRecordCount++
+		if !d.updateDeps(int32(binary.LittleEndian.Uint32(records[i].data[:4])), &deps[i]) {
+			uniqueDepRecordCount++
+		}
+	}
+
 	if err != nil {
 		// An error occurred while loading; try to recover by truncating the
 		// file to the last fully-read record.
@@ -403,6 +487,28 @@ func (d *DepsLog) Load(path string, state *State) (LoadStatus, error) {
 	return LoadSuccess, nil
 }
 
+// decodeDeps decodes the deps records into deps, using nodes as the slab for
+// Deps.Nodes.
+//
+// Returns the index of the first invalid record, or len(records).
+func (d *DepsLog) decodeDeps(records []depsRecord, deps []Deps, nodes []*Node) int {
+	for i := range records {
+		r := &records[i]
+		depsCount := (len(r.data) - 12) / 4
+		out := nodes[r.first : r.first+depsCount : r.first+depsCount]
+		for j, x := 0, 12; j < depsCount; j, x = j+1, x+4 {
+			v := binary.LittleEndian.Uint32(r.data[x : x+4])
+			if v >= uint32(r.nodeCount) {
+				return i
+			}
+			out[j] = d.Nodes[v]
+		}
+		deps[i].MTime = TimeStamp(binary.LittleEndian.Uint64(r.data[4:12]))
+		deps[i].Nodes = out
+	}
+	return len(records)
+}
+
 // GetDeps returns the Deps for this node ID.
 //
 // Silently ignore invalid node ID.
@@ -471,7 +577,7 @@ func (d *DepsLog) Recompact(path string) error {
 			continue
 		}
 
-		if err := newLog.recordDeps(d.Nodes[oldID], deps.MTime, deps.Nodes); err != nil {
+		if err := newLog.RecordDeps(d.Nodes[oldID], deps.MTime, deps.Nodes); err != nil {
 			_ = newLog.Close()
 			return err
 		}
@@ -15,6 +15,7 @@
 package nin
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -34,14 +35,14 @@ func TestDepsLogTest_WriteRead(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state1.GetNode("foo.h", 0))
 		deps = append(deps, state1.GetNode("bar.h", 0))
-		if err := log1.recordDeps(state1.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log1.RecordDeps(state1.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
 		deps = nil
 		deps = append(deps, state1.GetNode("foo.h", 0))
 		deps = append(deps, state1.GetNode("bar2.h", 0))
-		if err := log1.recordDeps(state1.GetNode("out2.o", 0), 2, deps); err != nil {
+		if err := log1.RecordDeps(state1.GetNode("out2.o", 0), 2, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -122,7 +123,7 @@ func TestDepsLogTest_LotsOfDeps(t *testing.T) {
 			buf := fmt.Sprintf("file%d.h", i)
 			deps = append(deps, state1.GetNode(buf, 0))
 		}
-		if err := log1.recordDeps(state1.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log1.RecordDeps(state1.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -171,7 +172,7 @@ func TestDepsLogTest_DoubleEntry(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 		if err := log.Close(); err != nil {
@@ -199,7 +200,7 @@ func TestDepsLogTest_DoubleEntry(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 		if err := log.Close(); err != nil {
@@ -230,14 +231,14 @@ func TestDepsLogTest_Recompact(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
 		deps = nil
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("baz.h", 0))
-		if err := log.recordDeps(state.GetNode("other_out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("other_out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -267,7 +268,7 @@ func TestDepsLogTest_Recompact(t *testing.T) {
 
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 		if err := log.Close(); err != nil {
@@ -493,14 +494,14 @@ func TestDepsLogTest_Truncated(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
 		deps = nil
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar2.h", 0))
-		if err := log.recordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -574,14 +575,14 @@ func TestDepsLogTest_TruncatedRecovery(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar.h", 0))
-		if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 			t.Fatal(err)
 		}
 
 		deps = nil
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar2.h", 0))
-		if err := log.recordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -625,7 +626,7 @@ func TestDepsLogTest_TruncatedRecovery(t *testing.T) {
 		var deps []*Node
 		deps = append(deps, state.GetNode("foo.h", 0))
 		deps = append(deps, state.GetNode("bar2.h", 0))
-		if err := log.recordDeps(state.GetNode("out2.o", 0), 3, deps); err != nil {
+		if err := log.RecordDeps(state.GetNode("out2.o", 0), 3, deps); err != nil {
 			t.Fatal(err)
 		}
 
@@ -651,6 +652,146 @@ func TestDepsLogTest_TruncatedRecovery(t *testing.T) {
 	}
 }
 
+func TestDepsLogTest_LoadWithOpts(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	{
+		state := NewState()
+		log := DepsLog{}
+		if err := log.OpenForWrite(testFilename); err != nil {
+			t.Fatal(err)
+		}
+		// Enough records to be decoded concurrently.
+		for i := 0; i < 3000; i++ {
+			deps := []*Node{
+				state.GetNode(fmt.Sprintf("foo%d.h", i%100), 0),
+				state.GetNode(fmt.Sprintf("bar%d.h", i), 0),
+			}
+			if err := log.RecordDeps(state.GetNode(fmt.Sprintf("out%d.o", i%2000), 0), TimeStamp(i), deps); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, opts := range []LogLoadOpts{{}, {Mmap: true}, {Concurrency: 4}, {Mmap: true, Concurrency: 4}} {
+		state := NewState()
+		log := DepsLog{}
+		if s, err := log.LoadWithOpts(testFilename, &state, opts); s != LoadSuccess || err != nil {
+			t.Fatal(s, err)
+		}
+		if len(log.Nodes) != 5100 {
+			t.Fatal(opts, len(log.Nodes))
+		}
+		deps := log.GetDeps(state.GetNode("out1.o", 0))
+		if deps == nil || deps.MTime != 2001 || len(deps.Nodes) != 2 {
+			t.Fatal(opts, deps)
+		}
+		if deps.Nodes[0].Path != "foo1.h" || deps.Nodes[1].Path != "bar2001.h" {
+			t.Fatal(opts, deps.Nodes[0].Path, deps.Nodes[1].Path)
+		}
+	}
+}
+
+// writeDepsLogInvalidID writes a deps log with 2000 valid deps records,
+// followed by a deps record referencing a node id that is not yet known and
+// the path record that would define it.
+//
+// Returns the size of the valid part of the file.
+func writeDepsLogInvalidID(t *testing.T, testFilename string) int {
+	{
+		state := NewState()
+		log := DepsLog{}
+		if err := log.OpenForWrite(testFilename); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			deps := []*Node{state.GetNode(fmt.Sprintf("in%d.h", i), 0)}
+			if err := log.RecordDeps(state.GetNode(fmt.Sprintf("out%d.o", i), 0), 1, deps); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileSize := getFileSize(t, testFilename)
+
+	f, err := os.OpenFile(testFilename, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 36)
+	binary.LittleEndian.PutUint32(b[0:], 0x80000000|16)
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	binary.LittleEndian.PutUint64(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[16:], 4000)
+	binary.LittleEndian.PutUint32(b[20:], 12)
+	copy(b[24:], "new.h")
+	binary.LittleEndian.PutUint32(b[32:], ^uint32(4000))
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fileSize
+}
+
+func TestDepsLogTest_LoadWithOptsInvalidID(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	fileSize := writeDepsLogInvalidID(t, testFilename)
+
+	state := NewState()
+	log := DepsLog{}
+	s, err := log.LoadWithOpts(testFilename, &state, LogLoadOpts{Concurrency: 4})
+	if s != LoadSuccess || err == nil || err.Error() != "record deps node id is out of bounds; recovering" {
+		t.Fatal(s, err)
+	}
+	if len(log.Nodes) != 4000 {
+		t.Fatal(len(log.Nodes))
+	}
+	if n := state.Paths["new.h"]; n != nil && n.ID != -1 {
+		t.Fatal(n.ID)
+	}
+	if deps := log.GetDeps(state.GetNode("out0.o", 0)); deps == nil || deps.MTime != 1 {
+		t.Fatal(deps)
+	}
+	if f2 := getFileSize(t, testFilename); f2 != fileSize {
+		t.Fatal(f2, fileSize)
+	}
+}
+
+// The file is truncated on recovery; the nodes created from the discarded
+// records must not reference the mapping.
+func TestDepsLogTest_LoadWithOptsInvalidIDMmap(t *testing.T) {
+	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
+	fileSize := writeDepsLogInvalidID(t, testFilename)
+
+	state := NewState()
+	log := DepsLog{}
+	s, err := log.LoadWithOpts(testFilename, &state, LogLoadOpts{Mmap: true})
+	if s != LoadSuccess || err == nil || err.Error() != "record deps node id is out of bounds; recovering" {
+		t.Fatal(s, err)
+	}
+	if f2 := getFileSize(t, testFilename); f2 != fileSize {
+		t.Fatal(f2, fileSize)
+	}
+	n := state.Paths["new.h"]
+	if n == nil || n.Path != "new.h" || n.ID != -1 {
+		t.Fatal(n)
+	}
+	for p, n := range state.Paths {
+		if p != n.Path {
+			t.Fatalf("%q != %q", p, n.Path)
+		}
+	}
+	if len(state.Paths) != 4001 {
+		t.Fatal(len(state.Paths))
+	}
+}
+
 func TestDepsLogTest_ReverseDepsNodes(t *testing.T) {
 	testFilename := filepath.Join(t.TempDir(), "DepsLogTest-tempfile")
 	state := NewState()
@@ -662,14 +803,14 @@ func TestDepsLogTest_ReverseDepsNodes(t *testing.T) {
 	var deps []*Node
 	deps = append(deps, state.GetNode("foo.h", 0))
 	deps = append(deps, state.GetNode("bar.h", 0))
-	if err := log.recordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
+	if err := log.RecordDeps(state.GetNode("out.o", 0), 1, deps); err != nil {
 		t.Fatal(err)
 	}
 
 	deps = nil
 	deps = append(deps, state.GetNode("foo.h", 0))
 	deps = append(deps, state.GetNode("bar2.h", 0))
-	if err := log.recordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
+	if err := log.RecordDeps(state.GetNode("out2.o", 0), 2, deps); err != nil {
 		t.Fatal(err)
 	}
 
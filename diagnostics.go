@@ -0,0 +1,98 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is an error or a warning printed by a compiler.
+type Diagnostic struct {
+	// Path is the file the diagnostic is about, relative to the build directory
+	// unless absolute.
+	Path string
+	// Line and Column are 1-based. Column is 0 when not printed.
+	Line   int
+	Column int
+	// Severity is "error", "fatal error", "warning", "note" or "remark".
+	Severity string
+	// Code is the MSVC diagnostic code, e.g. "C4996".
+	Code    string
+	Message string
+}
+
+// gccDiagnostic matches GCC and Clang diagnostics, e.g.
+// "foo.cc:12:3: error: message".
+var gccDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note|remark): (.*)$`)
+
+// msvcDiagnostic matches MSVC diagnostics, e.g.
+// "foo.cc(12,3): error C2065: message".
+var msvcDiagnostic = regexp.MustCompile(`^(.+?)\((\d+)(?:,(\d+))?\) ?: (fatal error|error|warning|note) ?([A-Z]+\d+)?: (.*)$`)
+
+// ParseDiagnostics returns the GCC, Clang and MSVC style diagnostics found in
+// the output of a command. The paths are as printed, i.e. relative to the
+// directory the command was run in.
+func ParseDiagnostics(output string) []Diagnostic {
+	var out []Diagnostic
+	for _, l := range strings.Split(StripAnsiEscapeCodes(output), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if m := gccDiagnostic.FindStringSubmatch(l); m != nil {
+			out = append(out, newDiagnostic(m[1], m[2], m[3], m[4], "", m[5]))
+		} else if m := msvcDiagnostic.FindStringSubmatch(l); m != nil {
+			out = append(out, newDiagnostic(m[1], m[2], m[3], m[4], m[5], m[6]))
+		}
+	}
+	return out
+}
+
+func newDiagnostic(path, line, column, severity, code, message string) Diagnostic {
+	d := Diagnostic{Path: strings.TrimSpace(path), Severity: severity, Code: code, Message: message}
+	d.Line, _ = strconv.Atoi(line)
+	d.Column, _ = strconv.Atoi(column)
+	return d
+}
+
+// EdgeDiagnostics returns the diagnostics in the output of the edge's command,
+// with the paths relative to the build directory.
+func EdgeDiagnostics(edge *Edge, output string) []Diagnostic {
+	diags := ParseDiagnostics(output)
+	for i := range diags {
+		diags[i].Path = CanonicalizePath(edge.ResolveCwdPath(diags[i].Path))
+	}
+	return diags
+}
+
+// DiagnosticSet deduplicates the diagnostics, since a warning in a header is
+// usually printed by all the commands compiling a file including it.
+type DiagnosticSet struct {
+	seen map[Diagnostic]struct{}
+}
+
+// Add returns the diagnostics not seen before.
+func (d *DiagnosticSet) Add(diags []Diagnostic) []Diagnostic {
+	if d.seen == nil {
+		d.seen = map[Diagnostic]struct{}{}
+	}
+	var out []Diagnostic
+	for _, diag := range diags {
+		if _, ok := d.seen[diag]; !ok {
+			d.seen[diag] = struct{}{}
+			out = append(out, diag)
+		}
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	output := "In file included from foo.cc:1:\n" +
+		"foo.h:3:10: warning: unused variable 'x' [-Wunused-variable]\n" +
+		"\x1B[1mfoo.cc:12:3: \x1B[0;1;31merror: \x1B[0m\x1B[1muse of undeclared identifier 'y'\x1B[0m\n" +
+		"    y = 1;\n" +
+		"foo.cc:20: note: declared here\r\n" +
+		"C:\\src\\bar.cc(7,5): error C2065: 'z': undeclared identifier\r\n" +
+		"bar.h(2): warning C4996: 'strcpy': This function may be unsafe.\n" +
+		"ld: error: undefined symbol: main\n" +
+		"1 warning and 1 error generated.\n"
+	want := []Diagnostic{
+		{Path: "foo.h", Line: 3, Column: 10, Severity: "warning", Message: "unused variable 'x' [-Wunused-variable]"},
+		{Path: "foo.cc", Line: 12, Column: 3, Severity: "error", Message: "use of undeclared identifier 'y'"},
+		{Path: "foo.cc", Line: 20, Severity: "note", Message: "declared here"},
+		{Path: "C:\\src\\bar.cc", Line: 7, Column: 5, Severity: "error", Code: "C2065", Message: "'z': undeclared identifier"},
+		{Path: "bar.h", Line: 2, Severity: "warning", Code: "C4996", Message: "'strcpy': This function may be unsafe."},
+	}
+	if diff := cmp.Diff(want, ParseDiagnostics(output)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestEdgeDiagnostics(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "build out/a.o: cat a.c\n  cwd = out\nbuild b.o: cat b.c\n", ParseManifestOpts{})
+	warning := "../inc/a.h:1:1: warning: oops\n"
+	var set DiagnosticSet
+	got := set.Add(EdgeDiagnostics(g.state.Paths["out/a.o"].InEdge, warning))
+	want := []Diagnostic{{Path: "inc/a.h", Line: 1, Column: 1, Severity: "warning", Message: "oops"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+	// The same warning printed by another edge is deduplicated.
+	if got := set.Add(EdgeDiagnostics(g.GetNode("b.o").InEdge, "inc/a.h:1:1: warning: oops\n")); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "fmt"
+
+// DirtyReasonKind is the kind of a DirtyReason.
+type DirtyReasonKind int32
+
+// Valid DirtyReasonKind values.
+const (
+	// DirtySourceMissing is a node without an in-edge that doesn't exist.
+	DirtySourceMissing DirtyReasonKind = iota
+	// DirtyInputDirty is a regular input of the edge that is dirty.
+	DirtyInputDirty
+	// DirtyPhonyOutputMissing is a missing output of a phony edge with no
+	// inputs.
+	DirtyPhonyOutputMissing
+	// DirtyOutputMissing is a missing output.
+	DirtyOutputMissing
+	// DirtyOutputOlder is an output older than the most recent input. When
+	// Restat is set, the mtime comes from the build log.
+	DirtyOutputOlder
+	// DirtyCommandChanged is a command that differs from the one recorded in
+	// the build log.
+	DirtyCommandChanged
+	// DirtyLogMtimeOlder is an mtime recorded in the build log older than the
+	// most recent input.
+	DirtyLogMtimeOlder
+	// DirtyLogEntryMissing is an output not found in the build log.
+	DirtyLogEntryMissing
+	// DirtyDepfileMissing is a depfile that is missing.
+	DirtyDepfileMissing
+	// DirtyDepfileMismatch is a depfile that doesn't mention the first output.
+	DirtyDepfileMismatch
+	// DirtyDepsMissing is an output without deps in the deps log.
+	DirtyDepsMissing
+	// DirtyDepsStale is an output newer than its deps log entry.
+	DirtyDepsStale
+	// DirtyDyndepPending is a dyndep file that is not ready yet. It doesn't
+	// make the edge dirty per se but its outputs are not ready.
+	DirtyDyndepPending
+)
+
+var dirtyReasonKindNames = [...]string{
+	"source_missing",
+	"input_dirty",
+	"phony_output_missing",
+	"output_missing",
+	"output_older",
+	"command_changed",
+	"log_mtime_older",
+	"log_entry_missing",
+	"depfile_missing",
+	"depfile_mismatch",
+	"deps_missing",
+	"deps_stale",
+	"dyndep_pending",
+}
+
+func (d DirtyReasonKind) String() string {
+	if d < 0 || int(d) >= len(dirtyReasonKindNames) {
+		return fmt.Sprintf("DirtyReasonKind(%d)", d)
+	}
+	return dirtyReasonKindNames[d]
+}
+
+// DirtyReason is a reason found by DependencyScan why a node is dirty.
+//
+// Only the fields relevant to Kind are set.
+type DirtyReason struct {
+	Kind DirtyReasonKind
+	// Edge is the edge that needs to run. It is nil for DirtySourceMissing.
+	Edge *Edge
+	// Node is the node the reason is about: the missing source, the output or
+	// the dyndep file.
+	Node *Node
+	// Input is the dirty input or the most recent input.
+	Input *Node
+	// Path is the depfile path.
+	Path string
+	// Got is the first output mentioned in the depfile.
+	Got string
+	// MTime is the output mtime, the mtime in the build log or the mtime in the
+	// deps log.
+	MTime TimeStamp
+	// InputMTime is the mtime of Input or, for DirtyDepsStale, of the output.
+	InputMTime TimeStamp
+	// Restat is set when MTime comes from the build log due to restat.
+	Restat bool
+	// OldHash is the command hash recorded in the build log and NewHash is the
+	// hash of the current command.
+	OldHash uint64
+	NewHash uint64
+	// OldCommand and NewCommand are the previous and current commands, as
+	// returned by Edge.EvaluateCommandWithoutEnv(), when the previous one was
+	// found in the CommandStore.
+	OldCommand string
+	NewCommand string
+}
+
+// String returns the same message as "-d explain".
+func (d *DirtyReason) String() string {
+	switch d.Kind {
+	case DirtySourceMissing:
+		return fmt.Sprintf("%s has no in-edge and is missing", d.Node.Path)
+	case DirtyInputDirty:
+		return fmt.Sprintf("%s is dirty", d.Input.Path)
+	case DirtyPhonyOutputMissing:
+		return fmt.Sprintf("output %s of phony edge with no inputs doesn't exist", d.Node.Path)
+	case DirtyOutputMissing:
+		return fmt.Sprintf("output %s doesn't exist", d.Node.Path)
+	case DirtyOutputOlder:
+		s := ""
+		if d.Restat {
+			s = "restat of "
+		}
+		return fmt.Sprintf("%soutput %s older than most recent input %s (%x vs %x)", s, d.Node.Path, d.Input.Path, d.MTime, d.InputMTime)
+	case DirtyCommandChanged:
+		if d.OldCommand != "" && d.OldCommand == d.NewCommand {
+			return fmt.Sprintf("environment changed for %s", d.Node.Path)
+		}
+		if d.OldCommand != "" {
+			return fmt.Sprintf("command line changed for %s: %s", d.Node.Path, CommandDiff(d.OldCommand, d.NewCommand))
+		}
+		return fmt.Sprintf("command line changed for %s", d.Node.Path)
+	case DirtyLogMtimeOlder:
+		return fmt.Sprintf("recorded mtime of %s older than most recent input %s (%x vs %x)", d.Node.Path, d.Input.Path, d.MTime, d.InputMTime)
+	case DirtyLogEntryMissing:
+		return fmt.Sprintf("command line not found in log for %s", d.Node.Path)
+	case DirtyDepfileMissing:
+		// TODO(maruel): Use %q for real quoting.
+		return fmt.Sprintf("depfile '%s' is missing", d.Path)
+	case DirtyDepfileMismatch:
+		return fmt.Sprintf("expected depfile '%s' to mention '%s', got '%s'", d.Path, d.Node.Path, d.Got)
+	case DirtyDepsMissing:
+		return fmt.Sprintf("deps for '%s' are missing", d.Node.Path)
+	case DirtyDepsStale:
+		return fmt.Sprintf("stored deps info out of date for '%s' (%x vs %x)", d.Node.Path, d.MTime, d.InputMTime)
+	case DirtyDyndepPending:
+		return fmt.Sprintf("dyndep file '%s' is not ready", d.Node.Path)
+	default:
+		return d.Kind.String()
+	}
+}
@@ -25,6 +25,10 @@ type Dyndeps struct {
 	restat          bool
 	implicitInputs  []*Node
 	implicitOutputs []*Node
+
+	// late is set when the information is for an edge whose own dyndep file
+	// was loaded earlier, i.e. a module it requires is provided by this file.
+	late bool
 }
 
 func (d *Dyndeps) String() string {
@@ -101,6 +105,16 @@ func (d *DyndepLoader) LoadDyndeps(node *Node, ddf DyndepFile) error {
 		}
 	}
 
+	// Add the modules required by the edges of the files loaded earlier.
+	for edge, oe := range ddf {
+		if oe.late && !oe.used {
+			oe.used = true
+			if err := d.updateEdge(edge, oe); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Reject extra outputs in dyndep file.
 	for edge, oe := range ddf {
 		if !oe.used {
@@ -158,5 +172,8 @@ func (d *DyndepLoader) loadDyndepFile(file *Node, ddf DyndepFile) error {
 	if err != nil {
 		return fmt.Errorf("loading '%s': %w", file.Path, err)
 	}
+	if isP1689(contents) {
+		return ParseDyndepP1689(d.state, ddf, file.Path, contents)
+	}
 	return ParseDyndep(d.state, ddf, file.Path, contents)
 }
@@ -0,0 +1,193 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// p1689 is a P1689 module dependency file, as emitted by
+// "clang-scan-deps -format=p1689" and "gcc -fdeps-format=p1689r5".
+//
+// See https://wg21.link/p1689r5.
+type p1689 struct {
+	Version  int         `json:"version"`
+	Revision int         `json:"revision"`
+	Rules    []p1689Rule `json:"rules"`
+}
+
+type p1689Rule struct {
+	PrimaryOutput string        `json:"primary-output"`
+	Outputs       []string      `json:"outputs"`
+	Provides      []p1689Module `json:"provides"`
+	Requires      []p1689Module `json:"requires"`
+}
+
+type p1689Module struct {
+	LogicalName string `json:"logical-name"`
+	// CompiledModulePath is the BMI file. It is optional.
+	CompiledModulePath string `json:"compiled-module-path"`
+	SourcePath         string `json:"source-path"`
+}
+
+// p1689Modules indexes the modules provided by the P1689 files loaded so far,
+// since each translation unit usually has its own file.
+type p1689Modules struct {
+	// bmis maps the logical name of a module to its compiled module path.
+	bmis map[string]string
+	// waiting are the edges requiring a module that wasn't provided yet by
+	// the time their file was loaded.
+	waiting map[string][]*Edge
+}
+
+// isP1689 returns true if the dyndep file content looks like P1689 JSON
+// instead of the ninja dyndep format.
+func isP1689(input []byte) bool {
+	input = bytes.TrimLeft(input, " \t\r\n")
+	return len(input) != 0 && input[0] == '{'
+}
+
+// ParseDyndepP1689 parses a P1689 module dependency file as dyndep
+// information.
+//
+// Each rule's primary output must be built by an edge with the file as its
+// dyndep binding. The compiled module paths of the modules it provides and its
+// other outputs become implicit outputs of the edge, and the compiled module
+// paths of the modules it requires become implicit inputs.
+//
+// A required module without a compiled module path is looked up in the
+// modules provided by this file and the P1689 files loaded before it. If it
+// is not found and the edge depends on a dyndep file not loaded yet, the
+// module is resolved when a file providing it is loaded; dyndepFile then also
+// contains the edges waiting for it. Otherwise it is an error. So an edge
+// importing a module must depend on the P1689 file of the module's provider.
+func ParseDyndepP1689(state *State, dyndepFile DyndepFile, filename string, input []byte) error {
+	// Strip the terminating 0 byte added by ReadFile().
+	input = bytes.TrimRight(input, "\x00")
+	var p p1689
+	if err := json.Unmarshal(input, &p); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if p.Version != 1 {
+		return fmt.Errorf("%s: unsupported P1689 version %d", filename, p.Version)
+	}
+
+	// Index the BMIs of the modules provided in this file.
+	modules := &state.modules
+	if modules.bmis == nil {
+		modules.bmis = map[string]string{}
+	}
+	for _, r := range p.Rules {
+		for _, m := range r.Provides {
+			if m.CompiledModulePath != "" {
+				modules.bmis[m.LogicalName] = m.CompiledModulePath
+			}
+		}
+	}
+
+	for _, r := range p.Rules {
+		if r.PrimaryOutput == "" {
+			return fmt.Errorf("%s: rule without primary-output", filename)
+		}
+		path := CanonicalizePath(r.PrimaryOutput)
+		node := state.Paths[path]
+		if node == nil || node.InEdge == nil {
+			// TODO(maruel): Use %q for real quoting.
+			return fmt.Errorf("%s: no build statement exists for '%s'", filename, path)
+		}
+		edge := node.InEdge
+		if _, ok := dyndepFile[edge]; ok {
+			// TODO(maruel): Use %q for real quoting.
+			return fmt.Errorf("%s: multiple statements for '%s'", filename, path)
+		}
+		dyndeps := &Dyndeps{}
+		dyndepFile[edge] = dyndeps
+
+		seen := map[*Node]struct{}{}
+		for _, o := range edge.Outputs {
+			seen[o] = struct{}{}
+		}
+		addOutput := func(p string) {
+			n := state.GetNode(CanonicalizePathBits(p))
+			if _, ok := seen[n]; !ok {
+				seen[n] = struct{}{}
+				dyndeps.implicitOutputs = append(dyndeps.implicitOutputs, n)
+			}
+		}
+		for _, o := range r.Outputs {
+			addOutput(o)
+		}
+		for _, m := range r.Provides {
+			if m.CompiledModulePath != "" {
+				addOutput(m.CompiledModulePath)
+			}
+		}
+
+		for _, m := range r.Requires {
+			bmi := m.CompiledModulePath
+			if bmi == "" {
+				if bmi = modules.bmis[m.LogicalName]; bmi == "" {
+					if !hasPendingDyndep(edge) {
+						// TODO(maruel): Use %q for real quoting.
+						return fmt.Errorf("%s: module '%s' required by '%s' is not provided", filename, m.LogicalName, path)
+					}
+					if modules.waiting == nil {
+						modules.waiting = map[string][]*Edge{}
+					}
+					modules.waiting[m.LogicalName] = append(modules.waiting[m.LogicalName], edge)
+					continue
+				}
+			}
+			n := state.GetNode(CanonicalizePathBits(bmi))
+			if _, ok := seen[n]; !ok {
+				seen[n] = struct{}{}
+				dyndeps.implicitInputs = append(dyndeps.implicitInputs, n)
+			}
+		}
+	}
+
+	// Resolve the modules now provided for the edges of the files loaded
+	// earlier.
+	for name, edges := range modules.waiting {
+		bmi := modules.bmis[name]
+		if bmi == "" {
+			continue
+		}
+		delete(modules.waiting, name)
+		n := state.GetNode(CanonicalizePathBits(bmi))
+		for _, edge := range edges {
+			dyndeps := dyndepFile[edge]
+			if dyndeps == nil {
+				dyndeps = &Dyndeps{late: true}
+				dyndepFile[edge] = dyndeps
+			}
+			dyndeps.implicitInputs = append(dyndeps.implicitInputs, n)
+		}
+	}
+	return nil
+}
+
+// hasPendingDyndep returns true if one of the inputs of the edge is a dyndep
+// file not loaded yet.
+func hasPendingDyndep(edge *Edge) bool {
+	for _, i := range edge.Inputs {
+		if i.DyndepPending {
+			return true
+		}
+	}
+	return false
+}
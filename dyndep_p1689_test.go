@@ -0,0 +1,170 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDyndepP1689(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule cxx\n  command = unused\nbuild a.o: cxx a.cppm || a.ddi\n  dyndep = a.ddi\nbuild b.o: cxx b.cpp || a.ddi\n  dyndep = a.ddi\n", ParseManifestOpts{})
+	g.fs.Create("a.ddi", `{
+  "version": 1,
+  "revision": 0,
+  "rules": [
+    {
+      "primary-output": "a.o",
+      "provides": [{"logical-name": "a", "compiled-module-path": "a.pcm", "source-path": "a.cppm"}],
+      "requires": [{"logical-name": "std", "compiled-module-path": "std.pcm"}]
+    },
+    {
+      "primary-output": "b.o",
+      "outputs": ["b.o", "b.extra"],
+      "requires": [{"logical-name": "a"}]
+    }
+  ]
+}
+`)
+	if err := g.scan.LoadDyndeps(g.GetNode("a.ddi"), DyndepFile{}); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(nodes []*Node) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Path)
+		}
+		return out
+	}
+	a := g.GetNode("a.o").InEdge
+	if diff := cmp.Diff([]string{"a.o", "a.pcm"}, paths(a.Outputs)); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"a.cppm", "std.pcm", "a.ddi"}, paths(a.Inputs)); diff != "" {
+		t.Fatal(diff)
+	}
+	b := g.GetNode("b.o").InEdge
+	if diff := cmp.Diff([]string{"b.o", "b.extra"}, paths(b.Outputs)); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"b.cpp", "a.pcm", "a.ddi"}, paths(b.Inputs)); diff != "" {
+		t.Fatal(diff)
+	}
+	if b.ImplicitDeps != 1 || b.ImplicitOuts != 1 {
+		t.Fatal(b.ImplicitDeps, b.ImplicitOuts)
+	}
+	// b.o now depends on a.o through a.pcm.
+	if g.GetNode("a.pcm").InEdge != a {
+		t.Fatal("expected a.pcm to be built by a.o's edge")
+	}
+}
+
+func TestDyndepP1689_Errors(t *testing.T) {
+	data := []struct {
+		input string
+		want  string
+	}{
+		{
+			`{"version": 2, "rules": []}`,
+			"dd: unsupported P1689 version 2",
+		},
+		{
+			`{"version": 1, "rules": [{"primary-output": "other"}]}`,
+			"dd: no build statement exists for 'other'",
+		},
+		{
+			`{"version": 1, "rules": [{"primary-output": "out", "requires": [{"logical-name": "m"}]}]}`,
+			"dd: module 'm' required by 'out' is not provided",
+		},
+		{
+			`{"version": 1, "rules": [{"primary-output": "out"}, {"primary-output": "out"}]}`,
+			"dd: multiple statements for 'out'",
+		},
+	}
+	for i, l := range data {
+		g := NewGraphTest(t)
+		g.AssertParse(&g.state, "rule r\n  command = unused\nbuild out: r || dd\n  dyndep = dd\n", ParseManifestOpts{})
+		g.fs.Create("dd", l.input)
+		err := g.scan.LoadDyndeps(g.GetNode("dd"), DyndepFile{})
+		if err == nil || err.Error() != l.want {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
+
+// Each translation unit has its own P1689 file, as emitted by
+// clang-scan-deps.
+const (
+	p1689ProvidesA = `{"version": 1, "rules": [{"primary-output": "a.o", "provides": [{"logical-name": "a", "compiled-module-path": "a.pcm"}]}]}`
+	p1689RequiresA = `{"version": 1, "rules": [{"primary-output": "b.o", "requires": [{"logical-name": "a"}]}]}`
+)
+
+func TestDyndepP1689_SeparateFiles(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule cxx\n  command = unused\nbuild a.o: cxx a.cppm || a.ddi\n  dyndep = a.ddi\nbuild b.o: cxx b.cpp || b.ddi a.ddi\n  dyndep = b.ddi\n", ParseManifestOpts{})
+	g.fs.Create("a.ddi", p1689ProvidesA)
+	g.fs.Create("b.ddi", p1689RequiresA)
+
+	// a.ddi is loaded before b.ddi since b.o depends on it.
+	if _, err := g.scan.RecomputeDirty(g.GetNode("b.o")); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range g.GetNode("b.o").InEdge.Inputs {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"b.cpp", "a.pcm", "b.ddi", "a.ddi"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if g.GetNode("a.pcm").InEdge != g.GetNode("a.o").InEdge {
+		t.Fatal("expected a.pcm to be built by a.o's edge")
+	}
+}
+
+func TestDyndepP1689_SeparateFilesLate(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule cxx\n  command = unused\nbuild a.o: cxx a.cppm || a.ddi\n  dyndep = a.ddi\nbuild b.o: cxx b.cpp || b.ddi a.ddi\n  dyndep = b.ddi\n", ParseManifestOpts{})
+	g.fs.Create("a.ddi", p1689ProvidesA)
+	g.fs.Create("b.ddi", p1689RequiresA)
+
+	// The module is not known yet, but a.ddi may provide it.
+	if err := g.scan.LoadDyndeps(g.GetNode("b.ddi"), DyndepFile{}); err != nil {
+		t.Fatal(err)
+	}
+	b := g.GetNode("b.o").InEdge
+	if b.ImplicitDeps != 0 {
+		t.Fatal(b.ImplicitDeps)
+	}
+	ddf := DyndepFile{}
+	if err := g.scan.LoadDyndeps(g.GetNode("a.ddi"), ddf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ddf[b]; !ok {
+		t.Fatal("expected b.o to be updated")
+	}
+	var got []string
+	for _, n := range b.Inputs {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"b.cpp", "a.pcm", "b.ddi", "a.ddi"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if b.ImplicitDeps != 1 {
+		t.Fatal(b.ImplicitDeps)
+	}
+}
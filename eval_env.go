@@ -141,7 +141,9 @@ func IsReservedBinding(v string) bool {
 		v == "restat" ||
 		v == "rspfile" ||
 		v == "rspfile_content" ||
-		v == "msvc_deps_prefix"
+		v == "msvc_deps_prefix" ||
+		isEnvBinding(v) ||
+		isCwdBinding(v)
 }
 
 // Rule is an invocable build command and associated metadata (description,
@@ -184,15 +186,24 @@ type BindingEnv struct {
 	Bindings map[string]string
 	Rules    map[string]*Rule
 	Parent   *BindingEnv
+
+	// chdir is the directory, relative to the build directory, that the paths
+	// and the commands in this scope are relative to. It is set by "subninja
+	// ... chdir" and inherited by the child scopes.
+	chdir string
 }
 
 // NewBindingEnv returns an initialized BindingEnv.
 func NewBindingEnv(parent *BindingEnv) *BindingEnv {
-	return &BindingEnv{
+	b := &BindingEnv{
 		Bindings: map[string]string{},
 		Rules:    map[string]*Rule{},
 		Parent:   parent,
 	}
+	if parent != nil {
+		b.chdir = parent.chdir
+	}
+	return b
 }
 
 // String serializes the bindings.
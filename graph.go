@@ -19,8 +19,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 )
 
 // ExistenceStatus represents the knowledge of the file's existence.
@@ -197,6 +199,13 @@ type Edge struct {
 	DepsLoaded           bool
 	DepsMissing          bool
 	GeneratedByDepLoader bool
+
+	// hasEnv is set when the build statement has its own environment
+	// bindings. See EvaluateEnv().
+	hasEnv bool
+	// hasCwd is set when the build statement has its own "cwd" or "cwd_rebase"
+	// binding. See Cwd().
+	hasCwd bool
 }
 
 // If this ever gets changed, update DelayedEdgesSet to take this into account.
@@ -224,18 +233,214 @@ func (e *Edge) isImplicitOut(index int) bool {
 // EvaluateCommand expands all variables in a command and return it as a string.
 //
 // If inclRspFile is enabled, the string will also contain the
-// full contents of a response file (if applicable)
+// full contents of a response file (if applicable) and the environment
+// variables set by the env bindings, the values of the environment variables
+// listed in "env_deps" and the working directory, so that it can be hashed to
+// detect changes.
+//
+// When the "cwd_rebase" binding is set, $in and $out are relative to the
+// directory set by "cwd".
 func (e *Edge) EvaluateCommand(inclRspFile bool) string {
-	command := e.GetBinding("command")
+	return e.evaluateCommand(inclRspFile, true)
+}
+
+// EvaluateCommandWithoutEnv returns EvaluateCommand(true) without the
+// environment variables set by the "env.NAME" and "env_deps" bindings, since
+// their values may be secrets.
+//
+// This is what CommandStore saves.
+func (e *Edge) EvaluateCommandWithoutEnv() string {
+	return e.evaluateCommand(true, false)
+}
+
+func (e *Edge) evaluateCommand(inclRspFile, inclEnv bool) string {
+	env := edgeEnv{
+		edge:        e,
+		escapeInOut: shellEscape,
+		rebase:      e.rebaseDir(),
+	}
+	command := env.LookupVariable("command")
 	if inclRspFile {
-		rspfileContent := e.GetBinding("rspfile_content")
+		env = edgeEnv{
+			edge:        e,
+			escapeInOut: shellEscape,
+			rebase:      env.rebase,
+		}
+		rspfileContent := env.LookupVariable("rspfile_content")
 		if rspfileContent != "" {
 			command += ";rspfile=" + rspfileContent
 		}
+		if cwd := e.Cwd(); cwd != "" {
+			command += ";cwd=" + cwd
+		}
+		if !inclEnv {
+			return command
+		}
+		if env, clear := e.EvaluateEnv(); len(env) != 0 || clear {
+			command += ";env=" + strings.Join(env, "\x00")
+			if clear {
+				command += ";clear_env"
+			}
+		}
+		if deps := e.envDeps(); len(deps) != 0 {
+			command += ";env_deps=" + strings.Join(deps, "\x00")
+		}
 	}
 	return command
 }
 
+// isEnvBinding returns true for the bindings related to the environment of
+// the command: "clear_env", "env_deps" and "env.NAME".
+func isEnvBinding(key string) bool {
+	return key == "clear_env" || key == "env_deps" || strings.HasPrefix(key, "env.")
+}
+
+// envDeps returns the sorted "NAME=value" pairs of the environment variables
+// listed in the "env_deps" binding, as seen by ninja. Unset variables are
+// returned as "NAME" so they differ from empty ones.
+func (e *Edge) envDeps() []string {
+	if !e.hasEnv && e.Rule.Bindings["env_deps"] == nil {
+		return nil
+	}
+	env := edgeEnv{
+		edge:        e,
+		escapeInOut: doNotEscape,
+	}
+	names := strings.Fields(env.LookupVariable("env_deps"))
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	out := make([]string, 0, len(names))
+	for i, name := range names {
+		if i != 0 && names[i-1] == name {
+			continue
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			out = append(out, name+"="+v)
+		} else {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// EvaluateEnv returns the environment variables to set for the command as
+// sorted "NAME=value" pairs, one per "env.NAME" binding of the rule or the
+// build statement. $in and $out are not shell escaped and are rebased like in
+// EvaluateCommand().
+//
+// clear is true when the "clear_env" binding is set, in which case the command
+// starts from a minimal environment instead of inheriting ninja's.
+func (e *Edge) EvaluateEnv() (env []string, clear bool) {
+	var names []string
+	for k := range e.Rule.Bindings {
+		if isEnvBinding(k) && k != "env_deps" {
+			names = append(names, k)
+		}
+	}
+	if e.hasEnv {
+		for k := range e.Env.Bindings {
+			if _, ok := e.Rule.Bindings[k]; !ok && isEnvBinding(k) && k != "env_deps" {
+				names = append(names, k)
+			}
+		}
+	}
+	if names == nil {
+		return nil, false
+	}
+	sort.Strings(names)
+	rebase := e.rebaseDir()
+	for _, k := range names {
+		ee := edgeEnv{edge: e, escapeInOut: doNotEscape, rebase: rebase}
+		v := ee.LookupVariable(k)
+		if k == "clear_env" {
+			clear = v != ""
+		} else if name := k[len("env."):]; name != "" {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env, clear
+}
+
+// isCwdBinding returns true for the bindings controlling the working
+// directory of the command: "cwd" and "cwd_rebase".
+func isCwdBinding(key string) bool {
+	return key == "cwd" || key == "cwd_rebase"
+}
+
+// Cwd returns the canonicalized directory the command is run in, as set by
+// the "cwd" binding and "subninja ... chdir", relative to the build directory.
+// It returns "" when the command is run in the build directory.
+func (e *Edge) Cwd() string {
+	chdir := e.Env.chdir
+	if !e.hasCwd && e.Rule.Bindings["cwd"] == nil {
+		return chdir
+	}
+	env := edgeEnv{
+		edge:        e,
+		escapeInOut: doNotEscape,
+	}
+	cwd := env.LookupVariable("cwd")
+	if cwd == "" {
+		return chdir
+	}
+	if cwd = CanonicalizePath(resolveCwdPath(chdir, cwd)); cwd == "." {
+		return ""
+	}
+	return cwd
+}
+
+// rebaseDir returns the directory $in and $out are made relative to when
+// evaluating the command, or "" when they are relative to the build
+// directory.
+//
+// In a subninja with a chdir, they are relative to this directory unless
+// "cwd_rebase" is set.
+func (e *Edge) rebaseDir() string {
+	if !e.hasCwd && e.Rule.Bindings["cwd_rebase"] == nil {
+		return e.Env.chdir
+	}
+	env := edgeEnv{
+		edge:        e,
+		escapeInOut: doNotEscape,
+	}
+	if env.LookupVariable("cwd_rebase") == "" {
+		return e.Env.chdir
+	}
+	return e.Cwd()
+}
+
+// ResolveCwdPath returns the path p, as written by the command in a depfile or
+// in its output, relative to the build directory instead of the directory the
+// command is run in. The result is not canonicalized.
+func (e *Edge) ResolveCwdPath(p string) string {
+	return resolveCwdPath(e.Cwd(), p)
+}
+
+func resolveCwdPath(cwd, p string) string {
+	if cwd == "" || p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return cwd + "/" + p
+}
+
+// rebasePath returns the path p relative to the directory dir. Both are
+// relative to the build directory. If p can't be made relative to dir, it is
+// made absolute.
+func rebasePath(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	if r, err := filepath.Rel(dir, p); err == nil {
+		return r
+	}
+	if a, err := filepath.Abs(p); err == nil {
+		return a
+	}
+	return p
+}
+
 // GetBinding returns the shell-escaped value of |key|.
 func (e *Edge) GetBinding(key string) string {
 	env := edgeEnv{
@@ -248,31 +453,35 @@ func (e *Edge) GetBinding(key string) string {
 // GetUnescapedDepfile returns like GetBinding("depfile"), but without shell
 // escaping.
 func (e *Edge) GetUnescapedDepfile() string {
-	env := edgeEnv{
-		edge:        e,
-		escapeInOut: doNotEscape,
-	}
-	return env.LookupVariable("depfile")
+	return e.getUnescapedPath("depfile")
 }
 
 // GetUnescapedDyndep returns like GetBinding("dyndep"), but without shell
 // escaping.
 func (e *Edge) GetUnescapedDyndep() string {
-	env := edgeEnv{
-		edge:        e,
-		escapeInOut: doNotEscape,
-	}
-	return env.LookupVariable("dyndep")
+	return e.getUnescapedPath("dyndep")
 }
 
 // GetUnescapedRspfile returns like GetBinding("rspfile"), but without shell
 // escaping.
 func (e *Edge) GetUnescapedRspfile() string {
+	return e.getUnescapedPath("rspfile")
+}
+
+// getUnescapedPath returns the unescaped value of the binding key, which is a
+// path. In a subninja with a chdir, the path is relative to this directory
+// and is resolved relative to the build directory.
+func (e *Edge) getUnescapedPath(key string) string {
 	env := edgeEnv{
 		edge:        e,
 		escapeInOut: doNotEscape,
+		rebase:      e.Env.chdir,
+	}
+	p := env.LookupVariable(key)
+	if e.Env.chdir == "" || p == "" {
+		return p
 	}
-	return env.LookupVariable("rspfile")
+	return CanonicalizePath(resolveCwdPath(e.Env.chdir, p))
 }
 
 // Dump prints the Edge details to stdout.
@@ -414,6 +623,8 @@ type edgeEnv struct {
 	edge        *Edge
 	escapeInOut escapeKind
 	recursive   bool
+	// rebase is the directory $in and $out are relative to, if not "".
+	rebase string
 }
 
 func (e *edgeEnv) LookupVariable(v string) string {
@@ -421,13 +632,13 @@ func (e *edgeEnv) LookupVariable(v string) string {
 	switch v {
 	case "in":
 		explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
-		return makePathList(edge.Inputs[:explicitDepsCount], ' ', e.escapeInOut)
+		return makePathList(edge.Inputs[:explicitDepsCount], ' ', e.escapeInOut, e.rebase)
 	case "in_newline":
 		explicitDepsCount := len(edge.Inputs) - int(edge.ImplicitDeps) - int(edge.OrderOnlyDeps)
-		return makePathList(edge.Inputs[:explicitDepsCount], '\n', e.escapeInOut)
+		return makePathList(edge.Inputs[:explicitDepsCount], '\n', e.escapeInOut, e.rebase)
 	case "out":
 		explicitOutsCount := len(edge.Outputs) - int(edge.ImplicitOuts)
-		return makePathList(edge.Outputs[:explicitOutsCount], ' ', e.escapeInOut)
+		return makePathList(edge.Outputs[:explicitOutsCount], ' ', e.escapeInOut, e.rebase)
 	default:
 		// TODO(maruel): Remove here and move to a post parsing evaluation in a
 		// separate goroutine.
@@ -458,7 +669,9 @@ func (e *edgeEnv) LookupVariable(v string) string {
 
 // Given a span of Nodes, construct a list of paths suitable for a command
 // line.
-func makePathList(span []*Node, sep byte, escapeInOut escapeKind) string {
+//
+// If rebase is not empty, the paths are made relative to this directory.
+func makePathList(span []*Node, sep byte, escapeInOut escapeKind, rebase string) string {
 	var z [64]string
 	var s []string
 	if l := len(span); l <= cap(z) {
@@ -470,6 +683,9 @@ func makePathList(span []*Node, sep byte, escapeInOut escapeKind) string {
 	first := false
 	for i, x := range span {
 		path := x.PathDecanonicalized()
+		if rebase != "" {
+			path = rebasePath(rebase, path)
+		}
 		if escapeInOut == shellEscape {
 			if runtime.GOOS == "windows" {
 				path = getWin32EscapedString(path)
@@ -536,6 +752,8 @@ type DependencyScan struct {
 	di           DiskInterface
 	depLoader    implicitDepLoader
 	dyndepLoader DyndepLoader
+	onDirty      func(r *DirtyReason)
+	commands     *CommandStore
 }
 
 // NewDependencyScan returns an initialized DependencyScan.
@@ -552,6 +770,40 @@ func (d *DependencyScan) depsLog() *DepsLog {
 	return d.depLoader.depsLog
 }
 
+// SetDirtyCallback sets a function to be called with each reason found by
+// RecomputeDirty() why a node is dirty.
+//
+// When f is set, the reasons are not printed even if Debug.Explaining is set;
+// f becomes the sole consumer.
+func (d *DependencyScan) SetDirtyCallback(f func(r *DirtyReason)) {
+	d.onDirty = f
+	d.depLoader.onDirty = f
+}
+
+// SetToolDeps enables treating the tool binary run by each command, resolved
+// through PATH, as an implicit input of the edge, so that updating a tool
+// rebuilds the edges using it.
+func (d *DependencyScan) SetToolDeps(enabled bool) {
+	d.depLoader.toolDeps = enabled
+}
+
+// SetCommandStore sets the store used to retrieve the previous command of an
+// edge whose command changed, to explain how it changed.
+func (d *DependencyScan) SetCommandStore(c *CommandStore) {
+	d.commands = c
+}
+
+// reportDirty explains why a node is dirty.
+//
+// Falls back to the legacy explain() output when there is no callback.
+func reportDirty(f func(r *DirtyReason), r *DirtyReason) {
+	if f != nil {
+		f(r)
+	} else {
+		explain("%s", r)
+	}
+}
+
 // RecomputeDirty updates the |dirty| state of the given Node by transitively
 // inspecting their input edges.
 //
@@ -599,7 +851,7 @@ func (d *DependencyScan) recomputeNodeDirty(node *Node, stack, validationNodes [
 			return stack, validationNodes, err
 		}
 		if node.Exists != ExistenceStatusExists {
-			explain("%s has no in-edge and is missing", node.Path)
+			reportDirty(d.onDirty, &DirtyReason{Kind: DirtySourceMissing, Node: node})
 		}
 		node.Dirty = node.Exists != ExistenceStatusExists
 		return stack, validationNodes, nil
@@ -637,6 +889,24 @@ func (d *DependencyScan) recomputeNodeDirty(node *Node, stack, validationNodes [
 		//   loaded to update this edge before it can possibly be scheduled.
 		if edge.Dyndep != nil && edge.Dyndep.DyndepPending {
 			var err error
+			// The C++ modules required by a P1689 dyndep file can be provided by
+			// the dyndep files of the edges this edge depends on, so load the ones
+			// that are ready first.
+			for _, i := range edge.Inputs {
+				if i == edge.Dyndep || !i.DyndepPending {
+					continue
+				}
+				stack, validationNodes, err = d.recomputeNodeDirty(i, stack, validationNodes)
+				if err != nil {
+					return stack, validationNodes, err
+				}
+				if i.DyndepPending && (i.InEdge == nil || i.InEdge.OutputsReady) {
+					if err := d.LoadDyndeps(i, DyndepFile{}); err != nil {
+						return stack, validationNodes, err
+					}
+				}
+			}
+
 			stack, validationNodes, err = d.recomputeNodeDirty(edge.Dyndep, stack, validationNodes)
 			if err != nil {
 				return stack, validationNodes, err
@@ -647,6 +917,8 @@ func (d *DependencyScan) recomputeNodeDirty(node *Node, stack, validationNodes [
 				if err := d.LoadDyndeps(edge.Dyndep, DyndepFile{}); err != nil {
 					return stack, validationNodes, err
 				}
+			} else if d.onDirty != nil {
+				d.onDirty(&DirtyReason{Kind: DirtyDyndepPending, Edge: edge, Node: edge.Dyndep})
 			}
 		}
 	}
@@ -699,7 +971,7 @@ func (d *DependencyScan) recomputeNodeDirty(node *Node, stack, validationNodes [
 			// If a regular input is dirty (or missing), we're dirty.
 			// Otherwise consider mtime.
 			if i.Dirty {
-				explain("%s is dirty", i.Path)
+				reportDirty(d.onDirty, &DirtyReason{Kind: DirtyInputDirty, Edge: edge, Node: node, Input: i})
 				dirty = true
 			} else {
 				if mostRecentInput == nil || i.MTime > mostRecentInput.MTime {
@@ -805,7 +1077,7 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 		// Phony edges don't write any output.  Outputs are only dirty if
 		// there are no inputs and we're missing the output.
 		if len(edge.Inputs) == 0 && output.Exists != ExistenceStatusExists {
-			explain("output %s of phony edge with no inputs doesn't exist", output.Path)
+			reportDirty(d.onDirty, &DirtyReason{Kind: DirtyPhonyOutputMissing, Edge: edge, Node: output})
 			return true
 		}
 
@@ -823,7 +1095,7 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 
 	// Dirty if we're missing the output.
 	if output.Exists != ExistenceStatusExists {
-		explain("output %s doesn't exist", output.Path)
+		reportDirty(d.onDirty, &DirtyReason{Kind: DirtyOutputMissing, Edge: edge, Node: output})
 		return true
 	}
 
@@ -844,11 +1116,7 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 		}
 
 		if outputMtime < mostRecentInput.MTime {
-			s := ""
-			if usedRestat {
-				s = "restat of "
-			}
-			explain("%soutput %s older than most recent input %s (%x vs %x)", s, output.Path, mostRecentInput.Path, outputMtime, mostRecentInput.MTime)
+			reportDirty(d.onDirty, &DirtyReason{Kind: DirtyOutputOlder, Edge: edge, Node: output, Input: mostRecentInput, MTime: outputMtime, InputMTime: mostRecentInput.MTime, Restat: usedRestat})
 			return true
 		}
 	}
@@ -859,11 +1127,18 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 			entry = d.buildLog.Entries[output.Path]
 		}
 		if entry != nil {
-			if !generator && HashCommand(command) != entry.commandHash {
+			if h := HashCommand(command); !generator && h != entry.commandHash {
 				// May also be dirty due to the command changing since the last build.
 				// But if this is a generator rule, the command changing does not make us
 				// dirty.
-				explain("command line changed for %s", output.Path)
+				r := &DirtyReason{Kind: DirtyCommandChanged, Edge: edge, Node: output, OldHash: entry.commandHash, NewHash: h}
+				if d.commands != nil && (d.onDirty != nil || Debug.Explaining) {
+					if old, err := d.commands.Lookup(entry.commandHash); err == nil {
+						r.OldCommand = old
+						r.NewCommand = edge.EvaluateCommandWithoutEnv()
+					}
+				}
+				reportDirty(d.onDirty, r)
 				return true
 			}
 			if mostRecentInput != nil && entry.mtime < mostRecentInput.MTime {
@@ -871,12 +1146,12 @@ func (d *DependencyScan) recomputeOutputDirty(edge *Edge, mostRecentInput *Node,
 				// mtime of the most recent input.  This can occur even when the mtime
 				// on disk is newer if a previous run wrote to the output file but
 				// exited with an error or was interrupted.
-				explain("recorded mtime of %s older than most recent input %s (%x vs %x)", output.Path, mostRecentInput.Path, entry.mtime, mostRecentInput.MTime)
+				reportDirty(d.onDirty, &DirtyReason{Kind: DirtyLogMtimeOlder, Edge: edge, Node: output, Input: mostRecentInput, MTime: entry.mtime, InputMTime: mostRecentInput.MTime})
 				return true
 			}
 		}
 		if entry == nil && !generator {
-			explain("command line not found in log for %s", output.Path)
+			reportDirty(d.onDirty, &DirtyReason{Kind: DirtyLogEntryMissing, Edge: edge, Node: output})
 			return true
 		}
 	}
@@ -899,6 +1174,13 @@ type implicitDepLoader struct {
 	state   *State
 	di      DiskInterface
 	depsLog *DepsLog
+	onDirty func(r *DirtyReason)
+
+	// toolDeps enables loadToolDep().
+	toolDeps bool
+	// toolPaths caches the tools resolved through PATH, keyed by the PATH and
+	// PATHEXT of the command and the tool name.
+	toolPaths map[string]string
 }
 
 func newImplicitDepLoader(state *State, depsLog *DepsLog, di DiskInterface) implicitDepLoader {
@@ -913,6 +1195,9 @@ func newImplicitDepLoader(state *State, depsLog *DepsLog, di DiskInterface) impl
 //
 // Returns false if info is just missing or out of date.
 func (i *implicitDepLoader) loadDeps(edge *Edge) (bool, error) {
+	if i.toolDeps {
+		i.loadToolDep(edge)
+	}
 	depsType := edge.GetBinding("deps")
 	if len(depsType) != 0 {
 		return i.loadDepsFromLog(edge), nil
@@ -940,8 +1225,7 @@ func (i *implicitDepLoader) loadDepFile(edge *Edge, path string) (bool, error) {
 	}
 	// On a missing depfile: return false and empty error.
 	if len(content) == 0 {
-		// TODO(maruel): Use %q for real quoting.
-		explain("depfile '%s' is missing", path)
+		reportDirty(i.onDirty, &DirtyReason{Kind: DirtyDepfileMissing, Edge: edge, Node: edge.Outputs[0], Path: path})
 		return false, nil
 	}
 
@@ -954,11 +1238,22 @@ func (i *implicitDepLoader) loadDepFile(edge *Edge, path string) (bool, error) {
 		return false, errors.New(path + ": no outputs declared")
 	}
 
+	// Paths in the depfile are relative to the directory the command was run
+	// in.
+	if cwd := edge.Cwd(); cwd != "" {
+		for j, o := range depfile.outs {
+			depfile.outs[j] = CanonicalizePath(resolveCwdPath(cwd, o))
+		}
+		for j, in := range depfile.ins {
+			depfile.ins[j] = resolveCwdPath(cwd, in)
+		}
+	}
+
 	// Check that this depfile matches the edge's output, if not return false to
 	// mark the edge as dirty.
 	firstOutput := edge.Outputs[0]
 	if primaryOut := CanonicalizePath(depfile.outs[0]); firstOutput.Path != primaryOut {
-		explain("expected depfile '%s' to mention '%s', got '%s'", path, firstOutput.Path, primaryOut)
+		reportDirty(i.onDirty, &DirtyReason{Kind: DirtyDepfileMismatch, Edge: edge, Node: firstOutput, Path: path, Got: primaryOut})
 		return false, nil
 	}
 
@@ -1009,13 +1304,13 @@ func (i *implicitDepLoader) loadDepsFromLog(edge *Edge) bool {
 		deps = i.depsLog.GetDeps(output)
 	}
 	if deps == nil {
-		explain("deps for '%s' are missing", output.Path)
+		reportDirty(i.onDirty, &DirtyReason{Kind: DirtyDepsMissing, Edge: edge, Node: output})
 		return false
 	}
 
 	// Deps are invalid if the output is newer than the deps.
 	if output.MTime > deps.MTime {
-		explain("stored deps info out of date for '%s' (%x vs %x)", output.Path, deps.MTime, output.MTime)
+		reportDirty(i.onDirty, &DirtyReason{Kind: DirtyDepsStale, Edge: edge, Node: output, MTime: deps.MTime, InputMTime: output.MTime})
 		return false
 	}
 
@@ -0,0 +1,531 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// GraphFormat is an output format supported by GraphExporter.
+type GraphFormat int32
+
+// Valid GraphFormat values.
+const (
+	// GraphDOT is the GraphViz .dot format.
+	GraphDOT GraphFormat = iota
+	// GraphMermaid is a Mermaid flowchart.
+	GraphMermaid
+	// GraphML is the GraphML XML format.
+	GraphML
+	// GraphJSON is a JSON node and edge list.
+	GraphJSON
+)
+
+// ParseGraphFormat returns the GraphFormat for its name: "dot", "mermaid",
+// "graphml" or "json".
+func ParseGraphFormat(s string) (GraphFormat, error) {
+	switch s {
+	case "dot":
+		return GraphDOT, nil
+	case "mermaid":
+		return GraphMermaid, nil
+	case "graphml":
+		return GraphML, nil
+	case "json":
+		return GraphJSON, nil
+	default:
+		// TODO(maruel): Use %q for real quoting.
+		return GraphDOT, fmt.Errorf("unknown graph format '%s'; valid values are dot, mermaid, graphml and json", s)
+	}
+}
+
+// GraphOpts are the options of a GraphExporter.
+type GraphOpts struct {
+	// Format is the output format.
+	Format GraphFormat
+	// MaxDepth is the maximum number of build edges traversed from the
+	// targets. 0 means unlimited.
+	MaxDepth int
+	// Exclude are path.Match() patterns of nodes to skip. A pattern without a
+	// slash is matched against the base name. The inputs of a skipped node are
+	// not traversed.
+	Exclude []string
+	// CollapseDirs merges all the files in a directory into a single node.
+	CollapseDirs bool
+	// Scan, when set, is used to only keep the dirty nodes. The traversal
+	// stops at clean nodes: their inputs are clean too, except for order-only
+	// inputs which are not included even when dirty.
+	Scan *DependencyScan
+	// Highlight is the path of a node to highlight, along with all the paths
+	// leading from the targets to it.
+	Highlight string
+}
+
+// GraphExporter creates a graph of the dependencies of targets, in one of
+// the formats in GraphFormat.
+//
+// Unlike GraphViz, it supports filtering the graph.
+type GraphExporter struct {
+	opts         GraphOpts
+	state        *State
+	dyndepLoader DyndepLoader
+	// depth is the minimum depth at which a node was found.
+	depth map[*Node]int
+	nodes []*Node
+	// expanded are the edges whose inputs were traversed.
+	expanded map[*Edge]struct{}
+	edges    []*Edge
+}
+
+// NewGraphExporter returns an initialized GraphExporter.
+func NewGraphExporter(state *State, di DiskInterface, opts GraphOpts) *GraphExporter {
+	return &GraphExporter{
+		opts:         opts,
+		state:        state,
+		dyndepLoader: NewDyndepLoader(state, di),
+		depth:        map[*Node]int{},
+		expanded:     map[*Edge]struct{}{},
+	}
+}
+
+// AddTarget adds a node and its dependencies to the graph.
+//
+// Returns an error if Scan is set and the dirty state failed to be computed.
+func (g *GraphExporter) AddTarget(node *Node) error {
+	if g.opts.Scan != nil {
+		if _, err := g.opts.Scan.RecomputeDirty(node); err != nil {
+			return err
+		}
+	}
+	if !g.keep(node) {
+		return nil
+	}
+	g.addNode(node, 0)
+	// Breadth first, so that a node is expanded at its minimal depth.
+	queue := []*Node{node}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		d := g.depth[n]
+		edge := n.InEdge
+		if edge == nil || (g.opts.MaxDepth > 0 && d >= g.opts.MaxDepth) {
+			continue
+		}
+		if _, ok := g.expanded[edge]; !ok {
+			g.expanded[edge] = struct{}{}
+			g.edges = append(g.edges, edge)
+			if edge.Dyndep != nil && edge.Dyndep.DyndepPending {
+				if err := g.dyndepLoader.LoadDyndeps(edge.Dyndep, DyndepFile{}); err != nil {
+					warningf("%s\n", err)
+				}
+			}
+		}
+		for _, out := range edge.Outputs {
+			if out != n && g.keep(out) {
+				g.addNode(out, d)
+			}
+		}
+		for _, in := range edge.Inputs {
+			if g.keep(in) && g.addNode(in, d+1) {
+				queue = append(queue, in)
+			}
+		}
+	}
+	return nil
+}
+
+// keep returns true if the node passes the filters.
+func (g *GraphExporter) keep(n *Node) bool {
+	if g.opts.Scan != nil && !n.Dirty {
+		return false
+	}
+	base := path.Base(n.Path)
+	for _, p := range g.opts.Exclude {
+		m := n.Path
+		if !strings.Contains(p, "/") {
+			m = base
+		}
+		if ok, _ := path.Match(p, m); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// addNode adds a node at depth d. Returns true if it needs to be expanded.
+func (g *GraphExporter) addNode(n *Node, d int) bool {
+	old, ok := g.depth[n]
+	if !ok {
+		g.nodes = append(g.nodes, n)
+	} else if old <= d {
+		return false
+	}
+	g.depth[n] = d
+	return true
+}
+
+// graphItem is a vertex in the generic graph representation.
+type graphItem struct {
+	ID string `json:"id"`
+	// Kind is one of "file", "edge" for a build statement, or "dir" when
+	// collapsed.
+	Kind        string `json:"kind"`
+	Label       string `json:"label"`
+	Dirty       bool   `json:"dirty,omitempty"`
+	Highlighted bool   `json:"highlighted,omitempty"`
+}
+
+// graphLink is an arc in the generic graph representation.
+type graphLink struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Label       string `json:"label,omitempty"`
+	OrderOnly   bool   `json:"order_only,omitempty"`
+	Highlighted bool   `json:"highlighted,omitempty"`
+	// toEdge is set when To is a build statement.
+	toEdge bool
+}
+
+type graphModel struct {
+	Nodes []*graphItem `json:"nodes"`
+	Links []*graphLink `json:"edges"`
+}
+
+// highlighted returns the nodes and edges on the paths leading to
+// opts.Highlight.
+func (g *GraphExporter) highlighted() (map[*Node]struct{}, map[*Edge]struct{}, error) {
+	hlNodes := map[*Node]struct{}{}
+	hlEdges := map[*Edge]struct{}{}
+	if g.opts.Highlight == "" {
+		return hlNodes, hlEdges, nil
+	}
+	target := g.state.Paths[CanonicalizePath(g.opts.Highlight)]
+	if _, ok := g.depth[target]; target == nil || !ok {
+		// TODO(maruel): Use %q for real quoting.
+		return nil, nil, fmt.Errorf("'%s' is not in the graph", g.opts.Highlight)
+	}
+	hlNodes[target] = struct{}{}
+	stack := []*Node{target}
+	for len(stack) != 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range n.OutEdges {
+			if _, ok := g.expanded[e]; !ok {
+				continue
+			}
+			if _, ok := hlEdges[e]; ok {
+				continue
+			}
+			hlEdges[e] = struct{}{}
+			for _, out := range e.Outputs {
+				if _, ok := g.depth[out]; !ok {
+					continue
+				}
+				if _, ok := hlNodes[out]; !ok {
+					hlNodes[out] = struct{}{}
+					stack = append(stack, out)
+				}
+			}
+		}
+	}
+	return hlNodes, hlEdges, nil
+}
+
+// model converts the traversed graph into its generic representation.
+func (g *GraphExporter) model() (*graphModel, error) {
+	hlNodes, hlEdges, err := g.highlighted()
+	if err != nil {
+		return nil, err
+	}
+	m := &graphModel{Nodes: []*graphItem{}, Links: []*graphLink{}}
+	ids := make(map[*Node]*graphItem, len(g.nodes))
+	for _, n := range g.nodes {
+		_, hl := hlNodes[n]
+		item := &graphItem{
+			ID:          fmt.Sprintf("n%d", len(m.Nodes)),
+			Kind:        "file",
+			Label:       strings.ReplaceAll(n.Path, "\\", "/"),
+			Dirty:       g.opts.Scan != nil && n.Dirty,
+			Highlighted: hl,
+		}
+		ids[n] = item
+		m.Nodes = append(m.Nodes, item)
+	}
+	for i, e := range g.edges {
+		_, hl := hlEdges[e]
+		if len(e.Inputs) == 1 && len(e.Outputs) == 1 {
+			in, out := ids[e.Inputs[0]], ids[e.Outputs[0]]
+			if in != nil && out != nil {
+				// Can draw simply.
+				m.Links = append(m.Links, &graphLink{From: in.ID, To: out.ID, Label: e.Rule.Name, Highlighted: hl && in.Highlighted})
+			}
+			continue
+		}
+		item := &graphItem{ID: fmt.Sprintf("e%d", i), Kind: "edge", Label: e.Rule.Name, Highlighted: hl}
+		m.Nodes = append(m.Nodes, item)
+		for _, out := range e.Outputs {
+			if o := ids[out]; o != nil {
+				m.Links = append(m.Links, &graphLink{From: item.ID, To: o.ID, Highlighted: hl && o.Highlighted})
+			}
+		}
+		for j, in := range e.Inputs {
+			if o := ids[in]; o != nil {
+				m.Links = append(m.Links, &graphLink{From: o.ID, To: item.ID, OrderOnly: e.IsOrderOnly(j), Highlighted: hl && o.Highlighted, toEdge: true})
+			}
+		}
+	}
+	if g.opts.CollapseDirs {
+		m = g.collapse(m, ids)
+	}
+	return m, nil
+}
+
+// collapse merges the file nodes per directory and removes the build
+// statements.
+func (g *GraphExporter) collapse(m *graphModel, ids map[*Node]*graphItem) *graphModel {
+	out := &graphModel{Nodes: []*graphItem{}, Links: []*graphLink{}}
+	dirs := map[string]*graphItem{}
+	fileToDir := map[string]*graphItem{}
+	for _, n := range g.nodes {
+		f := ids[n]
+		d := path.Dir(f.Label)
+		item := dirs[d]
+		if item == nil {
+			item = &graphItem{ID: fmt.Sprintf("d%d", len(out.Nodes)), Kind: "dir", Label: d}
+			dirs[d] = item
+			out.Nodes = append(out.Nodes, item)
+		}
+		item.Dirty = item.Dirty || f.Dirty
+		item.Highlighted = item.Highlighted || f.Highlighted
+		fileToDir[f.ID] = item
+	}
+	links := map[[2]string]*graphLink{}
+	add := func(from, to *graphItem, orderOnly, hl bool) {
+		if from == to {
+			return
+		}
+		k := [2]string{from.ID, to.ID}
+		l := links[k]
+		if l == nil {
+			l = &graphLink{From: from.ID, To: to.ID, OrderOnly: true}
+			links[k] = l
+			out.Links = append(out.Links, l)
+		}
+		l.OrderOnly = l.OrderOnly && orderOnly
+		l.Highlighted = l.Highlighted || hl
+	}
+	// Build statements are removed, so link their inputs to their outputs.
+	ins := map[string][]*graphLink{}
+	for _, l := range m.Links {
+		if l.toEdge {
+			ins[l.To] = append(ins[l.To], l)
+		}
+	}
+	for _, l := range m.Links {
+		if l.toEdge {
+			continue
+		}
+		to := fileToDir[l.To]
+		if from := fileToDir[l.From]; from != nil {
+			add(from, to, false, l.Highlighted)
+			continue
+		}
+		for _, in := range ins[l.From] {
+			add(fileToDir[in.From], to, in.OrderOnly, in.Highlighted && l.Highlighted)
+		}
+	}
+	return out
+}
+
+// Write writes the graph in the requested format.
+func (g *GraphExporter) Write(w io.Writer) error {
+	m, err := g.model()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	switch g.opts.Format {
+	case GraphDOT:
+		writeGraphDOT(b, m)
+	case GraphMermaid:
+		writeGraphMermaid(b, m)
+	case GraphML:
+		writeGraphML(b, m)
+	case GraphJSON:
+		e := json.NewEncoder(b)
+		e.SetEscapeHTML(false)
+		e.SetIndent("", "  ")
+		if err := e.Encode(m); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown graph format")
+	}
+	return b.Flush()
+}
+
+func writeGraphDOT(w *bufio.Writer, m *graphModel) {
+	_, _ = w.WriteString("digraph ninja {\nrankdir=\"LR\"\nnode [fontsize=10, shape=box, height=0.25]\nedge [fontsize=10]\n")
+	for _, n := range m.Nodes {
+		var attrs []string
+		switch n.Kind {
+		case "edge":
+			attrs = append(attrs, "shape=ellipse")
+		case "dir":
+			attrs = append(attrs, "shape=folder")
+		}
+		if n.Dirty {
+			attrs = append(attrs, "fontcolor=red")
+		}
+		if n.Highlighted {
+			attrs = append(attrs, "color=blue", "penwidth=3")
+		}
+		fmt.Fprintf(w, "%q [label=%q", n.ID, n.Label)
+		for _, a := range attrs {
+			fmt.Fprintf(w, ", %s", a)
+		}
+		_, _ = w.WriteString("]\n")
+	}
+	for _, l := range m.Links {
+		var attrs []string
+		if l.Label != "" {
+			// Note extra space before label text -- this is cosmetic and feels
+			// like a graphviz bug.
+			attrs = append(attrs, fmt.Sprintf("label=%q", " "+l.Label))
+		}
+		if l.toEdge {
+			attrs = append(attrs, "arrowhead=none")
+		}
+		if l.OrderOnly {
+			attrs = append(attrs, "style=dotted")
+		}
+		if l.Highlighted {
+			attrs = append(attrs, "color=blue", "penwidth=3")
+		}
+		fmt.Fprintf(w, "%q -> %q", l.From, l.To)
+		if len(attrs) != 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(attrs, ", "))
+		}
+		_, _ = w.WriteString("\n")
+	}
+	_, _ = w.WriteString("}\n")
+}
+
+// mermaidEscape escapes a label to be used inside double quotes.
+func mermaidEscape(s string) string {
+	return strings.ReplaceAll(s, "\"", "#quot;")
+}
+
+func writeGraphMermaid(w *bufio.Writer, m *graphModel) {
+	_, _ = w.WriteString("flowchart LR\n")
+	var dirty, hl []string
+	for _, n := range m.Nodes {
+		switch n.Kind {
+		case "edge":
+			fmt.Fprintf(w, "  %s([\"%s\"])\n", n.ID, mermaidEscape(n.Label))
+		case "dir":
+			fmt.Fprintf(w, "  %s[(\"%s\")]\n", n.ID, mermaidEscape(n.Label))
+		default:
+			fmt.Fprintf(w, "  %s[\"%s\"]\n", n.ID, mermaidEscape(n.Label))
+		}
+		if n.Dirty {
+			dirty = append(dirty, n.ID)
+		}
+		if n.Highlighted {
+			hl = append(hl, n.ID)
+		}
+	}
+	var hlLinks []string
+	for i, l := range m.Links {
+		arrow := "-->"
+		if l.toEdge {
+			arrow = "---"
+		}
+		if l.OrderOnly {
+			arrow = "-.->"
+			if l.toEdge {
+				arrow = "-.-"
+			}
+		}
+		if l.Label != "" {
+			fmt.Fprintf(w, "  %s %s|\"%s\"| %s\n", l.From, arrow, mermaidEscape(l.Label), l.To)
+		} else {
+			fmt.Fprintf(w, "  %s %s %s\n", l.From, arrow, l.To)
+		}
+		if l.Highlighted {
+			hlLinks = append(hlLinks, fmt.Sprintf("%d", i))
+		}
+	}
+	if len(dirty) != 0 {
+		fmt.Fprintf(w, "  classDef dirty color:#c00\n  class %s dirty\n", strings.Join(dirty, ","))
+	}
+	if len(hl) != 0 {
+		fmt.Fprintf(w, "  classDef highlight stroke:#00f,stroke-width:3px\n  class %s highlight\n", strings.Join(hl, ","))
+	}
+	if len(hlLinks) != 0 {
+		fmt.Fprintf(w, "  linkStyle %s stroke:#00f,stroke-width:3px\n", strings.Join(hlLinks, ","))
+	}
+}
+
+// xmlEscape escapes a string to be used in an attribute or a text node.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeGraphML(w *bufio.Writer, m *graphModel) {
+	_, _ = w.WriteString(xml.Header)
+	_, _ = w.WriteString("<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n" +
+		"  <key id=\"label\" for=\"all\" attr.name=\"label\" attr.type=\"string\"/>\n" +
+		"  <key id=\"kind\" for=\"node\" attr.name=\"kind\" attr.type=\"string\"/>\n" +
+		"  <key id=\"dirty\" for=\"node\" attr.name=\"dirty\" attr.type=\"boolean\"><default>false</default></key>\n" +
+		"  <key id=\"highlighted\" for=\"all\" attr.name=\"highlighted\" attr.type=\"boolean\"><default>false</default></key>\n" +
+		"  <key id=\"order_only\" for=\"edge\" attr.name=\"order_only\" attr.type=\"boolean\"><default>false</default></key>\n" +
+		"  <graph id=\"ninja\" edgedefault=\"directed\">\n")
+	for _, n := range m.Nodes {
+		fmt.Fprintf(w, "    <node id=\"%s\">\n", n.ID)
+		fmt.Fprintf(w, "      <data key=\"label\">%s</data>\n", xmlEscape(n.Label))
+		fmt.Fprintf(w, "      <data key=\"kind\">%s</data>\n", n.Kind)
+		if n.Dirty {
+			_, _ = w.WriteString("      <data key=\"dirty\">true</data>\n")
+		}
+		if n.Highlighted {
+			_, _ = w.WriteString("      <data key=\"highlighted\">true</data>\n")
+		}
+		_, _ = w.WriteString("    </node>\n")
+	}
+	for i, l := range m.Links {
+		fmt.Fprintf(w, "    <edge id=\"l%d\" source=\"%s\" target=\"%s\">\n", i, l.From, l.To)
+		if l.Label != "" {
+			fmt.Fprintf(w, "      <data key=\"label\">%s</data>\n", xmlEscape(l.Label))
+		}
+		if l.OrderOnly {
+			_, _ = w.WriteString("      <data key=\"order_only\">true</data>\n")
+		}
+		if l.Highlighted {
+			_, _ = w.WriteString("      <data key=\"highlighted\">true</data>\n")
+		}
+		_, _ = w.WriteString("    </edge>\n")
+	}
+	_, _ = w.WriteString("  </graph>\n</graphml>\n")
+}
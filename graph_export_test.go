@@ -0,0 +1,130 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const graphExportManifest = "build out: cat mid/a mid/b\n" +
+	"build mid/a: cat in/a.c\n" +
+	"build mid/b: cat in/b.c | in/b.h\n"
+
+func exportGraph(t *testing.T, g *GraphTest, opts GraphOpts, target string) string {
+	e := NewGraphExporter(&g.state, &g.fs, opts)
+	if err := e.AddTarget(g.GetNode(target)); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := e.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGraphExport_DOT(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "build out: cat in1 in2 || oo\nbuild mid: cat in3\n", ParseManifestOpts{})
+	got := exportGraph(t, &g, GraphOpts{}, "out")
+	want := "digraph ninja {\n" +
+		"rankdir=\"LR\"\n" +
+		"node [fontsize=10, shape=box, height=0.25]\n" +
+		"edge [fontsize=10]\n" +
+		"\"n0\" [label=\"out\"]\n" +
+		"\"n1\" [label=\"in1\"]\n" +
+		"\"n2\" [label=\"in2\"]\n" +
+		"\"n3\" [label=\"oo\"]\n" +
+		"\"e0\" [label=\"cat\", shape=ellipse]\n" +
+		"\"e0\" -> \"n0\"\n" +
+		"\"n1\" -> \"e0\" [arrowhead=none]\n" +
+		"\"n2\" -> \"e0\" [arrowhead=none]\n" +
+		"\"n3\" -> \"e0\" [arrowhead=none, style=dotted]\n" +
+		"}\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestGraphExport_Filters(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, graphExportManifest, ParseManifestOpts{})
+
+	got := exportGraph(t, &g, GraphOpts{Format: GraphJSON, MaxDepth: 1, Exclude: []string{"b"}}, "out")
+	want := `{"nodes":[{"id":"n0","kind":"file","label":"out"},{"id":"n1","kind":"file","label":"mid/a"},{"id":"e0","kind":"edge","label":"cat"}],` +
+		`"edges":[{"from":"e0","to":"n0"},{"from":"n1","to":"e0"}]}`
+	if diff := cmp.Diff(want, compactJSON(t, got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+
+	got = exportGraph(t, &g, GraphOpts{Format: GraphJSON, CollapseDirs: true, Highlight: "in/b.h"}, "out")
+	want = `{"nodes":[{"id":"d0","kind":"dir","label":".","highlighted":true},{"id":"d1","kind":"dir","label":"mid","highlighted":true},{"id":"d2","kind":"dir","label":"in","highlighted":true}],` +
+		`"edges":[{"from":"d1","to":"d0","highlighted":true},{"from":"d2","to":"d1","highlighted":true}]}`
+	if diff := cmp.Diff(want, compactJSON(t, got)); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestGraphExport_Dirty(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, graphExportManifest, ParseManifestOpts{})
+	g.fs.Create("in/a.c", "")
+	g.fs.Create("in/b.c", "")
+	g.fs.Create("in/b.h", "")
+	g.fs.Create("mid/a", "")
+	g.fs.Create("mid/b", "")
+	g.fs.Create("out", "")
+	g.fs.Tick()
+	g.fs.Create("in/b.h", "")
+
+	got := exportGraph(t, &g, GraphOpts{Format: GraphMermaid, Scan: &g.scan}, "out")
+	want := "flowchart LR\n" +
+		"  n0[\"out\"]\n" +
+		"  n1[\"mid/b\"]\n" +
+		"  e0([\"cat\"])\n" +
+		"  e1([\"cat\"])\n" +
+		"  e0 --> n0\n" +
+		"  n1 --- e0\n" +
+		"  e1 --> n1\n" +
+		"  classDef dirty color:#c00\n" +
+		"  class n0,n1 dirty\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
+
+func TestGraphExport_GraphML(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "build a&b: cat <in>\n", ParseManifestOpts{})
+	got := exportGraph(t, &g, GraphOpts{Format: GraphML}, "a&b")
+	if !strings.Contains(got, "<data key=\"label\">a&amp;b</data>") || !strings.Contains(got, "<data key=\"label\">&lt;in&gt;</data>") {
+		t.Fatal(got)
+	}
+	if !strings.Contains(got, "<edge id=\"l0\" source=\"n1\" target=\"n0\">") {
+		t.Fatal(got)
+	}
+}
+
+func compactJSON(t *testing.T, s string) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
@@ -0,0 +1,564 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GraphQuery evaluates queries over the build graph in the style of "bazel
+// query".
+//
+// The grammar is:
+//
+//	expr := term {op term}
+//	op   := "+" | "union" | "^" | "intersect" | "-" | "except"
+//	term := word | "(" expr ")" | function "(" args ")"
+//
+// The operators are left associative and have the same precedence. A word is
+// a path, a glob pattern as understood by path.Match or a path prefix ending
+// with "..."; "..." alone is every node. Words can be quoted with ' or ".
+//
+// The functions are:
+//
+//	deps(x [, depth])             x and its transitive inputs
+//	rdeps(universe, x [, depth])  the nodes in universe depending on x, and x
+//	kind(regexp, x)               the nodes in x whose rule matches; source files are "source"
+//	filter(regexp, x)             the nodes in x whose path matches
+//	somepath(a, b)                a path from a node in a to a node in b
+//	allpaths(a, b)                all the nodes on a path from a node in a to a node in b
+//	set(word...)                  the union of the words
+//
+// A path goes from a node to its inputs.
+type GraphQuery struct {
+	state   *State
+	depsLog *DepsLog
+	rdeps   map[*Node][]*Node
+}
+
+// NewGraphQuery returns a GraphQuery over state.
+//
+// If depsLog is not nil, the dependencies recorded in it are considered as
+// inputs of the edges, like after a build.
+func NewGraphQuery(state *State, depsLog *DepsLog) *GraphQuery {
+	return &GraphQuery{state: state, depsLog: depsLog}
+}
+
+// Eval evaluates the query expression.
+//
+// The nodes are returned in a stable order: words are sorted by path, the
+// functions traversing the graph return the nodes in the order they are
+// visited and somepath() returns the nodes in the path order.
+func (g *GraphQuery) Eval(expr string) ([]*Node, error) {
+	p := graphQueryParser{g: g, input: expr}
+	p.next()
+	s, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != gqEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return s.nodes, nil
+}
+
+// inputs returns the inputs of the edge generating n.
+func (g *GraphQuery) inputs(n *Node) []*Node {
+	if n.InEdge == nil {
+		return nil
+	}
+	if g.depsLog != nil {
+		if deps := g.depsLog.GetDeps(n); deps != nil && g.depsLog.IsDepsEntryLiveFor(n) {
+			return append(append([]*Node{}, n.InEdge.Inputs...), deps.Nodes...)
+		}
+	}
+	return n.InEdge.Inputs
+}
+
+// outputs returns the outputs of the edges using n as an input.
+func (g *GraphQuery) outputs(n *Node) []*Node {
+	var out []*Node
+	for _, e := range n.OutEdges {
+		out = append(out, e.Outputs...)
+	}
+	if g.depsLog != nil {
+		if g.rdeps == nil {
+			g.rdeps = map[*Node][]*Node{}
+			for id, deps := range g.depsLog.Deps {
+				if deps == nil {
+					continue
+				}
+				if o := g.depsLog.Nodes[id]; g.depsLog.IsDepsEntryLiveFor(o) {
+					for _, in := range deps.Nodes {
+						g.rdeps[in] = append(g.rdeps[in], o)
+					}
+				}
+			}
+		}
+		out = append(out, g.rdeps[n]...)
+	}
+	return out
+}
+
+// walk returns the nodes reachable from start following next, up to depth
+// levels (unlimited if negative), only visiting the nodes for which keep
+// returns true.
+func walk(start *nodeSet, depth int, next func(*Node) []*Node, keep func(*Node) bool) *nodeSet {
+	out := &nodeSet{}
+	var level []*Node
+	for _, n := range start.nodes {
+		if keep(n) && out.add(n) {
+			level = append(level, n)
+		}
+	}
+	for d := 0; len(level) != 0 && (depth < 0 || d < depth); d++ {
+		var nextLevel []*Node
+		for _, n := range level {
+			for _, m := range next(n) {
+				if keep(m) && out.add(m) {
+					nextLevel = append(nextLevel, m)
+				}
+			}
+		}
+		level = nextLevel
+	}
+	return out
+}
+
+func keepAll(*Node) bool {
+	return true
+}
+
+// nodeSet is an ordered set of nodes.
+type nodeSet struct {
+	nodes []*Node
+	has   map[*Node]struct{}
+}
+
+func (s *nodeSet) add(n *Node) bool {
+	if s.has == nil {
+		s.has = map[*Node]struct{}{}
+	}
+	if _, ok := s.has[n]; ok {
+		return false
+	}
+	s.has[n] = struct{}{}
+	s.nodes = append(s.nodes, n)
+	return true
+}
+
+func (s *nodeSet) contains(n *Node) bool {
+	_, ok := s.has[n]
+	return ok
+}
+
+// filter returns the nodes of s for which f returns true.
+func (s *nodeSet) filter(f func(*Node) bool) *nodeSet {
+	out := &nodeSet{}
+	for _, n := range s.nodes {
+		if f(n) {
+			out.add(n)
+		}
+	}
+	return out
+}
+
+type gqKind int
+
+const (
+	gqEOF gqKind = iota
+	gqWord
+	gqLParen
+	gqRParen
+	gqComma
+	gqPlus
+	gqCaret
+)
+
+var gqPunctuation = map[byte]gqKind{
+	'(': gqLParen,
+	')': gqRParen,
+	',': gqComma,
+	'+': gqPlus,
+	'^': gqCaret,
+}
+
+type gqToken struct {
+	kind   gqKind
+	value  string
+	quoted bool
+	offset int
+}
+
+func (t gqToken) String() string {
+	switch t.kind {
+	case gqEOF:
+		return "end of query"
+	case gqWord:
+		return strconv.Quote(t.value)
+	default:
+		return "'" + t.value + "'"
+	}
+}
+
+// graphQueryParser is a recursive descent parser evaluating the expression
+// as it is parsed.
+type graphQueryParser struct {
+	g     *GraphQuery
+	input string
+	ofs   int
+	tok   gqToken
+	err   error
+}
+
+func (p *graphQueryParser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("query:%d: %s", p.tok.offset+1, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token in p.tok.
+func (p *graphQueryParser) next() {
+	for p.ofs < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.ofs]) != -1 {
+		p.ofs++
+	}
+	start := p.ofs
+	p.tok = gqToken{offset: start}
+	if p.ofs == len(p.input) {
+		return
+	}
+	c := p.input[p.ofs]
+	if k, ok := gqPunctuation[c]; ok {
+		p.tok.kind = k
+		p.tok.value = string(c)
+		p.ofs++
+		return
+	}
+	switch c {
+	case '"', '\'':
+		end := strings.IndexByte(p.input[p.ofs+1:], c)
+		if end == -1 {
+			p.err = fmt.Errorf("query:%d: unterminated quote", start+1)
+			p.ofs = len(p.input)
+			return
+		}
+		p.tok.kind = gqWord
+		p.tok.value = p.input[p.ofs+1 : p.ofs+1+end]
+		p.tok.quoted = true
+		p.ofs += end + 2
+	default:
+		for p.ofs < len(p.input) && strings.IndexByte(" \t\r\n(),+^\"'", p.input[p.ofs]) == -1 {
+			p.ofs++
+		}
+		p.tok.kind = gqWord
+		p.tok.value = p.input[start:p.ofs]
+	}
+}
+
+// op returns the set operator at the current token, if any.
+func (p *graphQueryParser) op() string {
+	switch p.tok.kind {
+	case gqPlus:
+		return "union"
+	case gqCaret:
+		return "intersect"
+	case gqWord:
+		if !p.tok.quoted {
+			switch p.tok.value {
+			case "union", "intersect", "except":
+				return p.tok.value
+			case "-":
+				return "except"
+			}
+		}
+	}
+	return ""
+}
+
+func (p *graphQueryParser) expr() (*nodeSet, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.op(); op != ""; op = p.op() {
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "union":
+			for _, n := range right.nodes {
+				left.add(n)
+			}
+		case "intersect":
+			left = left.filter(right.contains)
+		case "except":
+			left = left.filter(func(n *Node) bool { return !right.contains(n) })
+		}
+	}
+	return left, nil
+}
+
+func (p *graphQueryParser) term() (*nodeSet, error) {
+	switch p.tok.kind {
+	case gqLParen:
+		p.next()
+		s, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != gqRParen {
+			return nil, p.errorf("expected ')', got %s", p.tok)
+		}
+		p.next()
+		return s, nil
+	case gqWord:
+		if p.op() != "" {
+			break
+		}
+		word := p.tok
+		p.next()
+		if !word.quoted && p.tok.kind == gqLParen {
+			p.next()
+			return p.function(word)
+		}
+		return p.word(word)
+	}
+	return nil, p.errorf("unexpected %s", p.tok)
+}
+
+// word returns the nodes named by a word.
+func (p *graphQueryParser) word(w gqToken) (*nodeSet, error) {
+	pattern := w.value
+	if prefix := strings.TrimSuffix(pattern, "..."); prefix != pattern {
+		var nodes []*Node
+		for name, n := range p.g.state.Paths {
+			if strings.HasPrefix(name, prefix) {
+				nodes = append(nodes, n)
+			}
+		}
+		return sortedSet(nodes), nil
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("query:%d: %s: %w", w.offset+1, pattern, err)
+		}
+		var nodes []*Node
+		for name, n := range p.g.state.Paths {
+			if ok, _ := path.Match(pattern, name); ok {
+				nodes = append(nodes, n)
+			}
+		}
+		return sortedSet(nodes), nil
+	}
+	n := p.g.state.Paths[CanonicalizePath(pattern)]
+	if n == nil {
+		// TODO(maruel): Use %q for real quoting.
+		return nil, fmt.Errorf("query:%d: unknown target '%s'", w.offset+1, pattern)
+	}
+	s := &nodeSet{}
+	s.add(n)
+	return s, nil
+}
+
+func sortedSet(nodes []*Node) *nodeSet {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Path < nodes[j].Path
+	})
+	s := &nodeSet{}
+	for _, n := range nodes {
+		s.add(n)
+	}
+	return s
+}
+
+// args parses the arguments of a function up to the closing parenthesis.
+//
+// The kinds describe the arguments: 'e' for an expression, 'w' for a word and
+// 'i' for an integer. The arguments after min are optional. "w*" is a list of
+// words.
+func (p *graphQueryParser) args(name string, kinds string, min int) ([]interface{}, error) {
+	var out []interface{}
+	for i := 0; ; i++ {
+		if p.tok.kind == gqRParen && (i >= min || kinds == "w*") {
+			p.next()
+			return out, nil
+		}
+		if i != 0 && kinds != "w*" {
+			if p.tok.kind != gqComma {
+				return nil, p.errorf("expected ',' or ')' in %s(), got %s", name, p.tok)
+			}
+			p.next()
+		}
+		if kinds != "w*" && i >= len(kinds) {
+			return nil, p.errorf("too many arguments to %s()", name)
+		}
+		k := byte('w')
+		if kinds != "w*" {
+			k = kinds[i]
+		}
+		switch k {
+		case 'e':
+			s, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, s)
+		case 'w', 'i':
+			if p.tok.kind != gqWord {
+				return nil, p.errorf("expected a word in %s(), got %s", name, p.tok)
+			}
+			if k == 'w' {
+				out = append(out, p.tok)
+			} else {
+				v, err := strconv.Atoi(p.tok.value)
+				if err != nil || v < 0 {
+					return nil, p.errorf("expected a depth in %s(), got %s", name, p.tok)
+				}
+				out = append(out, v)
+			}
+			p.next()
+		}
+	}
+}
+
+func (p *graphQueryParser) regexp(name string, w gqToken) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(w.value)
+	if err != nil {
+		return nil, fmt.Errorf("query:%d: %s(): %w", w.offset+1, name, err)
+	}
+	return re, nil
+}
+
+// function evaluates a function call. The opening parenthesis was read.
+func (p *graphQueryParser) function(name gqToken) (*nodeSet, error) {
+	g := p.g
+	depth := func(args []interface{}, i int) int {
+		if len(args) > i {
+			return args[i].(int)
+		}
+		return -1
+	}
+	switch name.value {
+	case "deps":
+		args, err := p.args(name.value, "ei", 1)
+		if err != nil {
+			return nil, err
+		}
+		return walk(args[0].(*nodeSet), depth(args, 1), g.inputs, keepAll), nil
+	case "rdeps":
+		args, err := p.args(name.value, "eei", 2)
+		if err != nil {
+			return nil, err
+		}
+		universe := args[0].(*nodeSet)
+		return walk(args[1].(*nodeSet), depth(args, 2), g.outputs, keepAll).filter(universe.contains), nil
+	case "kind", "filter":
+		args, err := p.args(name.value, "we", 2)
+		if err != nil {
+			return nil, err
+		}
+		re, err := p.regexp(name.value, args[0].(gqToken))
+		if err != nil {
+			return nil, err
+		}
+		if name.value == "filter" {
+			return args[1].(*nodeSet).filter(func(n *Node) bool { return re.MatchString(n.Path) }), nil
+		}
+		return args[1].(*nodeSet).filter(func(n *Node) bool {
+			kind := "source"
+			if n.InEdge != nil {
+				kind = n.InEdge.Rule.Name
+			}
+			return re.MatchString(kind)
+		}), nil
+	case "somepath":
+		args, err := p.args(name.value, "ee", 2)
+		if err != nil {
+			return nil, err
+		}
+		return g.somepath(args[0].(*nodeSet), args[1].(*nodeSet)), nil
+	case "allpaths":
+		args, err := p.args(name.value, "ee", 2)
+		if err != nil {
+			return nil, err
+		}
+		from := walk(args[0].(*nodeSet), -1, g.inputs, keepAll)
+		to := walk(args[1].(*nodeSet), -1, g.outputs, from.contains)
+		return from.filter(to.contains), nil
+	case "set":
+		args, err := p.args(name.value, "w*", 0)
+		if err != nil {
+			return nil, err
+		}
+		out := &nodeSet{}
+		for _, a := range args {
+			s, err := p.word(a.(gqToken))
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range s.nodes {
+				out.add(n)
+			}
+		}
+		return out, nil
+	}
+	// TODO(maruel): Use %q for real quoting.
+	return nil, fmt.Errorf("query:%d: unknown function '%s'", name.offset+1, name.value)
+}
+
+// somepath returns a shortest path from a node in from to a node in to.
+func (g *GraphQuery) somepath(from, to *nodeSet) *nodeSet {
+	parent := map[*Node]*Node{}
+	queue := []*Node{}
+	for _, n := range from.nodes {
+		if _, ok := parent[n]; !ok {
+			parent[n] = nil
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if to.contains(n) {
+			var path []*Node
+			for ; n != nil; n = parent[n] {
+				path = append(path, n)
+			}
+			out := &nodeSet{}
+			for i := len(path) - 1; i >= 0; i-- {
+				out.add(path[i])
+			}
+			return out
+		}
+		for _, m := range g.inputs(n) {
+			if _, ok := parent[m]; !ok {
+				parent[m] = n
+				queue = append(queue, m)
+			}
+		}
+	}
+	return &nodeSet{}
+}
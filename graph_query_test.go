@@ -0,0 +1,106 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGraphQuery(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "rule cc\n  command = cc $in\n  deps = gcc\n  depfile = $out.d\n"+
+		"build out/a.o: cc a.c | gen.h\n"+
+		"build out/b.o: cc b.c\n"+
+		"build gen.h: cat gen.in\n"+
+		"build out/lib: cat out/a.o out/b.o\n"+
+		"build all: phony out/lib\n", ParseManifestOpts{})
+	// out/b.o includes gen.h according to the deps log.
+	b := s.state.Paths["out/b.o"]
+	b.ID = 0
+	depsLog := DepsLog{Nodes: []*Node{b}, Deps: []*Deps{{Nodes: []*Node{s.state.Paths["gen.h"]}}}}
+
+	data := []struct {
+		query   string
+		depsLog bool
+		want    []string
+	}{
+		{"all", false, []string{"all"}},
+		{"deps(out/lib)", false, []string{"out/lib", "out/a.o", "out/b.o", "a.c", "gen.h", "b.c", "gen.in"}},
+		{"deps(out/lib, 1)", false, []string{"out/lib", "out/a.o", "out/b.o"}},
+		{"rdeps(..., gen.in)", false, []string{"gen.in", "gen.h", "out/a.o", "out/lib", "all"}},
+		{"rdeps(..., gen.h)", true, []string{"gen.h", "out/a.o", "out/b.o", "out/lib", "all"}},
+		{"rdeps(out/..., gen.h, 1)", false, []string{"out/a.o"}},
+		{"kind(cc, ...)", false, []string{"out/a.o", "out/b.o"}},
+		{"kind('^source$', deps(all))", false, []string{"a.c", "b.c", "gen.in"}},
+		{"filter('\\.c$', ...)", false, []string{"a.c", "b.c"}},
+		{"somepath(all, gen.in)", false, []string{"all", "out/lib", "out/a.o", "gen.h", "gen.in"}},
+		{"somepath(gen.in, all)", false, nil},
+		{"allpaths(all, gen.h)", true, []string{"all", "out/lib", "out/a.o", "out/b.o", "gen.h"}},
+		{"out/* - out/lib", false, []string{"out/a.o", "out/b.o"}},
+		{"set(b.c a.c) + gen.h", false, []string{"b.c", "a.c", "gen.h"}},
+		{"deps(out/a.o) ^ deps(out/b.o)", true, []string{"gen.h", "gen.in"}},
+		{"deps(out/a.o) intersect (deps(out/b.o) except b.c)", false, nil},
+		{"(a.c union b.c) except a.c", false, []string{"b.c"}},
+	}
+	for i, l := range data {
+		var d *DepsLog
+		if l.depsLog {
+			d = &depsLog
+		}
+		nodes, err := NewGraphQuery(&s.state, d).Eval(l.query)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		var got []string
+		for _, n := range nodes {
+			got = append(got, n.Path)
+		}
+		if diff := cmp.Diff(l.want, got); diff != "" {
+			t.Errorf("#%d: %s: %s", i, l.query, diff)
+		}
+	}
+}
+
+func TestGraphQuery_Errors(t *testing.T) {
+	s := NewStateTestWithBuiltinRules(t)
+	s.AssertParse(&s.state, "build out: cat in\n", ParseManifestOpts{})
+	data := []struct {
+		query string
+		want  string
+	}{
+		{"", "query:1: unexpected end of query"},
+		{"missing", "query:1: unknown target 'missing'"},
+		{"deps(out", "query:9: expected ',' or ')' in deps(), got end of query"},
+		{"deps(out, x)", "query:11: expected a depth in deps(), got \"x\""},
+		{"deps(out, 1, 2)", "query:14: too many arguments to deps()"},
+		{"foo(out)", "query:1: unknown function 'foo'"},
+		{"(out", "query:5: expected ')', got end of query"},
+		{"out in", "query:5: unexpected \"in\""},
+		{"out + 'in", "query:7: unterminated quote"},
+		{"filter('(', out)", "query:8: filter(): error parsing regexp: missing closing ): `(`"},
+		{"out -", "query:6: unexpected end of query"},
+	}
+	for i, l := range data {
+		_, err := NewGraphQuery(&s.state, nil).Eval(l.query)
+		if err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+		if diff := cmp.Diff(l.want, err.Error()); diff != "" {
+			t.Errorf("#%d: %s", i, diff)
+		}
+	}
+}
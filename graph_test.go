@@ -15,8 +15,11 @@
 package nin
 
 import (
+	"path/filepath"
 	"runtime"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 type GraphTest struct {
@@ -1078,3 +1081,254 @@ func TestGraphTest_PhonyDepsMtimes(t *testing.T) {
 		t.Fatal("expected true")
 	}
 }
+
+func TestGraphTest_DirtyCallback(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "build mid: cat in | implicit\nbuild out: cat mid\n", ParseManifestOpts{})
+	g.fs.Create("in", "")
+	g.fs.Create("mid", "")
+	g.fs.Create("out", "")
+	g.fs.Tick()
+	g.fs.Create("in", "")
+
+	var got []string
+	g.scan.SetDirtyCallback(func(r *DirtyReason) {
+		got = append(got, r.Kind.String()+": "+r.String())
+	})
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"source_missing: implicit has no in-edge and is missing",
+		"input_dirty: implicit is dirty",
+		"input_dirty: mid is dirty",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestGraphTest_EnvBindings(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule r\n  command = cmd $in\n  env.B = $out\n  env.A = rule\nbuild out: r in\n  env.A = edge\n  env.C = c\nbuild out2: r in\n  clear_env = 1\nbuild out3: cat in\n", ParseManifestOpts{})
+
+	edge := g.GetNode("out").InEdge
+	env, clear := edge.EvaluateEnv()
+	if diff := cmp.Diff([]string{"A=edge", "B=out", "C=c"}, env); diff != "" {
+		t.Fatal(diff)
+	}
+	if clear {
+		t.Fatal("expected false")
+	}
+	if got := edge.EvaluateCommand(true); got != "cmd in;env=A=edge\x00B=out\x00C=c" {
+		t.Fatalf("%q", got)
+	}
+	if got := edge.EvaluateCommandWithoutEnv(); got != "cmd in" {
+		t.Fatalf("%q", got)
+	}
+
+	edge = g.GetNode("out2").InEdge
+	env, clear = edge.EvaluateEnv()
+	if diff := cmp.Diff([]string{"A=rule", "B=out2"}, env); diff != "" {
+		t.Fatal(diff)
+	}
+	if !clear {
+		t.Fatal("expected true")
+	}
+	if got := edge.EvaluateCommand(true); got != "cmd in;env=A=rule\x00B=out2;clear_env" {
+		t.Fatalf("%q", got)
+	}
+
+	// The command hash of an edge without env bindings is unchanged.
+	edge = g.GetNode("out3").InEdge
+	if env, clear = edge.EvaluateEnv(); env != nil || clear {
+		t.Fatal(env, clear)
+	}
+	if got := edge.EvaluateCommand(true); got != "cat in > out3" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestGraphTest_EnvDeps(t *testing.T) {
+	t.Setenv("NIN_TEST_A", "a")
+	t.Setenv("NIN_TEST_EMPTY", "")
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule r\n  command = cmd\n  env_deps = NIN_TEST_UNSET NIN_TEST_A\nbuild out: r in\nbuild out2: r in\n  env_deps = NIN_TEST_EMPTY NIN_TEST_A NIN_TEST_A\n", ParseManifestOpts{})
+
+	edge := g.GetNode("out").InEdge
+	if got := edge.EvaluateCommand(true); got != "cmd;env_deps=NIN_TEST_A=a\x00NIN_TEST_UNSET" {
+		t.Fatalf("%q", got)
+	}
+	if got := edge.EvaluateCommandWithoutEnv(); got != "cmd" {
+		t.Fatalf("%q", got)
+	}
+	// env_deps doesn't set anything in the environment of the command.
+	if env, clear := edge.EvaluateEnv(); env != nil || clear {
+		t.Fatal(env, clear)
+	}
+	if got := edge.EvaluateCommand(false); got != "cmd" {
+		t.Fatalf("%q", got)
+	}
+
+	edge = g.GetNode("out2").InEdge
+	if got := edge.EvaluateCommand(true); got != "cmd;env_deps=NIN_TEST_A=a\x00NIN_TEST_EMPTY=" {
+		t.Fatalf("%q", got)
+	}
+
+	// Changing the value changes the command hash.
+	before := HashCommand(edge.EvaluateCommand(true))
+	t.Setenv("NIN_TEST_A", "b")
+	if before == HashCommand(edge.EvaluateCommand(true)) {
+		t.Fatal("expected different hashes")
+	}
+}
+
+func TestGraphTest_CwdBindings(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule r\n  command = cmd $in $out\n  cwd = pkg\nbuild out/a: r pkg/in\nbuild out/b: r pkg/in\n  cwd_rebase = 1\nbuild out/c: r pkg/in\n  cwd = .\n  cwd_rebase = 1\nbuild out/d: cat in\n", ParseManifestOpts{})
+
+	edge := g.state.Paths["out/a"].InEdge
+	if got := edge.Cwd(); got != "pkg" {
+		t.Fatal(got)
+	}
+	if got := edge.EvaluateCommand(false); got != "cmd pkg/in out/a" {
+		t.Fatalf("%q", got)
+	}
+	if got := edge.EvaluateCommand(true); got != "cmd pkg/in out/a;cwd=pkg" {
+		t.Fatalf("%q", got)
+	}
+
+	edge = g.state.Paths["out/b"].InEdge
+	want := "cmd in ../out/b"
+	if runtime.GOOS == "windows" {
+		want = "cmd in ..\\out\\b"
+	}
+	if got := edge.EvaluateCommand(false); got != want {
+		t.Fatalf("%q", got)
+	}
+	// The depfile is still read from the build directory.
+	if got := edge.GetUnescapedDepfile(); got != "" {
+		t.Fatalf("%q", got)
+	}
+
+	edge = g.state.Paths["out/c"].InEdge
+	if got := edge.Cwd(); got != "" {
+		t.Fatal(got)
+	}
+	if got := edge.EvaluateCommand(true); got != "cmd pkg/in out/c" {
+		t.Fatalf("%q", got)
+	}
+
+	edge = g.state.Paths["out/d"].InEdge
+	if got := edge.Cwd(); got != "" {
+		t.Fatal(got)
+	}
+}
+
+func TestGraphTest_CwdDepfile(t *testing.T) {
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, "rule catdep\n  depfile = $out.d\n  command = cat $in > $out\n  cwd = pkg\nbuild out.o: catdep pkg/foo.cc\n", ParseManifestOpts{})
+	g.fs.Create("pkg/foo.cc", "")
+	// The paths in the depfile are relative to the directory the command was
+	// run in.
+	g.fs.Create("out.o.d", "../out.o: foo.h ../other/bar.h\n")
+	g.fs.Create("out.o", "")
+	g.fs.Create("pkg/foo.h", "")
+	g.fs.Tick()
+	g.fs.Create("other/bar.h", "")
+
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out.o")); err != nil {
+		t.Fatal(err)
+	}
+	edge := g.GetNode("out.o").InEdge
+	var got []string
+	for _, n := range edge.Inputs {
+		got = append(got, n.Path)
+	}
+	if diff := cmp.Diff([]string{"pkg/foo.cc", "pkg/foo.h", "other/bar.h"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if !g.GetNode("out.o").Dirty {
+		t.Fatal("expected true")
+	}
+}
+
+func TestGraphTest_ToolDeps(t *testing.T) {
+	t.Setenv("PATH", filepath.Join("missing")+string(filepath.ListSeparator)+filepath.Join("tools"))
+	const manifest = "rule cc\n  command = FOO=1 cc $in -o $out\nbuild out: cc in\nbuild out2: cat in\n"
+	tool := filepath.Join("tools", "cc")
+
+	g := NewGraphTest(t)
+	g.AssertParse(&g.state, manifest, ParseManifestOpts{})
+	g.scan.SetToolDeps(true)
+	g.fs.Create(tool, "")
+	g.fs.Tick()
+	g.fs.Create("in", "")
+	g.fs.Create("out", "")
+	g.fs.Create("out2", "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out2")); err != nil {
+		t.Fatal(err)
+	}
+	edge := g.GetNode("out").InEdge
+	if len(edge.Inputs) != 2 || edge.Inputs[1].Path != "tools/cc" || edge.ImplicitDeps != 1 {
+		t.Fatal(edge.Inputs)
+	}
+	if g.GetNode("out").Dirty {
+		t.Fatal("expected false")
+	}
+	// cat is not found in PATH.
+	if edge = g.GetNode("out2").InEdge; len(edge.Inputs) != 1 {
+		t.Fatal(edge.Inputs)
+	}
+
+	// Updating the tool makes the output dirty.
+	g = NewGraphTest(t)
+	g.AssertParse(&g.state, manifest, ParseManifestOpts{})
+	g.scan.SetToolDeps(true)
+	g.fs.Create("in", "")
+	g.fs.Create("out", "")
+	g.fs.Tick()
+	g.fs.Create(tool, "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out")); err != nil {
+		t.Fatal(err)
+	}
+	if !g.GetNode("out").Dirty {
+		t.Fatal("expected true")
+	}
+
+	// The PATH of the command is used, not nin's.
+	g = NewGraphTest(t)
+	g.AssertParse(&g.state, "rule cc\n  command = cc $in -o $out\n  env.PATH = bin\nbuild out: cc in\nbuild out2: cc in\n  clear_env = 1\n  env.PATH =\n", ParseManifestOpts{})
+	g.scan.SetToolDeps(true)
+	g.fs.Create(tool, "")
+	g.fs.Create(filepath.Join("bin", "cc"), "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out2")); err != nil {
+		t.Fatal(err)
+	}
+	if edge = g.GetNode("out").InEdge; len(edge.Inputs) != 2 || edge.Inputs[1].Path != "bin/cc" {
+		t.Fatal(edge.Inputs)
+	}
+	if edge = g.GetNode("out2").InEdge; len(edge.Inputs) != 1 {
+		t.Fatal(edge.Inputs)
+	}
+
+	// It is opt-in.
+	g = NewGraphTest(t)
+	g.AssertParse(&g.state, manifest, ParseManifestOpts{})
+	g.fs.Create("in", "")
+	g.fs.Create("out", "")
+	g.fs.Tick()
+	g.fs.Create(tool, "")
+	if _, err := g.scan.RecomputeDirty(g.GetNode("out")); err != nil {
+		t.Fatal(err)
+	}
+	if g.GetNode("out").Dirty {
+		t.Fatal("expected false")
+	}
+}
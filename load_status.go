@@ -23,3 +23,23 @@ const (
 	LoadSuccess
 	LoadNotFound
 )
+
+// LogLoadOpts are the options when loading a build log or a deps log.
+type LogLoadOpts struct {
+	// Mmap memory maps the file instead of reading it in memory.
+	//
+	// Build log records are parsed in place and strings reference the mapping
+	// directly, so the mapping is never released. This is the fastest way to
+	// load a large log, and the pages are backed by the file instead of the
+	// heap.
+	//
+	// The deps log paths are copied instead since the file may be truncated
+	// when recovering from a corrupted record, so its mapping is released once
+	// loaded.
+	//
+	// Only has an effect on POSIX.
+	Mmap bool
+	// Concurrency is the number of goroutines used to parse records. A value
+	// of 0 or 1 parses serially.
+	Concurrency int
+}
@@ -0,0 +1,347 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ManifestChangeKind is the kind of a ManifestChange.
+type ManifestChangeKind string
+
+// Valid ManifestChangeKind values.
+const (
+	ManifestAdded   ManifestChangeKind = "added"
+	ManifestRemoved ManifestChangeKind = "removed"
+	ManifestChanged ManifestChangeKind = "changed"
+)
+
+// ManifestChange is a single semantic difference between two manifests.
+type ManifestChange struct {
+	Kind ManifestChangeKind `json:"kind"`
+	// Name is the pool name, the rule name, the first output of the build
+	// statement or the default target.
+	Name string `json:"name"`
+	// Field is what changed in a ManifestChanged change, e.g. "depth",
+	// "command", "inputs", "env" or the name of a binding. For "env", Old and
+	// New are the names of the environment variables, never their values.
+	Field string `json:"field,omitempty"`
+	// Old and New are the values before and after. One of them is empty when
+	// an input or an output is added or removed.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// ManifestDiff is the semantic difference between two manifests.
+//
+// The order of the statements and of the paths in them is ignored.
+type ManifestDiff struct {
+	Pools    []ManifestChange `json:"pools"`
+	Rules    []ManifestChange `json:"rules"`
+	Edges    []ManifestChange `json:"edges"`
+	Defaults []ManifestChange `json:"defaults"`
+}
+
+// Empty returns true if the manifests are equivalent.
+func (m *ManifestDiff) Empty() bool {
+	return len(m.Pools) == 0 && len(m.Rules) == 0 && len(m.Edges) == 0 && len(m.Defaults) == 0
+}
+
+// DiffManifests returns the semantic difference between two parsed manifests.
+//
+// Build statements are matched by their outputs, so a statement is only
+// reported as added or removed when none of its outputs is produced by the
+// other manifest. Commands, without their environment, and the bindings in
+// edgeDiffBindings are compared once evaluated.
+func DiffManifests(old, new *State) ManifestDiff {
+	return ManifestDiff{
+		Pools:    diffPools(old, new),
+		Rules:    diffRules(old, new),
+		Edges:    diffEdges(old, new),
+		Defaults: diffDefaults(old, new),
+	}
+}
+
+func diffPools(old, new *State) []ManifestChange {
+	out := []ManifestChange{}
+	names := map[string]struct{}{}
+	for name := range old.Pools {
+		names[name] = struct{}{}
+	}
+	for name := range new.Pools {
+		names[name] = struct{}{}
+	}
+	for _, name := range sortedKeys(names) {
+		o, n := old.Pools[name], new.Pools[name]
+		switch {
+		case n == nil:
+			out = append(out, ManifestChange{Kind: ManifestRemoved, Name: name, Field: "depth", Old: strconv.Itoa(o.depth)})
+		case o == nil:
+			out = append(out, ManifestChange{Kind: ManifestAdded, Name: name, Field: "depth", New: strconv.Itoa(n.depth)})
+		case o.depth != n.depth:
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: "depth", Old: strconv.Itoa(o.depth), New: strconv.Itoa(n.depth)})
+		}
+	}
+	return out
+}
+
+// manifestRules returns the rules of a manifest by name.
+//
+// Rules in subninjas are only found via the edges using them. When rules in
+// different scopes have the same name, the first one wins.
+func manifestRules(s *State) map[string]*Rule {
+	out := map[string]*Rule{}
+	for name, r := range s.Bindings.Rules {
+		if r != PhonyRule {
+			out[name] = r
+		}
+	}
+	for _, e := range s.Edges {
+		if _, ok := out[e.Rule.Name]; !ok && e.Rule != PhonyRule {
+			out[e.Rule.Name] = e.Rule
+		}
+	}
+	return out
+}
+
+func diffRules(old, new *State) []ManifestChange {
+	oldRules := manifestRules(old)
+	newRules := manifestRules(new)
+	out := []ManifestChange{}
+	names := map[string]struct{}{}
+	for name := range oldRules {
+		names[name] = struct{}{}
+	}
+	for name := range newRules {
+		names[name] = struct{}{}
+	}
+	for _, name := range sortedKeys(names) {
+		o, n := oldRules[name], newRules[name]
+		switch {
+		case n == nil:
+			out = append(out, ManifestChange{Kind: ManifestRemoved, Name: name})
+		case o == nil:
+			out = append(out, ManifestChange{Kind: ManifestAdded, Name: name})
+		default:
+			keys := map[string]struct{}{}
+			for k := range o.Bindings {
+				keys[k] = struct{}{}
+			}
+			for k := range n.Bindings {
+				keys[k] = struct{}{}
+			}
+			for _, k := range sortedKeys(keys) {
+				ov, nv := "", ""
+				if b := o.Bindings[k]; b != nil {
+					ov = b.Unparse()
+				}
+				if b := n.Bindings[k]; b != nil {
+					nv = b.Unparse()
+				}
+				if ov != nv {
+					out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: k, Old: ov, New: nv})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// edgeDiffBindings are the reserved bindings other than the command that
+// change how an edge is built. "env_deps" is the list of names, not their
+// values.
+var edgeDiffBindings = []string{"clear_env", "deps", "depfile", "dyndep", "env_deps", "generator", "msvc_deps_prefix", "restat", "rspfile"}
+
+func diffEdges(old, new *State) []ManifestChange {
+	// Match the edges by their outputs.
+	matched := map[*Edge]*Edge{}
+	var added []*Edge
+	for _, e := range new.Edges {
+		var m *Edge
+		for _, o := range e.Outputs {
+			if n := old.Paths[o.Path]; n != nil && n.InEdge != nil {
+				if _, ok := matched[n.InEdge]; !ok {
+					m = n.InEdge
+					break
+				}
+			}
+		}
+		if m == nil {
+			added = append(added, e)
+			continue
+		}
+		matched[m] = e
+	}
+	out := []ManifestChange{}
+	for _, e := range added {
+		out = append(out, ManifestChange{Kind: ManifestAdded, Name: e.Outputs[0].Path, New: e.Rule.Name})
+	}
+	for _, o := range old.Edges {
+		n := matched[o]
+		if n == nil {
+			out = append(out, ManifestChange{Kind: ManifestRemoved, Name: o.Outputs[0].Path, Old: o.Rule.Name})
+			continue
+		}
+		name := n.Outputs[0].Path
+		if o.Rule.Name != n.Rule.Name {
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: "rule", Old: o.Rule.Name, New: n.Rule.Name})
+		}
+		if o.Pool.Name != n.Pool.Name {
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: "pool", Old: o.Pool.Name, New: n.Pool.Name})
+		}
+		if oc, nc := o.EvaluateCommandWithoutEnv(), n.EvaluateCommandWithoutEnv(); oc != nc {
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: "command", Old: oc, New: nc})
+		}
+		for _, k := range edgeDiffBindings {
+			if ov, nv := o.GetBinding(k), n.GetBinding(k); ov != nv {
+				out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: k, Old: ov, New: nv})
+			}
+		}
+		out = append(out, diffEnv(name, o, n)...)
+		out = append(out, diffPaths(name, "inputs", edgeInputs(o), edgeInputs(n))...)
+		out = append(out, diffPaths(name, "outputs", edgeOutputs(o), edgeOutputs(n))...)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// diffEnv returns the "env.NAME" variables that were added, removed or whose
+// value changed. Only the names are reported since the values may be
+// secrets.
+func diffEnv(name string, old, new *Edge) []ManifestChange {
+	o := edgeEnvValues(old)
+	n := edgeEnvValues(new)
+	names := map[string]struct{}{}
+	for k := range o {
+		names[k] = struct{}{}
+	}
+	for k := range n {
+		names[k] = struct{}{}
+	}
+	out := []ManifestChange{}
+	for _, k := range sortedKeys(names) {
+		ov, oOK := o[k]
+		nv, nOK := n[k]
+		if oOK && nOK && ov == nv {
+			continue
+		}
+		c := ManifestChange{Kind: ManifestChanged, Name: name, Field: "env"}
+		if oOK {
+			c.Old = k
+		}
+		if nOK {
+			c.New = k
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// edgeEnvValues returns the environment variables set by the edge.
+func edgeEnvValues(e *Edge) map[string]string {
+	env, _ := e.EvaluateEnv()
+	out := make(map[string]string, len(env))
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		out[kv[:i]] = kv[i+1:]
+	}
+	return out
+}
+
+// edgeInputs returns the inputs of an edge, qualified by their kind.
+func edgeInputs(e *Edge) map[string]struct{} {
+	out := map[string]struct{}{}
+	for i, n := range e.Inputs {
+		switch {
+		case e.IsImplicit(i):
+			out[n.Path+" (implicit)"] = struct{}{}
+		case e.IsOrderOnly(i):
+			out[n.Path+" (order-only)"] = struct{}{}
+		default:
+			out[n.Path] = struct{}{}
+		}
+	}
+	for _, n := range e.Validations {
+		out[n.Path+" (validation)"] = struct{}{}
+	}
+	return out
+}
+
+// edgeOutputs returns the outputs of an edge, qualified by their kind.
+func edgeOutputs(e *Edge) map[string]struct{} {
+	out := map[string]struct{}{}
+	for i, n := range e.Outputs {
+		if e.isImplicitOut(i) {
+			out[n.Path+" (implicit)"] = struct{}{}
+		} else {
+			out[n.Path] = struct{}{}
+		}
+	}
+	return out
+}
+
+func diffPaths(name, field string, old, new map[string]struct{}) []ManifestChange {
+	out := []ManifestChange{}
+	for _, p := range sortedKeys(old, new) {
+		_, o := old[p]
+		_, n := new[p]
+		if !n {
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: field, Old: p})
+		} else if !o {
+			out = append(out, ManifestChange{Kind: ManifestChanged, Name: name, Field: field, New: p})
+		}
+	}
+	return out
+}
+
+func diffDefaults(old, new *State) []ManifestChange {
+	o := map[string]struct{}{}
+	for _, n := range old.Defaults {
+		o[n.Path] = struct{}{}
+	}
+	n := map[string]struct{}{}
+	for _, d := range new.Defaults {
+		n[d.Path] = struct{}{}
+	}
+	out := []ManifestChange{}
+	for _, p := range sortedKeys(o, n) {
+		if _, ok := n[p]; !ok {
+			out = append(out, ManifestChange{Kind: ManifestRemoved, Name: p})
+		} else if _, ok := o[p]; !ok {
+			out = append(out, ManifestChange{Kind: ManifestAdded, Name: p})
+		}
+	}
+	return out
+}
+
+// sortedKeys returns the sorted union of the keys of the sets.
+func sortedKeys(sets ...map[string]struct{}) []string {
+	seen := map[string]struct{}{}
+	var out []string
+	for _, s := range sets {
+		for k := range s {
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				out = append(out, k)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
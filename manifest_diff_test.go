@@ -0,0 +1,128 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffManifests(t *testing.T) {
+	old := NewState()
+	assertParseManifest(t, "pool p\n  depth = 2\n"+
+		"pool gone\n  depth = 1\n"+
+		"rule cc\n  command = cc $in -o $out\n"+
+		"rule old\n  command = old\n"+
+		"flags = -O2\n"+
+		"build a.o: cc a.c\n"+
+		"build b.o: cc b.c | b.h\n"+
+		"build c.o: cc c.c\n  pool = p\n"+
+		"build d: old\n"+
+		"build all: phony a.o b.o c.o\n"+
+		"default all\n", &old)
+
+	// Reordered, with changes.
+	new := NewState()
+	assertParseManifest(t, "rule cc\n  command = cc $flags $in -o $out\n"+
+		"rule new\n  command = new\n"+
+		"pool p\n  depth = 4\n"+
+		"flags = -O2\n"+
+		"build all: phony c.o b.o a.o\n"+
+		"build c.o: cc c.c\n  pool = p\n  flags =\n"+
+		"build b.o | b.d: cc b.c || gen.h\n"+
+		"build a.o: cc a.c\n"+
+		"build e: new\n"+
+		"default all e\n", &new)
+
+	got := DiffManifests(&old, &new)
+	want := ManifestDiff{
+		Pools: []ManifestChange{
+			{Kind: ManifestRemoved, Name: "gone", Field: "depth", Old: "1"},
+			{Kind: ManifestChanged, Name: "p", Field: "depth", Old: "2", New: "4"},
+		},
+		Rules: []ManifestChange{
+			{Kind: ManifestChanged, Name: "cc", Field: "command", Old: "cc ${in} -o ${out}", New: "cc ${flags} ${in} -o ${out}"},
+			{Kind: ManifestAdded, Name: "new"},
+			{Kind: ManifestRemoved, Name: "old"},
+		},
+		Edges: []ManifestChange{
+			{Kind: ManifestChanged, Name: "a.o", Field: "command", Old: "cc a.c -o a.o", New: "cc -O2 a.c -o a.o"},
+			{Kind: ManifestChanged, Name: "b.o", Field: "command", Old: "cc b.c -o b.o", New: "cc -O2 b.c -o b.o"},
+			{Kind: ManifestChanged, Name: "b.o", Field: "inputs", Old: "b.h (implicit)"},
+			{Kind: ManifestChanged, Name: "b.o", Field: "inputs", New: "gen.h (order-only)"},
+			{Kind: ManifestChanged, Name: "b.o", Field: "outputs", New: "b.d (implicit)"},
+			{Kind: ManifestChanged, Name: "c.o", Field: "command", Old: "cc c.c -o c.o", New: "cc  c.c -o c.o"},
+			{Kind: ManifestRemoved, Name: "d", Old: "old"},
+			{Kind: ManifestAdded, Name: "e", New: "new"},
+		},
+		Defaults: []ManifestChange{
+			{Kind: ManifestAdded, Name: "e"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+
+	if d := DiffManifests(&new, &new); !d.Empty() {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestDiffManifests_EdgeBindings(t *testing.T) {
+	old := NewState()
+	assertParseManifest(t, "rule cc\n  command = cc $in -o $out\n  deps = gcc\n  depfile = $out.d\n"+
+		"build a.o: cc a.c\n"+
+		"build b.o: cc b.c\n  restat = 1\n", &old)
+	new := NewState()
+	assertParseManifest(t, "rule cc\n  command = cc $in -o $out\n  deps = gcc\n  depfile = $out.d\n"+
+		"build a.o: cc a.c\n  deps =\n  depfile = a.d\n"+
+		"build b.o: cc b.c\n  generator = 1\n", &new)
+
+	got := DiffManifests(&old, &new)
+	want := []ManifestChange{
+		{Kind: ManifestChanged, Name: "a.o", Field: "deps", Old: "gcc"},
+		{Kind: ManifestChanged, Name: "a.o", Field: "depfile", Old: "a.o.d", New: "a.d"},
+		{Kind: ManifestChanged, Name: "b.o", Field: "generator", New: "1"},
+		{Kind: ManifestChanged, Name: "b.o", Field: "restat", Old: "1"},
+	}
+	if diff := cmp.Diff(want, got.Edges); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+	if got.Empty() {
+		t.Fatal("expected a difference")
+	}
+}
+
+func TestDiffManifests_Env(t *testing.T) {
+	t.Setenv("NIN_TEST_SECRET", "hunter2")
+	old := NewState()
+	assertParseManifest(t, "rule r\n  command = r\n"+
+		"build a: r\n  env.TOKEN = s3cret\n  env.KEEP = 1\n  env.GONE = 1\n", &old)
+	new := NewState()
+	assertParseManifest(t, "rule r\n  command = r\n"+
+		"build a: r\n  env.TOKEN = t0ken\n  env.KEEP = 1\n  env.ADDED = 1\n  env_deps = NIN_TEST_SECRET\n", &new)
+
+	got := DiffManifests(&old, &new)
+	want := []ManifestChange{
+		{Kind: ManifestChanged, Name: "a", Field: "env_deps", New: "NIN_TEST_SECRET"},
+		{Kind: ManifestChanged, Name: "a", Field: "env", New: "ADDED"},
+		{Kind: ManifestChanged, Name: "a", Field: "env", Old: "GONE"},
+		{Kind: ManifestChanged, Name: "a", Field: "env", Old: "TOKEN", New: "TOKEN"},
+	}
+	if diff := cmp.Diff(want, got.Edges); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ManifestExtractor writes a standalone manifest containing only what is
+// needed to build a set of targets.
+//
+// The bindings of each build statement are evaluated, so the resulting
+// manifest doesn't depend on the variables, includes and subninjas of the
+// original one. All the paths are relative to the build directory.
+type ManifestExtractor struct {
+	state *State
+	edges map[*Edge]struct{}
+	nodes map[*Node]struct{}
+	// defaults are the targets, written as the default statement.
+	defaults []*Node
+}
+
+// NewManifestExtractor returns an initialized ManifestExtractor.
+func NewManifestExtractor(state *State) *ManifestExtractor {
+	return &ManifestExtractor{
+		state: state,
+		edges: map[*Edge]struct{}{},
+		nodes: map[*Node]struct{}{},
+	}
+}
+
+// AddTarget adds a node, along with the build statements needed to build it
+// and its validations.
+func (m *ManifestExtractor) AddTarget(node *Node) {
+	if _, ok := m.nodes[node]; !ok {
+		m.defaults = append(m.defaults, node)
+	}
+	m.add(node)
+}
+
+func (m *ManifestExtractor) add(node *Node) {
+	if _, ok := m.nodes[node]; ok {
+		return
+	}
+	m.nodes[node] = struct{}{}
+	edge := node.InEdge
+	// Edges created by the dependency loader are not part of the manifest.
+	if edge == nil || edge.GeneratedByDepLoader {
+		return
+	}
+	if _, ok := m.edges[edge]; ok {
+		return
+	}
+	m.edges[edge] = struct{}{}
+	for _, in := range edge.Inputs {
+		m.add(in)
+	}
+	for _, v := range edge.Validations {
+		m.add(v)
+	}
+}
+
+// Write writes the manifest.
+func (m *ManifestExtractor) Write(w io.Writer) error {
+	edges := make([]*Edge, 0, len(m.edges))
+	for e := range m.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].ID < edges[j].ID
+	})
+
+	// Rules defined in different subninjas can have the same name, so rules
+	// are renamed as needed.
+	ruleNames := map[*Rule]string{}
+	used := map[string]*Rule{PhonyRule.Name: PhonyRule}
+	var rules []*Rule
+	var pools []*Pool
+	seenPools := map[*Pool]struct{}{}
+	for _, e := range edges {
+		if _, ok := ruleNames[e.Rule]; !ok {
+			name := e.Rule.Name
+			for i := 2; used[name] != nil && used[name] != e.Rule; i++ {
+				name = e.Rule.Name + "_" + strconv.Itoa(i)
+			}
+			used[name] = e.Rule
+			ruleNames[e.Rule] = name
+			if e.Rule != PhonyRule {
+				rules = append(rules, e.Rule)
+			}
+		}
+		if _, ok := seenPools[e.Pool]; !ok && e.Pool != DefaultPool && e.Pool != ConsolePool {
+			seenPools[e.Pool] = struct{}{}
+			pools = append(pools, e.Pool)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	b := bufio.NewWriter(w)
+	b.WriteString("# Extracted by nin -t extract.\n")
+	if v := m.state.Bindings.LookupVariable("builddir"); v != "" {
+		fmt.Fprintf(b, "builddir = %s\n", escapeBindingValue(v))
+	}
+	for _, p := range pools {
+		fmt.Fprintf(b, "\npool %s\n  depth = %d\n", p.Name, p.depth)
+	}
+	for _, r := range rules {
+		fmt.Fprintf(b, "\nrule %s\n", ruleNames[r])
+		keys := make([]string, 0, len(r.Bindings))
+		for k := range r.Bindings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(b, "  %s = %s\n", k, unparseEvalString(r.Bindings[k]))
+		}
+	}
+	for _, e := range edges {
+		writeExtractedEdge(b, e, ruleNames[e.Rule])
+	}
+	if len(m.defaults) != 0 {
+		b.WriteString("\ndefault")
+		for _, n := range m.defaults {
+			b.WriteString(" " + escapeManifestPath(n.Path))
+		}
+		b.WriteString("\n")
+	}
+	return b.Flush()
+}
+
+// writeExtractedEdge writes the build statement of an edge, with its bindings
+// evaluated.
+func writeExtractedEdge(b *bufio.Writer, e *Edge, rule string) {
+	b.WriteString("\nbuild")
+	explicitOuts := len(e.Outputs) - int(e.ImplicitOuts)
+	for i, o := range e.Outputs {
+		if i == explicitOuts {
+			b.WriteString(" |")
+		}
+		b.WriteString(" " + escapeManifestPath(o.Path))
+	}
+	b.WriteString(": " + rule)
+	explicitIns := len(e.Inputs) - int(e.ImplicitDeps) - int(e.OrderOnlyDeps)
+	for i, in := range e.Inputs {
+		if i == explicitIns && e.ImplicitDeps != 0 {
+			b.WriteString(" |")
+		} else if i == explicitIns+int(e.ImplicitDeps) {
+			b.WriteString(" ||")
+		}
+		b.WriteString(" " + escapeManifestPath(in.Path))
+	}
+	if len(e.Validations) != 0 {
+		b.WriteString(" |@")
+		for _, v := range e.Validations {
+			b.WriteString(" " + escapeManifestPath(v.Path))
+		}
+	}
+	b.WriteString("\n")
+	if e.Rule == PhonyRule {
+		return
+	}
+	bindings := extractBindings(e)
+	keys := make([]string, 0, len(bindings))
+	for k := range bindings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "  %s = %s\n", k, escapeBindingValue(bindings[k]))
+	}
+}
+
+// extractBindings returns the evaluated bindings of an edge.
+//
+// Every reserved binding is set on the build statement so the rule's one is
+// never used, except for values containing a newline (i.e. $in_newline in
+// rspfile_content) since a binding cannot contain one. In this case the
+// variables referenced by the rule's binding are set instead.
+func extractBindings(e *Edge) map[string]string {
+	keys := map[string]struct{}{}
+	for k := range e.Rule.Bindings {
+		keys[k] = struct{}{}
+	}
+	for env := e.Env; env != nil; env = env.Parent {
+		for k := range env.Bindings {
+			if IsReservedBinding(k) {
+				keys[k] = struct{}{}
+			}
+		}
+	}
+	cwd := e.Cwd()
+	rebase := e.rebaseDir()
+	if cwd != "" {
+		keys["cwd"] = struct{}{}
+		keys["cwd_rebase"] = struct{}{}
+	}
+	out := map[string]string{}
+	var newlines []string
+	for k := range keys {
+		v := ""
+		switch {
+		case k == "command":
+			v = e.EvaluateCommand(false)
+		case k == "depfile" || k == "dyndep" || k == "rspfile":
+			v = e.getUnescapedPath(k)
+		case k == "rspfile_content":
+			env := edgeEnv{edge: e, escapeInOut: shellEscape, rebase: rebase}
+			v = env.LookupVariable(k)
+		case k == "cwd":
+			v = cwd
+		case k == "cwd_rebase":
+			// $in and $out are already rebased in the evaluated bindings. It is
+			// only needed for the ones evaluated from the rule.
+			if rebase != "" && rebase == cwd {
+				v = "1"
+			}
+		case isEnvBinding(k):
+			env := edgeEnv{edge: e, escapeInOut: doNotEscape, rebase: rebase}
+			v = env.LookupVariable(k)
+		default:
+			v = e.GetBinding(k)
+		}
+		if strings.Contains(v, "\n") {
+			newlines = append(newlines, k)
+			continue
+		}
+		out[k] = v
+	}
+	for _, k := range newlines {
+		eval := e.Rule.Bindings[k]
+		if eval == nil {
+			continue
+		}
+		for _, t := range eval.Parsed {
+			if !t.IsSpecial || IsReservedBinding(t.Value) {
+				continue
+			}
+			if t.Value == "in" || t.Value == "out" || t.Value == "in_newline" {
+				continue
+			}
+			out[t.Value] = e.Env.LookupVariable(t.Value)
+		}
+	}
+	return out
+}
+
+// unparseEvalString returns the manifest representation of an EvalString.
+func unparseEvalString(e *EvalString) string {
+	out := ""
+	for i, t := range e.Parsed {
+		if t.IsSpecial {
+			out += "${" + t.Value + "}"
+		} else if i == 0 {
+			out += escapeBindingValue(t.Value)
+		} else {
+			out += strings.ReplaceAll(t.Value, "$", "$$")
+		}
+	}
+	return out
+}
+
+// escapeBindingValue escapes a string to be used as a binding value.
+func escapeBindingValue(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	if strings.HasPrefix(s, " ") {
+		// Leading whitespace is otherwise skipped.
+		s = "$" + s
+	}
+	return s
+}
+
+// escapeManifestPath escapes a path to be used in a build or default
+// statement.
+func escapeManifestPath(s string) string {
+	if !strings.ContainsAny(s, "$ :") {
+		return s
+	}
+	r := strings.NewReplacer("$", "$$", " ", "$ ", ":", "$:")
+	return r.Replace(s)
+}
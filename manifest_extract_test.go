@@ -0,0 +1,113 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifestExtractor(t *testing.T) {
+	p := NewParserTest(t, ParseManifestSerial)
+	p.fs.Create("sub.ninja", "cflags = -O2\nrule cc\n  command = cc $cflags -c $in -o $out\nbuild sub/b.o: cc b.c\n")
+	p.assertParse("cflags = -g\n" +
+		"builddir = out\n" +
+		"pool link_pool\n" +
+		"  depth = 2\n" +
+		"rule cc\n" +
+		"  command = cc $cflags -c $in -o $out\n" +
+		"  depfile = $out.d\n" +
+		"  deps = gcc\n" +
+		"rule link\n" +
+		"  command = link @$rspfile\n" +
+		"  rspfile = $out.rsp\n" +
+		"  rspfile_content = $in_newline $ldflags\n" +
+		"  pool = link_pool\n" +
+		"ldflags = -s\n" +
+		"build a.o: cc a$ b.c || gen.h\n" +
+		"  cflags = -Wall\n" +
+		"build gen.h: phony\n" +
+		"build unrelated.o: cc unrelated.c\n" +
+		"subninja sub.ninja\n" +
+		"build app: link a.o sub/b.o | lib.a |@ check\n" +
+		"build check: cc check.c\n")
+
+	e := NewManifestExtractor(&p.state)
+	e.AddTarget(p.state.Paths["app"])
+	var b bytes.Buffer
+	if err := e.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Extracted by nin -t extract.\n" +
+		"builddir = out\n" +
+		"\n" +
+		"pool link_pool\n" +
+		"  depth = 2\n" +
+		"\n" +
+		"rule cc\n" +
+		"  command = cc ${cflags} -c ${in} -o ${out}\n" +
+		"  depfile = ${out}.d\n" +
+		"  deps = gcc\n" +
+		"\n" +
+		"rule cc_2\n" +
+		"  command = cc ${cflags} -c ${in} -o ${out}\n" +
+		"\n" +
+		"rule link\n" +
+		"  command = link @${rspfile}\n" +
+		"  pool = link_pool\n" +
+		"  rspfile = ${out}.rsp\n" +
+		"  rspfile_content = ${in_newline} ${ldflags}\n" +
+		"\n" +
+		"build a.o: cc a$ b.c || gen.h\n" +
+		"  command = cc -Wall -c 'a b.c' -o a.o\n" +
+		"  depfile = a.o.d\n" +
+		"  deps = gcc\n" +
+		"\n" +
+		"build gen.h: phony\n" +
+		"\n" +
+		"build sub/b.o: cc_2 b.c\n" +
+		"  command = cc -O2 -c b.c -o sub/b.o\n" +
+		"\n" +
+		"build app: link a.o sub/b.o | lib.a |@ check\n" +
+		"  command = link @app.rsp\n" +
+		"  ldflags = -s\n" +
+		"  pool = link_pool\n" +
+		"  rspfile = app.rsp\n" +
+		"\n" +
+		"build check: cc check.c\n" +
+		"  command = cc -g -c check.c -o check\n" +
+		"  depfile = check.d\n" +
+		"  deps = gcc\n" +
+		"\n" +
+		"default app\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Fatalf("+want, -got: %s", diff)
+	}
+
+	// The extracted manifest must evaluate to the same commands.
+	state := NewState()
+	assertParseManifest(t, b.String(), &state)
+	for _, path := range []string{"a.o", "sub/b.o", "app", "check"} {
+		want := p.state.Paths[path].InEdge.EvaluateCommand(true)
+		if got := state.Paths[path].InEdge.EvaluateCommand(true); got != want {
+			t.Errorf("%s: want %q, got %q", path, want, got)
+		}
+	}
+	if state.Paths["unrelated.o"] != nil {
+		t.Fatal("unexpected unrelated.o")
+	}
+}
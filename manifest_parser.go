@@ -98,11 +98,12 @@ type subninja struct {
 	err      error
 	ls       lexerState // lexer state when the subninja statement was parsed.
 	env      *BindingEnv
+	chdir    string // directory the subninja is relative to.
 }
 
 // readSubninjaAsync is the goroutine that reads the subninja file in parallel
 // to the main build.ninja to reduce overall latency.
-func readSubninjaAsync(fr FileReader, filename string, ch chan<- subninja, ls lexerState, env *BindingEnv) {
+func readSubninjaAsync(fr FileReader, filename, chdir string, ch chan<- subninja, ls lexerState, env *BindingEnv) {
 	input, err := fr.ReadFile(filename)
 	ch <- subninja{
 		filename: filename,
@@ -110,5 +111,15 @@ func readSubninjaAsync(fr FileReader, filename string, ch chan<- subninja, ls le
 		err:      err,
 		ls:       ls,
 		env:      env,
+		chdir:    chdir,
 	}
 }
+
+// subninjaChdir returns the canonicalized directory of a "subninja ... chdir
+// dir" statement found in a scope relative to parent.
+func subninjaChdir(parent, dir string) string {
+	if dir = CanonicalizePath(resolveCwdPath(parent, dir)); dir == "." {
+		return ""
+	}
+	return dir
+}
@@ -445,7 +445,7 @@ func (m *manifestParserState) processDefault(d dataDefault) error {
 		if len(path) == 0 {
 			return d.evals[i].ls.Error("empty path")
 		}
-		if err := m.state.addDefault(CanonicalizePath(path)); err != nil {
+		if err := m.state.addDefault(CanonicalizePath(resolveCwdPath(d.env.chdir, path))); err != nil {
 			return d.evals[i].ls.Error(err.Error())
 		}
 	}
@@ -606,12 +606,18 @@ func (m *manifestParserState) processEdge(d dataEdge) error {
 	if d.hadIndentToken {
 		env = NewBindingEnv(d.env)
 	}
+	hasEnv := false
+	hasCwd := false
 	for _, i := range d.bindings {
 		env.Bindings[i.key] = i.eval.Evaluate(d.env)
+		hasEnv = hasEnv || isEnvBinding(i.key)
+		hasCwd = hasCwd || isCwdBinding(i.key)
 	}
 
 	edge := m.state.addEdge(rule)
 	edge.Env = env
+	edge.hasEnv = hasEnv
+	edge.hasCwd = hasCwd
 
 	if poolName := edge.GetBinding("pool"); poolName != "" {
 		pool := m.state.Pools[poolName]
@@ -628,7 +634,7 @@ func (m *manifestParserState) processEdge(d dataEdge) error {
 		if len(path) == 0 {
 			return d.lsEnd.error("empty path", d.lsRule.filename, d.lsRule.input)
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		if !m.state.addOut(edge, path, slashBits) {
 			if m.options.ErrOnDupeEdge {
 				return d.lsEnd.error("multiple rules generate "+path, d.lsRule.filename, d.lsRule.input)
@@ -655,7 +661,7 @@ func (m *manifestParserState) processEdge(d dataEdge) error {
 		if len(path) == 0 {
 			return d.lsEnd.error("empty path", d.lsRule.filename, d.lsRule.input)
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		m.state.addIn(edge, path, slashBits)
 	}
 	edge.ImplicitDeps = int32(d.implicit)
@@ -667,7 +673,7 @@ func (m *manifestParserState) processEdge(d dataEdge) error {
 		if path == "" {
 			return d.lsEnd.error("empty path", d.lsRule.filename, d.lsRule.input)
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		m.state.addValidation(edge, path, slashBits)
 	}
 
@@ -727,7 +733,7 @@ func (m *manifestParserRoutine) parseInclude() (dataInclude, error) {
 //
 // This is a stop-the-world event.
 func (m *manifestParserState) processInclude(d dataInclude) error {
-	path := d.eval.Evaluate(d.env)
+	path := resolveCwdPath(d.env.chdir, d.eval.Evaluate(d.env))
 	input, err := m.fr.ReadFile(path)
 	if err != nil {
 		// Wrap it.
@@ -763,12 +769,27 @@ func (m *manifestParserState) processInclude(d dataInclude) error {
 }
 
 // parseSubninja parses a "subninja" statement.
+//
+// "subninja <path> chdir <dir>" interprets the paths and runs the commands of
+// the subninja relative to dir.
 func (m *manifestParserRoutine) parseSubninja() (dataSubninja, error) {
 	d := dataSubninja{context: &m.manifestParserContext}
 	var err error
 	if d.eval, err = m.lexer.readEvalString(true); err != nil {
 		return d, err
 	}
+	if keyword := m.lexer.readIdent(); keyword != "" {
+		if keyword != "chdir" {
+			// TODO(maruel): Use %q for real quoting.
+			return d, m.lexer.Error(fmt.Sprintf("unexpected '%s', expected chdir", keyword))
+		}
+		if d.chdir, err = m.lexer.readEvalString(true); err != nil {
+			return d, err
+		}
+		if len(d.chdir.Parsed) == 0 {
+			return d, m.lexer.Error("expected directory")
+		}
+	}
 	d.ls = m.lexer
 	return d, m.expectToken(NEWLINE)
 }
@@ -778,11 +799,16 @@ func (m *manifestParserRoutine) parseSubninja() (dataSubninja, error) {
 func (m *manifestParserState) processSubninja(d dataSubninja, actions chan<- actionBatch) error {
 	// We can finally resolve what file path it is. Start the read to process
 	// later.
-	filename := d.eval.Evaluate(d.context.env)
+	env := d.context.env
+	filename := resolveCwdPath(env.chdir, d.eval.Evaluate(env))
+	chdir := env.chdir
+	if len(d.chdir.Parsed) != 0 {
+		chdir = subninjaChdir(chdir, d.chdir.Evaluate(env))
+	}
 	// Start the goroutine to read it asynchronously. It will send an action back.
 	// TODO(maruel): Use a workerpool, something around runtime.NumCPU() ?
 	d.context.subninjasEnqueued++
-	go m.processSubninjaReal(filename, d, actions)
+	go m.processSubninjaReal(filename, chdir, d, actions)
 	return nil
 }
 
@@ -792,7 +818,7 @@ func (m *manifestParserState) processSubninja(d dataSubninja, actions chan<- act
 //
 // Contrary to the include, here we run a separate concurrent parsing loop. The
 // state modification is still in the main loop.
-func (m *manifestParserState) processSubninjaReal(filename string, d dataSubninja, actions chan<- actionBatch) {
+func (m *manifestParserState) processSubninjaReal(filename, chdir string, d dataSubninja, actions chan<- actionBatch) {
 	input, err := m.fr.ReadFile(filename)
 	if err != nil {
 		// Wrap it.
@@ -826,6 +852,7 @@ func (m *manifestParserState) processSubninjaReal(filename string, d dataSubninj
 				state:   m.state,
 			},
 		}
+		subparser.env.chdir = chdir
 		// We must not use subparser.parseMain() here, since we want it to send the
 		// actions to the main thread. So use parse() directly. This is fine
 		// because we do not want to handle grand-children subninjas here.
@@ -906,6 +933,7 @@ type dataInclude struct {
 
 type dataSubninja struct {
 	eval    EvalString
+	chdir   EvalString
 	ls      lexer
 	context *manifestParserContext
 }
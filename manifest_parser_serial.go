@@ -193,7 +193,7 @@ func (m *manifestParserSerial) parseDefault() error {
 			return m.lexer.Error("empty path")
 
 		}
-		if err = m.state.addDefault(CanonicalizePath(path)); err != nil {
+		if err = m.state.addDefault(CanonicalizePath(resolveCwdPath(m.env.chdir, path))); err != nil {
 			return m.lexer.Error(err.Error())
 		}
 
@@ -348,6 +348,8 @@ func (m *manifestParserSerial) parseEdge() error {
 	if hasIndentToken {
 		env = NewBindingEnv(m.env)
 	}
+	hasEnv := false
+	hasCwd := false
 	for hasIndentToken {
 		key, val, err := m.parseLet()
 		if err != nil {
@@ -355,11 +357,15 @@ func (m *manifestParserSerial) parseEdge() error {
 		}
 
 		env.Bindings[key] = val.Evaluate(m.env)
+		hasEnv = hasEnv || isEnvBinding(key)
+		hasCwd = hasCwd || isCwdBinding(key)
 		hasIndentToken = m.lexer.PeekToken(INDENT)
 	}
 
 	edge := m.state.addEdge(rule)
 	edge.Env = env
+	edge.hasEnv = hasEnv
+	edge.hasCwd = hasCwd
 
 	poolName := edge.GetBinding("pool")
 	if poolName != "" {
@@ -377,7 +383,7 @@ func (m *manifestParserSerial) parseEdge() error {
 		if len(path) == 0 {
 			return m.lexer.Error("empty path")
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		if !m.state.addOut(edge, path, slashBits) {
 			if m.options.ErrOnDupeEdge {
 				return m.lexer.Error("multiple rules generate " + path)
@@ -404,7 +410,7 @@ func (m *manifestParserSerial) parseEdge() error {
 		if len(path) == 0 {
 			return m.lexer.Error("empty path")
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		m.state.addIn(edge, path, slashBits)
 	}
 	edge.ImplicitDeps = int32(implicit)
@@ -416,7 +422,7 @@ func (m *manifestParserSerial) parseEdge() error {
 		if path == "" {
 			return m.lexer.Error("empty path")
 		}
-		path, slashBits := CanonicalizePathBits(path)
+		path, slashBits := CanonicalizePathBits(resolveCwdPath(env.chdir, path))
 		m.state.addValidation(edge, path, slashBits)
 	}
 
@@ -473,7 +479,7 @@ func (m *manifestParserSerial) parseInclude() error {
 	}
 
 	// Process state.
-	path := eval.Evaluate(m.env)
+	path := resolveCwdPath(m.env.chdir, eval.Evaluate(m.env))
 	input, err := m.fr.ReadFile(path)
 	if err != nil {
 		// Wrap it.
@@ -504,12 +510,30 @@ func (m *manifestParserSerial) parseInclude() error {
 // reads the file and send the content to the channel, but not process it.
 //
 // Otherwise, it processes it serially.
+//
+// "subninja <path> chdir <dir>" interprets the paths and runs the commands of
+// the subninja relative to dir.
 func (m *manifestParserSerial) parseSubninja() error {
 	eval, err := m.lexer.readEvalString(true)
 	if err != nil {
 		return err
 	}
-	filename := eval.Evaluate(m.env)
+	filename := resolveCwdPath(m.env.chdir, eval.Evaluate(m.env))
+	chdir := m.env.chdir
+	if keyword := m.lexer.readIdent(); keyword != "" {
+		if keyword != "chdir" {
+			// TODO(maruel): Use %q for real quoting.
+			return m.lexer.Error(fmt.Sprintf("unexpected '%s', expected chdir", keyword))
+		}
+		dir, err := m.lexer.readEvalString(true)
+		if err != nil {
+			return err
+		}
+		if len(dir.Parsed) == 0 {
+			return m.lexer.Error("expected directory")
+		}
+		chdir = subninjaChdir(chdir, dir.Evaluate(m.env))
+	}
 	ls := m.lexer.lexerState
 	if err = m.expectToken(NEWLINE); err != nil {
 		return err
@@ -518,7 +542,7 @@ func (m *manifestParserSerial) parseSubninja() error {
 	if m.options.Concurrency != ParseManifestSerial {
 		// Start the goroutine to read it asynchronously. It will be processed
 		// after the main manifest.
-		go readSubninjaAsync(m.fr, filename, m.subninjas, ls, m.env)
+		go readSubninjaAsync(m.fr, filename, chdir, m.subninjas, ls, m.env)
 		m.subninjasEnqueued++
 		return nil
 	}
@@ -529,7 +553,7 @@ func (m *manifestParserSerial) parseSubninja() error {
 		// Wrap it.
 		return m.error(fmt.Sprintf("loading '%s': %s", filename, err.Error()), ls)
 	}
-	return m.processOneSubninja(filename, input, m.env)
+	return m.processOneSubninja(filename, chdir, input, m.env)
 }
 
 // processSubninjaQueue empties the queue of subninja files to process.
@@ -547,12 +571,12 @@ func (m *manifestParserSerial) processSubninjaQueue() error {
 			err = m.error(fmt.Sprintf("loading '%s': %s", s.filename, s.err.Error()), s.ls)
 			continue
 		}
-		err = m.processOneSubninja(s.filename, s.input, s.env)
+		err = m.processOneSubninja(s.filename, s.chdir, s.input, s.env)
 	}
 	return err
 }
 
-func (m *manifestParserSerial) processOneSubninja(filename string, input []byte, env *BindingEnv) error {
+func (m *manifestParserSerial) processOneSubninja(filename, chdir string, input []byte, env *BindingEnv) error {
 	subparser := manifestParserSerial{
 		fr:      m.fr,
 		options: m.options,
@@ -561,6 +585,7 @@ func (m *manifestParserSerial) processOneSubninja(filename string, input []byte,
 		// root one.
 		env: NewBindingEnv(env),
 	}
+	subparser.env.chdir = chdir
 	// Do not wrap error inside the subninja.
 	return subparser.parse(filename, input)
 }
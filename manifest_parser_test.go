@@ -740,6 +740,14 @@ func TestParserTest_Errors(t *testing.T) {
 			"subninja foo.ninja\n",
 			"input:1: loading 'foo.ninja': file does not exist\nsubninja foo.ninja\n                  ^ near here",
 		},
+		{
+			"subninja foo.ninja bar\n",
+			"input:1: unexpected 'bar', expected chdir\nsubninja foo.ninja bar\n                   ^ near here",
+		},
+		{
+			"subninja foo.ninja chdir\n",
+			"input:1: expected directory\nsubninja foo.ninja chdir\n                        ^ near here",
+		},
 		{
 			// DyndepNotInput
 			"rule touch\n  command = touch $out\nbuild result: touch\n  dyndep = notin\n",
@@ -885,6 +893,54 @@ func TestParserTest_DuplicateRuleInDifferentSubninjasWithInclude(t *testing.T) {
 	}
 }
 
+func TestParserTest_SubNinjaChdir(t *testing.T) {
+	for _, c := range concurrencyVals {
+		t.Run(c.String(), func(t *testing.T) {
+			p := NewParserTest(t, c)
+			p.fs.Create("foo/build.ninja", "include rules.ninja\nbuild out.o: cc src.c\nsubninja bar/build.ninja chdir bar\ndefault out.o\n")
+			p.fs.Create("foo/rules.ninja", "rule touch\n  command = touch $out\n  rspfile = $out.rsp\n  rspfile_content = $in\n")
+			p.fs.Create("foo/bar/build.ninja", "build x: touch y\n")
+			p.assertParse("rule cc\n  command = cc $in -o $out\n  depfile = $out.d\nsubninja foo/build.ninja chdir foo\n")
+
+			want := []string{"foo/build.ninja", "foo/rules.ninja", "foo/bar/build.ninja"}
+			if diff := cmp.Diff(want, p.fs.filesRead); diff != "" {
+				t.Error(diff)
+			}
+			if len(p.state.Defaults) != 1 || p.state.Defaults[0].Path != "foo/out.o" {
+				t.Fatal(p.state.Defaults)
+			}
+
+			edge := p.state.Paths["foo/out.o"].InEdge
+			if got := edge.Inputs[0].Path; got != "foo/src.c" {
+				t.Fatal(got)
+			}
+			if got := edge.Cwd(); got != "foo" {
+				t.Fatal(got)
+			}
+			if got := edge.EvaluateCommand(false); got != "cc src.c -o out.o" {
+				t.Fatal(got)
+			}
+			if got := edge.GetUnescapedDepfile(); got != "foo/out.o.d" {
+				t.Fatal(got)
+			}
+
+			edge = p.state.Paths["foo/bar/x"].InEdge
+			if got := edge.Inputs[0].Path; got != "foo/bar/y" {
+				t.Fatal(got)
+			}
+			if got := edge.Cwd(); got != "foo/bar" {
+				t.Fatal(got)
+			}
+			if got := edge.EvaluateCommand(true); got != "touch x;rspfile=y;cwd=foo/bar" {
+				t.Fatal(got)
+			}
+			if got := edge.GetUnescapedRspfile(); got != "foo/bar/x.rsp" {
+				t.Fatal(got)
+			}
+		})
+	}
+}
+
 func TestParserTest_SubNinjaGrandChildren(t *testing.T) {
 	// A more complicated version of TestParserTest_SubNinja.
 	for _, c := range concurrencyVals {
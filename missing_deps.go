@@ -172,13 +172,39 @@ func (m *MissingDependencyScanner) processNodeDeps(node *Node, depNodes []*Node)
 	}
 }
 
+// MissingDependencyStats is the statistics of a MissingDependencyScanner.
+type MissingDependencyStats struct {
+	// NodesProcessed is the number of nodes visited.
+	NodesProcessed int
+	// MissingDepPaths is the number of missing dependency paths.
+	MissingDepPaths int
+	// NodesMissingDeps is the number of targets with a missing dependency.
+	NodesMissingDeps int
+	// GeneratedNodes is the number of distinct generated inputs involved.
+	GeneratedNodes int
+	// GeneratorRules is the number of rules generating these inputs.
+	GeneratorRules int
+}
+
+// Stats returns the statistics collected so far.
+func (m *MissingDependencyScanner) Stats() MissingDependencyStats {
+	return MissingDependencyStats{
+		NodesProcessed:   len(m.seen),
+		MissingDepPaths:  m.missingDepPathCount,
+		NodesMissingDeps: len(m.nodesMissingDeps),
+		GeneratedNodes:   len(m.generatedNodes),
+		GeneratorRules:   len(m.generatorRules),
+	}
+}
+
 // PrintStats prints statistics to stdout.
 func (m *MissingDependencyScanner) PrintStats() {
-	fmt.Printf("Processed %d nodes.\n", len(m.seen))
+	s := m.Stats()
+	fmt.Printf("Processed %d nodes.\n", s.NodesProcessed)
 	if m.HadMissingDeps() {
-		fmt.Printf("Error: There are %d missing dependency paths.\n", m.missingDepPathCount)
+		fmt.Printf("Error: There are %d missing dependency paths.\n", s.MissingDepPaths)
 		fmt.Printf("%d targets had depfile dependencies on %d distinct generated inputs (from %d rules) without a non-depfile dep path to the generator.\n",
-			len(m.nodesMissingDeps), len(m.generatedNodes), len(m.generatorRules))
+			s.NodesMissingDeps, s.GeneratedNodes, s.GeneratorRules)
 		fmt.Printf("There might be build flakiness if any of the targets listed above are built alone, or not late enough, in a clean output directory.\n")
 	} else {
 		fmt.Printf("No missing dependencies on generated files found.\n")
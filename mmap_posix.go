@@ -0,0 +1,61 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package nin
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps a file read-only in memory.
+//
+// Unless released with munmapFile, strings referencing the mapping stay valid
+// for the lifetime of the process. It is fine for the file to be appended to, deleted
+// or renamed afterward, but it must not be truncated below its current size.
+//
+// Returns an error that matches os.IsNotExist() if the file is missing.
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := s.Size()
+	if size == 0 {
+		// mmap() refuses empty mappings.
+		return []byte{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, errors.New("file is too large to be mapped")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile releases a mapping returned by mmapFile. Nothing must reference
+// it afterward.
+func munmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,30 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "io/ioutil"
+
+// mmapFile reads the file in memory.
+//
+// TODO(maruel): Use CreateFileMapping(). A mapped file cannot be deleted or
+// renamed over on Windows, which Recompact() does, so it needs more work.
+func mmapFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+// munmapFile is a no-op, the memory is released by the garbage collector.
+func munmapFile(data []byte) error {
+	return nil
+}
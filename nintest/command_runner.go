@@ -0,0 +1,129 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nintest
+
+import (
+	"testing"
+
+	"github.com/maruel/nin"
+)
+
+// Command simulates the command of an edge. It returns the exit code and the
+// output of the command.
+type Command func(edge *nin.Edge, fs *FS) (nin.ExitStatus, string)
+
+// Touch creates the outputs of the edge.
+func Touch(edge *nin.Edge, fs *FS) (nin.ExitStatus, string) {
+	for _, out := range edge.Outputs {
+		fs.Create(out.Path, "")
+	}
+	return nin.ExitSuccess, ""
+}
+
+// Succeed does nothing and succeeds.
+func Succeed(edge *nin.Edge, fs *FS) (nin.ExitStatus, string) {
+	return nin.ExitSuccess, ""
+}
+
+// Fail does nothing and fails.
+func Fail(edge *nin.Edge, fs *FS) (nin.ExitStatus, string) {
+	return nin.ExitFailure, ""
+}
+
+// CommandRunner is a nin.CommandRunner simulating the commands with functions
+// selected by rule name.
+//
+// Commands complete as soon as they are started and are reaped in the order
+// they were started.
+type CommandRunner struct {
+	// Rules maps a rule name to the function simulating its commands.
+	Rules map[string]Command
+	// Default simulates the commands of the rules not in Rules. If nil, such a
+	// command fails the test.
+	Default Command
+	// Parallelism is the maximum number of commands running at once.
+	Parallelism int
+	// Commands are the commands started, in order.
+	Commands []string
+
+	t       testing.TB
+	fs      *FS
+	active  []*nin.Edge
+	results []nin.Result
+}
+
+// NewCommandRunner returns a CommandRunner with Touch as Default and a
+// Parallelism of 1.
+func NewCommandRunner(t testing.TB, fs *FS) *CommandRunner {
+	return &CommandRunner{
+		Rules:       map[string]Command{},
+		Default:     Touch,
+		Parallelism: 1,
+		t:           t,
+		fs:          fs,
+	}
+}
+
+// CanRunMore implements nin.CommandRunner.
+func (c *CommandRunner) CanRunMore() bool {
+	return len(c.active) < c.Parallelism
+}
+
+// StartCommand implements nin.CommandRunner.
+func (c *CommandRunner) StartCommand(edge *nin.Edge) bool {
+	for _, a := range c.active {
+		if a == edge {
+			c.t.Errorf("running same edge twice: %s", edge.Outputs[0].Path)
+			return false
+		}
+	}
+	f := c.Rules[edge.Rule.Name]
+	if f == nil {
+		f = c.Default
+	}
+	if f == nil {
+		c.t.Errorf("unexpected rule %q", edge.Rule.Name)
+		return false
+	}
+	c.Commands = append(c.Commands, edge.EvaluateCommand(false))
+	exitCode, output := f(edge, c.fs)
+	c.active = append(c.active, edge)
+	c.results = append(c.results, nin.Result{Edge: edge, ExitCode: exitCode, Output: output})
+	return true
+}
+
+// WaitForCommand implements nin.CommandRunner.
+func (c *CommandRunner) WaitForCommand(result *nin.Result) bool {
+	if len(c.results) == 0 {
+		return false
+	}
+	*result = c.results[0]
+	c.results = c.results[1:]
+	c.active = c.active[1:]
+	return true
+}
+
+// GetActiveEdges implements nin.CommandRunner.
+func (c *CommandRunner) GetActiveEdges() []*nin.Edge {
+	return c.active
+}
+
+// Abort implements nin.CommandRunner.
+func (c *CommandRunner) Abort() {
+	c.active = nil
+	c.results = nil
+}
+
+var _ nin.CommandRunner = (*CommandRunner)(nil)
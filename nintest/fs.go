@@ -0,0 +1,180 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nintest
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/maruel/nin"
+)
+
+// FS is an implementation of nin.DiskInterface that uses an in-memory
+// representation of disk state.
+//
+// Time is fake: it only moves forward with Tick(). It also logs file accesses
+// and directory creations so it can be used by tests to verify disk access
+// patterns.
+type FS struct {
+	files           map[string]file
+	directoriesMade map[string]struct{}
+	filesRead       []string
+	filesRemoved    map[string]struct{}
+	filesCreated    map[string]struct{}
+	now             nin.TimeStamp
+}
+
+// file is a single in-memory file.
+type file struct {
+	mtime     nin.TimeStamp
+	statError error
+	contents  []byte
+}
+
+// NewFS returns an empty FS. The current time is 1.
+func NewFS() *FS {
+	return &FS{
+		files:           map[string]file{},
+		directoriesMade: map[string]struct{}{},
+		filesRemoved:    map[string]struct{}{},
+		filesCreated:    map[string]struct{}{},
+		now:             1,
+	}
+}
+
+// Now returns the current fake time, used as the mtime of the files created.
+func (f *FS) Now() nin.TimeStamp {
+	return f.now
+}
+
+// Tick moves time forward; subsequent file operations will be newer than
+// previous ones.
+func (f *FS) Tick() nin.TimeStamp {
+	f.now++
+	return f.now
+}
+
+// Create creates or overwrites a file with contents at the current time.
+func (f *FS) Create(path, contents string) {
+	f.files[path] = file{mtime: f.now, contents: []byte(contents)}
+	f.filesCreated[path] = struct{}{}
+}
+
+// SetMTime sets the mtime of a file, creating it if needed.
+func (f *FS) SetMTime(path string, mtime nin.TimeStamp) {
+	i, ok := f.files[path]
+	if !ok {
+		f.filesCreated[path] = struct{}{}
+	}
+	i.mtime = mtime
+	f.files[path] = i
+}
+
+// SetStatError makes Stat(path) fail with err.
+func (f *FS) SetStatError(path string, err error) {
+	i := f.files[path]
+	i.mtime = -1
+	i.statError = err
+	f.files[path] = i
+}
+
+// Exists returns true if the file exists.
+func (f *FS) Exists(path string) bool {
+	_, ok := f.files[path]
+	return ok
+}
+
+// FilesRead returns the files read, in order, including duplicates.
+func (f *FS) FilesRead() []string {
+	return f.filesRead
+}
+
+// FilesCreated returns the sorted list of files created.
+func (f *FS) FilesCreated() []string {
+	return sortedKeys(f.filesCreated)
+}
+
+// FilesRemoved returns the sorted list of files removed.
+func (f *FS) FilesRemoved() []string {
+	return sortedKeys(f.filesRemoved)
+}
+
+// DirectoriesMade returns the sorted list of directories created.
+func (f *FS) DirectoriesMade() []string {
+	return sortedKeys(f.directoriesMade)
+}
+
+// Stat implements nin.DiskInterface.
+func (f *FS) Stat(path string) (nin.TimeStamp, error) {
+	if i, ok := f.files[path]; ok {
+		return i.mtime, i.statError
+	}
+	return 0, nil
+}
+
+// WriteFile implements nin.DiskInterface.
+func (f *FS) WriteFile(path, contents string) error {
+	f.Create(path, contents)
+	return nil
+}
+
+// MakeDir implements nin.DiskInterface.
+func (f *FS) MakeDir(path string) error {
+	f.directoriesMade[path] = struct{}{}
+	return nil
+}
+
+// ReadFile implements nin.DiskInterface.
+//
+// Like nin.RealDiskInterface, the returned buffer is terminated by a 0 byte.
+func (f *FS) ReadFile(path string) ([]byte, error) {
+	f.filesRead = append(f.filesRead, path)
+	i, ok := f.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if len(i.contents) == 0 {
+		return nil, nil
+	}
+	// Return a copy since a lot of the code modify the buffer in-place.
+	n := make([]byte, len(i.contents)+1)
+	copy(n, i.contents)
+	return n, nil
+}
+
+// RemoveFile implements nin.DiskInterface.
+func (f *FS) RemoveFile(path string) error {
+	if _, ok := f.directoriesMade[path]; ok {
+		return errors.New("can't remove directory in unit tests; not true in practice")
+	}
+	if _, ok := f.files[path]; !ok {
+		return os.ErrNotExist
+	}
+	delete(f.files, path)
+	f.filesRemoved[path] = struct{}{}
+	return nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+var _ nin.DiskInterface = (*FS)(nil)
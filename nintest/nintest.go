@@ -0,0 +1,140 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nintest contains fakes and helpers to unit test code generating
+// ninja build graphs with the nin package.
+//
+// FS is an in-memory nin.DiskInterface with controllable mtimes,
+// CommandRunner simulates commands per rule and Status logs to testing.TB.
+// AssertPlan checks the commands a build would run.
+package nintest
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+// ParseManifest parses a build.ninja content into a new State and verifies the
+// resulting graph.
+func ParseManifest(t testing.TB, input string) *nin.State {
+	state := nin.NewState()
+	AssertParse(t, &state, input)
+	return &state
+}
+
+// AssertParse parses a build.ninja content into state and verifies the
+// resulting graph.
+func AssertParse(t testing.TB, state *nin.State, input string) {
+	// Inject the terminating 0 byte. In real code, it is injected by
+	// RealDiskInterface.ReadFile.
+	if err := nin.ParseManifest(state, nil, nin.ParseManifestOpts{}, "input", []byte(input+"\x00")); err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+	VerifyGraph(t, state)
+}
+
+// GetNode returns the node for path, failing the test if it is not in state.
+func GetNode(t testing.TB, state *nin.State, path string) *nin.Node {
+	n := state.Paths[path]
+	if n == nil {
+		t.Helper()
+		t.Fatalf("node %q not found", path)
+	}
+	return n
+}
+
+// VerifyGraph verifies the consistency of the edges and nodes of state.
+func VerifyGraph(t testing.TB, state *nin.State) {
+	t.Helper()
+	for _, e := range state.Edges {
+		if len(e.Outputs) == 0 {
+			t.Fatal("all edges need at least one output")
+		}
+		for _, inNode := range e.Inputs {
+			found := false
+			for _, oe := range inNode.OutEdges {
+				if oe == e {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatal("each edge's inputs must have the edge as out-edge")
+			}
+		}
+		for _, outNode := range e.Outputs {
+			if outNode.InEdge != e {
+				t.Fatal("each edge's output must have the edge as in-edge")
+			}
+		}
+	}
+
+	// The union of all in- and out-edges of each nodes should be exactly edges.
+	nodeEdgeSet := map[*nin.Edge]struct{}{}
+	for _, n := range state.Paths {
+		if n.InEdge != nil {
+			nodeEdgeSet[n.InEdge] = struct{}{}
+		}
+		for _, oe := range n.OutEdges {
+			nodeEdgeSet[oe] = struct{}{}
+		}
+	}
+	if len(state.Edges) != len(nodeEdgeSet) {
+		t.Fatal("the union of all in- and out-edges must match State.Edges")
+	}
+}
+
+// Build builds targets with runner, using fs as the disk and a Status logging
+// to t.
+//
+// There is no build log nor deps log.
+func Build(t testing.TB, state *nin.State, fs *FS, runner *CommandRunner, config *nin.BuildConfig, targets ...string) error {
+	b := nin.NewBuilder(state, config, nil, nil, fs, NewStatus(t), 0)
+	b.SetCommandRunner(runner)
+	for _, target := range targets {
+		if _, err := b.AddTarget(GetNode(t, state, target)); err != nil {
+			return err
+		}
+	}
+	if b.AlreadyUpToDate() {
+		return nil
+	}
+	return b.Build()
+}
+
+// AssertPlan asserts the commands a build of targets would run, in order,
+// without modifying fs.
+func AssertPlan(t testing.TB, state *nin.State, fs *FS, want []string, targets ...string) {
+	t.Helper()
+	runner := NewCommandRunner(t, fs)
+	runner.Default = Succeed
+	config := nin.NewBuildConfig()
+	config.Verbosity = nin.Quiet
+	config.DryRun = true
+	if err := Build(t, state, fs, runner, &config, targets...); err != nil {
+		t.Fatal(err)
+	}
+	if want == nil {
+		want = []string{}
+	}
+	got := runner.Commands
+	if got == nil {
+		got = []string{}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected plan (-want +got):\n%s", diff)
+	}
+}
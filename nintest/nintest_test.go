@@ -0,0 +1,88 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nintest
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/maruel/nin"
+)
+
+const manifest = `rule cc
+  command = cc -c $in -o $out
+rule link
+  command = ld $in -o $out
+build a.o: cc a.c | a.h
+build b.o: cc b.c
+build prog: link a.o b.o
+`
+
+func TestAssertPlan(t *testing.T) {
+	state := ParseManifest(t, manifest)
+	fs := NewFS()
+	fs.Create("a.c", "")
+	fs.Create("a.h", "")
+	fs.Create("b.c", "")
+	AssertPlan(t, state, fs, []string{"cc -c a.c -o a.o", "cc -c b.c -o b.o", "ld a.o b.o -o prog"}, "prog")
+	// The dry run didn't create anything.
+	if fs.Exists("prog") {
+		t.Fatal("unexpected prog")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	state := ParseManifest(t, manifest)
+	fs := NewFS()
+	fs.Create("a.c", "")
+	fs.Create("a.h", "")
+	fs.Create("b.c", "")
+	config := nin.NewBuildConfig()
+	config.Verbosity = nin.Quiet
+	runner := NewCommandRunner(t, fs)
+	if err := Build(t, state, fs, runner, &config, "prog"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a.c", "a.h", "a.o", "b.c", "b.o", "prog"}, fs.FilesCreated()); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Touching the header only rebuilds a.o and prog.
+	state = ParseManifest(t, manifest)
+	fs.Tick()
+	fs.Create("a.h", "")
+	AssertPlan(t, state, fs, []string{"cc -c a.c -o a.o", "ld a.o b.o -o prog"}, "prog")
+}
+
+func TestCommandRunner_Rules(t *testing.T) {
+	state := ParseManifest(t, manifest)
+	fs := NewFS()
+	fs.Create("a.c", "")
+	fs.Create("a.h", "")
+	fs.Create("b.c", "")
+	config := nin.NewBuildConfig()
+	config.Verbosity = nin.Quiet
+	runner := NewCommandRunner(t, fs)
+	runner.Rules["link"] = Fail
+	if err := Build(t, state, fs, runner, &config, "prog"); err == nil || err.Error() != "subcommand failed" {
+		t.Fatal(err)
+	}
+	if fs.Exists("prog") {
+		t.Fatal("unexpected prog")
+	}
+	if !fs.Exists("b.o") {
+		t.Fatal("expected b.o")
+	}
+}
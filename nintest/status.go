@@ -0,0 +1,89 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nintest
+
+import (
+	"testing"
+
+	"github.com/maruel/nin"
+)
+
+// Status is a nin.Status that logs to testing.TB.
+//
+// Errors are logged, not reported as test failures, since they are the normal
+// outcome of a failing build.
+type Status struct {
+	t testing.TB
+}
+
+// NewStatus returns a Status logging to t.
+func NewStatus(t testing.TB) *Status {
+	return &Status{t: t}
+}
+
+// PlanHasTotalEdges implements nin.Status.
+func (s *Status) PlanHasTotalEdges(total int) {
+	s.t.Logf("plan has %d edges", total)
+}
+
+// BuildEdgeStarted implements nin.Status.
+func (s *Status) BuildEdgeStarted(edge *nin.Edge, startTimeMillis int32) {
+	s.t.Logf("started: %s", edge.EvaluateCommand(false))
+}
+
+// BuildEdgeFinished implements nin.Status.
+func (s *Status) BuildEdgeFinished(edge *nin.Edge, endTimeMillis int32, success bool, output string) {
+	if !success {
+		s.t.Logf("FAILED: %s\n%s", edge.EvaluateCommand(false), output)
+	} else if output != "" {
+		s.t.Logf("finished: %s\n%s", edge.EvaluateCommand(false), output)
+	}
+}
+
+// BuildEdgeDiagnostics implements nin.DiagnosticsReporter.
+func (s *Status) BuildEdgeDiagnostics(edge *nin.Edge, diags []nin.Diagnostic) {
+	for _, d := range diags {
+		s.t.Logf("%s:%d:%d: %s: %s", d.Path, d.Line, d.Column, d.Severity, d.Message)
+	}
+}
+
+// BuildLoadDyndeps implements nin.Status.
+func (s *Status) BuildLoadDyndeps() {
+}
+
+// BuildStarted implements nin.Status.
+func (s *Status) BuildStarted() {
+}
+
+// BuildFinished implements nin.Status.
+func (s *Status) BuildFinished() {
+}
+
+// Info implements nin.Status.
+func (s *Status) Info(msg string, i ...interface{}) {
+	s.t.Logf("info: "+msg, i...)
+}
+
+// Warning implements nin.Status.
+func (s *Status) Warning(msg string, i ...interface{}) {
+	s.t.Logf("warning: "+msg, i...)
+}
+
+// Error implements nin.Status.
+func (s *Status) Error(msg string, i ...interface{}) {
+	s.t.Logf("error: "+msg, i...)
+}
+
+var _ nin.Status = (*Status)(nil)
@@ -0,0 +1,103 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// OutputMode selects which edges have their output saved by OutputStore.
+type OutputMode int32
+
+const (
+	// OutputNone saves nothing.
+	OutputNone OutputMode = iota
+	// OutputAll saves the output of every edge run.
+	OutputAll
+	// OutputFailed only saves the output of the edges that failed. The record
+	// of an edge that then succeeds is removed.
+	OutputFailed
+)
+
+// StoredOutput is the output of an edge run as saved by OutputStore.
+type StoredOutput struct {
+	// Path is the first output of the edge.
+	Path     string     `json:"path"`
+	Command  string     `json:"command"`
+	ExitCode ExitStatus `json:"exit_code"`
+	// StartMillis and EndMillis are Unix timestamps in milliseconds.
+	StartMillis int64  `json:"start_ms"`
+	EndMillis   int64  `json:"end_ms"`
+	Output      string `json:"output"`
+}
+
+// OutputStore persists the output of the edges run, one file per edge keyed by
+// the edge's first output path, so it can be retrieved after the build.
+//
+// Only the last run of each edge is kept.
+type OutputStore struct {
+	Dir  string
+	Mode OutputMode
+}
+
+// fileName returns the file name for the output path.
+func (o *OutputStore) fileName(path string) string {
+	return hashFileName(o.Dir, HashCommand(path))
+}
+
+// Record saves the output of an edge run, according to Mode.
+func (o *OutputStore) Record(s *StoredOutput) error {
+	if o.Mode == OutputNone {
+		return nil
+	}
+	name := o.fileName(s.Path)
+	if o.Mode == OutputFailed && s.ExitCode == ExitSuccess {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(o.Dir, 0o777); err != nil {
+		return err
+	}
+	return WriteFileAtomic(name, b)
+}
+
+// Lookup returns the last output saved for the edge whose first output is
+// path.
+//
+// Returns an error wrapping os.ErrNotExist if nothing was saved.
+func (o *OutputStore) Lookup(path string) (*StoredOutput, error) {
+	b, err := ioutil.ReadFile(o.fileName(path))
+	if err != nil {
+		return nil, err
+	}
+	s := &StoredOutput{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %w", o.fileName(path), err)
+	}
+	if s.Path != path {
+		// Hash collision.
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return s, nil
+}
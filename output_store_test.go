@@ -0,0 +1,50 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOutputStore(t *testing.T) {
+	o := OutputStore{Dir: t.TempDir(), Mode: OutputAll}
+	if _, err := o.Lookup("out"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	want := &StoredOutput{Path: "out", Command: "cc -o out", ExitCode: 1, StartMillis: 10, EndMillis: 20, Output: "warning\n"}
+	if err := o.Record(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := o.Lookup("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Only the failures are kept: a success removes the previous record.
+	o.Mode = OutputFailed
+	if err := o.Record(&StoredOutput{Path: "out", Command: "cc -o out"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Lookup("out"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal. The child process writes to slave and
+// the parent reads its output from master.
+//
+// The output post-processing is disabled so "\n" is not converted to "\r\n",
+// making the output the same as through a pipe.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+	var unlock int32
+	if err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	if err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var t syscall.Termios
+	if err = ioctl(slave, syscall.TCGETS, unsafe.Pointer(&t)); err == nil {
+		t.Oflag &^= syscall.OPOST
+		err = ioctl(slave, syscall.TCSETS, unsafe.Pointer(&t))
+	}
+	if err != nil {
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// ioctl calls ioctl() on f without using f.Fd(), which would put the file in
+// blocking mode and tie up an OS thread for each read of a running command.
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	c, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err2 := c.Control(func(fd uintptr) {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+			err = errno
+		}
+	}); err2 != nil {
+		return err2
+	}
+	return err
+}
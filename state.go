@@ -136,6 +136,9 @@ type State struct {
 
 	Bindings *BindingEnv
 	Defaults []*Node
+
+	// modules are the C++ modules provided by the P1689 dyndep files loaded.
+	modules p1689Modules
 }
 
 //type Paths ExternalStringHashMap<Node*>::Type
@@ -14,11 +14,10 @@
 
 package nin
 
-// TODO(maruel): Create a Status (or LinePrinter?) for test cases that
-// redirect to testing.T.Log().
-
 // Status is the interface that tracks the status of a build:
 // completion fraction, printing updates.
+//
+// See nintest.Status for an implementation logging to testing.TB.
 type Status interface {
 	PlanHasTotalEdges(total int)
 	BuildEdgeStarted(edge *Edge, startTimeMillis int32)
@@ -31,3 +30,21 @@ type Status interface {
 	Warning(msg string, i ...interface{})
 	Error(msg string, i ...interface{})
 }
+
+// DiagnosticsReporter is optionally implemented by a Status to receive the
+// compiler diagnostics found in the output of the commands.
+//
+// The output is only parsed when the Status implements it.
+type DiagnosticsReporter interface {
+	// BuildEdgeDiagnostics is called after BuildEdgeFinished with the
+	// diagnostics that were not already reported during the build.
+	BuildEdgeDiagnostics(edge *Edge, diags []Diagnostic)
+}
+
+// ExitCodeReporter is optionally implemented by a Status to receive the exit
+// code of the commands.
+type ExitCodeReporter interface {
+	// BuildEdgeExitCode is called right before BuildEdgeFinished with the exit
+	// code of the command.
+	BuildEdgeExitCode(edge *Edge, exitCode ExitStatus)
+}
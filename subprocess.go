@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"os"
+	"os/exec"
 	"sync"
 	"sync/atomic"
 )
@@ -25,6 +26,34 @@ import (
 // The Go runtime already handles poll under the hood so this abstraction layer
 // has to be replaced; unless we realize that the Go runtime is too slow.
 
+// environ returns the environment of a command with env set, env being
+// "NAME=value" pairs.
+//
+// Returns nil to inherit the current environment when there's nothing to do.
+// When clear is set, the command starts from a minimal environment with only
+// the variables in minimalEnvVars.
+func environ(env []string, clear bool) []string {
+	if !clear && len(env) == 0 {
+		return nil
+	}
+	var out []string
+	if clear {
+		for _, k := range minimalEnvVars {
+			if v, ok := os.LookupEnv(k); ok {
+				out = append(out, k+"="+v)
+			}
+		}
+		// exec.Cmd inherits the environment when Env is nil.
+		if out == nil {
+			out = []string{}
+		}
+	} else {
+		out = os.Environ()
+	}
+	// exec.Cmd uses the last value of duplicate keys.
+	return append(out, env...)
+}
+
 // subprocess is the dumbest implementation, just to get going.
 type subprocess struct {
 	done     int32
@@ -49,18 +78,44 @@ func (s *subprocess) GetOutput() string {
 	return s.buf
 }
 
-func (s *subprocess) run(ctx context.Context, c string, useConsole bool) {
+// subprocessOpts are the options of a subprocess beside its command.
+type subprocessOpts struct {
+	// env is the environment of the process. The current environment is
+	// inherited when nil.
+	env []string
+	// dir is the working directory of the process. The current directory is
+	// used when empty.
+	dir        string
+	useConsole bool
+	// pty runs the process with its output attached to a pseudo-terminal
+	// instead of a pipe, so it prints colors as in a terminal. It falls back
+	// to a pipe when not supported.
+	pty bool
+}
+
+func (s *subprocess) run(ctx context.Context, c string, opts subprocessOpts) {
 	// The C++ code is fairly involved in its way to setup the process, the code
 	// here is fairly naive.
 	// TODO(maruel):  Enable skipShell. This needs more testing.
+	useConsole := opts.useConsole
 	cmd := createCmd(ctx, c, useConsole, false)
+	cmd.Env = opts.env
+	cmd.Dir = opts.dir
 	buf := bytes.Buffer{}
 	cmd.Stdout = &buf
 	cmd.Stderr = &buf
+	ran := false
 	if useConsole {
 		cmd.Stdin = os.Stdin
+	} else if opts.pty {
+		if master, slave, err := openPTY(); err == nil {
+			runPTY(cmd, master, slave, &buf)
+			ran = true
+		}
+	}
+	if !ran {
+		_ = cmd.Run()
 	}
-	_ = cmd.Run()
 	// Skip a memory copy.
 	s.buf = unsafeString(buf.Bytes())
 	// TODO(maruel): For compatibility with ninja, use ExitInterrupted (2) for
@@ -68,6 +123,38 @@ func (s *subprocess) run(ctx context.Context, c string, useConsole bool) {
 	s.exitCode = int32(cmd.ProcessState.ExitCode())
 }
 
+// runPTY runs cmd with its output attached to the pseudo-terminal slave and
+// reads it from master into buf.
+func runPTY(cmd *exec.Cmd, master, slave *os.File, buf *bytes.Buffer) {
+	defer master.Close()
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	err := cmd.Start()
+	// Close the parent's copy so reading master stops once the process and its
+	// children closed theirs.
+	slave.Close()
+	if err != nil {
+		buf.WriteString(err.Error())
+		return
+	}
+	// Linux returns EIO once the slave is closed.
+	_, _ = buf.ReadFrom(master)
+	_ = cmd.Wait()
+}
+
+// CheckPTY returns an error if the commands can't be run with their output
+// attached to a pseudo-terminal, in which case BuildConfig.UsePTY silently
+// falls back to a pipe.
+func CheckPTY() error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	slave.Close()
+	master.Close()
+	return nil
+}
+
 type subprocessSet struct {
 	ctx      context.Context
 	cancel   func()
@@ -115,17 +202,22 @@ func (s *subprocessSet) Finished() int {
 
 // Add starts a new child process.
 func (s *subprocessSet) Add(c string, useConsole bool) *subprocess {
+	return s.start(c, subprocessOpts{useConsole: useConsole})
+}
+
+// start starts a new child process with options.
+func (s *subprocessSet) start(c string, opts subprocessOpts) *subprocess {
 	subproc := &subprocess{}
 	s.wg.Add(1)
-	go s.enqueue(subproc, c, useConsole)
+	go s.enqueue(subproc, c, opts)
 	s.mu.Lock()
 	s.running = append(s.running, subproc)
 	s.mu.Unlock()
 	return subproc
 }
 
-func (s *subprocessSet) enqueue(subproc *subprocess, c string, useConsole bool) {
-	subproc.run(s.ctx, c, useConsole)
+func (s *subprocessSet) enqueue(subproc *subprocess, c string, opts subprocessOpts) {
+	subproc.run(s.ctx, c, opts)
 	// Do it before sending the channel because procDone is a blocking channel
 	// and the caller relies on Running() == 0 && Finished() == 0. Otherwise
 	// Clear() would hang.
@@ -23,6 +23,9 @@ import (
 	"syscall"
 )
 
+// minimalEnvVars are the environment variables kept with clear_env.
+var minimalEnvVars = []string{"PATH"}
+
 func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool) *exec.Cmd {
 	// The commands being run use shell redirection. The C++ version uses
 	// system() which always uses the default shell.
@@ -18,6 +18,8 @@
 package nin
 
 import (
+	"os"
+	"runtime"
 	"syscall"
 	"testing"
 )
@@ -38,3 +40,68 @@ func subprocessTestFixUlimit(t *testing.T, numHandles int) {
 		}
 	}
 }
+
+func TestSubprocessTest_Env(t *testing.T) {
+	t.Setenv("NIN_TEST_INHERITED", "inherited")
+	data := []struct {
+		env   []string
+		clear bool
+		want  string
+	}{
+		{nil, false, "inherited,\n"},
+		{[]string{"NIN_TEST_SET=set"}, false, "inherited,set\n"},
+		{[]string{"NIN_TEST_INHERITED=overridden"}, false, "overridden,\n"},
+		{[]string{"NIN_TEST_SET=set"}, true, ",set\n"},
+	}
+	for i, l := range data {
+		subprocs := newSubprocessSetTest(t)
+		subproc := subprocs.start("echo $NIN_TEST_INHERITED,$NIN_TEST_SET", subprocessOpts{env: environ(l.env, l.clear)})
+		for !subproc.Done() {
+			subprocs.DoWork()
+		}
+		if got := subproc.GetOutput(); got != l.want {
+			t.Fatalf("#%d: %q", i, got)
+		}
+	}
+}
+
+func TestSubprocessTest_Dir(t *testing.T) {
+	dir := t.TempDir()
+	subprocs := newSubprocessSetTest(t)
+	subproc := subprocs.start("pwd", subprocessOpts{dir: dir})
+	for !subproc.Done() {
+		subprocs.DoWork()
+	}
+	if got := subproc.GetOutput(); got != dir+"\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestSubprocessTest_PTY(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo-terminals are only supported on linux")
+	}
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip(err)
+	}
+	data := []struct {
+		pty  bool
+		want string
+	}{
+		{false, "pipe\nline2\n"},
+		{true, "tty\nline2\n"},
+	}
+	for i, l := range data {
+		subprocs := newSubprocessSetTest(t)
+		subproc := subprocs.start("if test -t 1 && test -t 2; then echo tty; else echo pipe; fi; echo line2 >&2; exit 3", subprocessOpts{pty: l.pty})
+		for !subproc.Done() {
+			subprocs.DoWork()
+		}
+		if got := subproc.GetOutput(); got != l.want {
+			t.Fatalf("#%d: %q", i, got)
+		}
+		if got := subproc.Finish(); got != 3 {
+			t.Fatalf("#%d: %d", i, got)
+		}
+	}
+}
@@ -21,6 +21,10 @@ import (
 	"syscall"
 )
 
+// minimalEnvVars are the environment variables kept with clear_env. Many
+// programs fail to start without SystemRoot.
+var minimalEnvVars = []string{"PATH", "SystemRoot", "TEMP", "TMP"}
+
 func createCmd(ctx context.Context, c string, useConsole, enableSkipShell bool) *exec.Cmd {
 	// The commands being run use shell redirection. The C++ version uses
 	// system() which always uses the default shell.
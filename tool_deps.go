@@ -0,0 +1,163 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// loadToolDep adds the tool binary run by the command of edge as an implicit
+// input, so that the edge is rebuilt when the tool is updated.
+//
+// The tool is the first token of the command, resolved through the PATH the
+// command is run with, i.e. taking into account the env.PATH and clear_env
+// bindings of the edge. Nothing is added if it can't be found.
+func (i *implicitDepLoader) loadToolDep(edge *Edge) {
+	if edge.Rule == PhonyRule {
+		return
+	}
+	name := commandTool(edge.EvaluateCommand(false))
+	if name == "" {
+		return
+	}
+	if strings.ContainsAny(name, `/\`) {
+		// Relative to the directory the command is run in.
+		name = resolveCwdPath(edge.Cwd(), name)
+	}
+	env, clear := edge.EvaluateEnv()
+	pathEnv := edgeGetenv(env, clear, "PATH")
+	pathExt := edgeGetenv(env, clear, "PATHEXT")
+	key := pathEnv + "\x00" + pathExt + "\x00" + name
+	path, ok := i.toolPaths[key]
+	if !ok {
+		path = lookPath(i.di, name, pathEnv, pathExt)
+		if i.toolPaths == nil {
+			i.toolPaths = map[string]string{}
+		}
+		i.toolPaths[key] = path
+	}
+	if path == "" {
+		return
+	}
+	node := i.state.GetNode(CanonicalizePathBits(path))
+	for _, n := range edge.Inputs {
+		if n == node {
+			return
+		}
+	}
+	implicitDep := i.preallocateSpace(edge, 1)
+	edge.Inputs[implicitDep] = node
+	node.OutEdges = append(node.OutEdges, edge)
+	i.createPhonyInEdge(node)
+}
+
+// commandTool returns the first token of a shell command, skipping the
+// leading environment variable assignments like "FOO=bar".
+//
+// It handles simple quoting but doesn't try to be a full shell parser.
+func commandTool(command string) string {
+	for {
+		command = strings.TrimLeft(command, " \t")
+		if command == "" {
+			return ""
+		}
+		tok := ""
+		if q := command[0]; q == '"' || q == '\'' {
+			end := strings.IndexByte(command[1:], q)
+			if end == -1 {
+				return ""
+			}
+			tok = command[1 : end+1]
+			command = command[end+2:]
+		} else {
+			end := strings.IndexAny(command, " \t")
+			if end == -1 {
+				end = len(command)
+			}
+			tok = command[:end]
+			command = command[end:]
+		}
+		if i := strings.IndexByte(tok, '='); i > 0 && !strings.ContainsAny(tok[:i], "/\\") {
+			continue
+		}
+		return tok
+	}
+}
+
+// edgeGetenv returns the value of the environment variable key for a command
+// run with the environment returned by Edge.EvaluateEnv().
+func edgeGetenv(env []string, clear bool, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if j := strings.IndexByte(env[i], '='); j >= 0 && envKeyEqual(env[i][:j], key) {
+			return env[i][j+1:]
+		}
+	}
+	if clear {
+		return ""
+	}
+	return os.Getenv(key)
+}
+
+// envKeyEqual returns true if a and b are the same environment variable.
+// They are case insensitive on Windows.
+func envKeyEqual(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// lookPath searches for the executable name in the directories listed in
+// pathEnv, using di to stat the candidates. On Windows, pathExt lists the
+// extensions to try.
+//
+// A name with a path separator is not searched in pathEnv. It returns "" if
+// not found.
+func lookPath(di DiskInterface, name, pathEnv, pathExt string) string {
+	var exts []string
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		exts = filepath.SplitList(strings.ToLower(pathExt))
+		if len(exts) == 0 {
+			exts = []string{".com", ".exe", ".bat", ".cmd"}
+		}
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return findExecutable(di, name, exts)
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if dir == "" {
+			continue
+		}
+		if p := findExecutable(di, filepath.Join(dir, name), exts); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+func findExecutable(di DiskInterface, path string, exts []string) string {
+	if mtime, err := di.Stat(path); err == nil && mtime > 0 {
+		return path
+	}
+	for _, ext := range exts {
+		if mtime, err := di.Stat(path + ext); err == nil && mtime > 0 {
+			return path + ext
+		}
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nin
+
+import "testing"
+
+func TestCommandTool(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"  cc -c foo.c", "cc"},
+		{"cc", "cc"},
+		{"FOO=1 BAR=2 ./tools/gen.py a", "./tools/gen.py"},
+		{"\"C:/Program Files/cl.exe\" /c foo.c", "C:/Program Files/cl.exe"},
+		{"'unterminated", ""},
+		{"./a=b c", "./a=b"},
+	}
+	for i, l := range data {
+		if got := commandTool(l.in); got != l.want {
+			t.Errorf("#%d: commandTool(%q) = %q; want %q", i, l.in, got, l.want)
+		}
+	}
+}
@@ -16,8 +16,11 @@ package nin
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"unsafe"
 )
 
@@ -392,6 +395,39 @@ func SpellcheckString(text string, words ...string) string {
 	return result
 }
 
+// StripAnsiEscapeCodes removes all Ansi escape codes
+// (http://www.termsys.demon.co.uk/vtansi.htm).
+func StripAnsiEscapeCodes(in string) string {
+	if strings.IndexByte(in, '\x1B') == -1 {
+		return in
+	}
+	var stripped strings.Builder
+	stripped.Grow(len(in))
+
+	for i := 0; i < len(in); i++ {
+		if in[i] != '\x1B' {
+			// Not an escape code.
+			stripped.WriteByte(in[i])
+			continue
+		}
+
+		// Only strip CSIs for now.
+		if i+1 >= len(in) {
+			break
+		}
+		if in[i+1] != '[' { // Not a CSI.
+			continue
+		}
+		i += 2
+
+		// Skip everything up to and including the next [a-zA-Z].
+		for i < len(in) && !islatinalpha(in[i]) {
+			i++
+		}
+	}
+	return stripped.String()
+}
+
 func islatinalpha(c byte) bool {
 	// isalpha() is locale-dependent.
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
@@ -536,3 +572,21 @@ func elideMiddle(str string, width int) string {
 func unsafeString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+// WriteFileAtomic writes data to a temporary file first and renames it to
+// path, so that an interrupted process doesn't leave a truncated file.
+//
+// The temporary file is path with a ".tmp" suffix.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hashFileName returns the file name in dir for the hash, as used by
+// CommandStore and OutputStore.
+func hashFileName(dir string, hash uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x", hash))
+}
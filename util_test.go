@@ -15,6 +15,9 @@
 package nin
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -296,6 +299,42 @@ func TestElideMiddle_ElideInTheMiddle(t *testing.T) {
 	}
 }
 
+func TestStripAnsiEscapeCodes_EscapeAtEnd(t *testing.T) {
+	stripped := StripAnsiEscapeCodes("foo\x1B")
+	if "foo" != stripped {
+		t.Fatalf("%+q", stripped)
+	}
+
+	stripped = StripAnsiEscapeCodes("foo\x1B[")
+	if "foo" != stripped {
+		t.Fatalf("%+q", stripped)
+	}
+}
+
+func TestStripAnsiEscapeCodes_StripColors(t *testing.T) {
+	// An actual clang warning.
+	input := "\x1B[1maffixmgr.cxx:286:15: \x1B[0m\x1B[0;1;35mwarning: \x1B[0m\x1B[1musing the result... [-Wparentheses]\x1B[0m"
+	stripped := StripAnsiEscapeCodes(input)
+	if "affixmgr.cxx:286:15: warning: using the result... [-Wparentheses]" != stripped {
+		t.Fatalf("%+q", stripped)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "a")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(p, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(p); err != nil || string(got) != content {
+			t.Fatal(string(got), err)
+		}
+	}
+	if _, err := os.Stat(p + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
 var dummyBenchmarkValue = ""
 
 // The C++ version is canonPerftest. It runs 2000000 iterations.